@@ -38,5 +38,5 @@ type Blob struct {
 func (b *Blob) Valid() bool {
 	h := b.Ref.Hash()
 	h.Write(b.Data)
-	return bytes.Equal(h.Sum(nil), b.Ref.ref.bytes())
+	return bytes.Equal(h.Sum(nil), b.Ref.hash[:])
 }
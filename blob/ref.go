@@ -40,12 +40,62 @@ type SizedRef struct {
 
 // String formats the Ref as a string.
 func (r Ref) String() string {
-	buf := getBuf(4 + 1 + 28*2)[:0]
+	buf := getBuf(1 + 1 + 4 + 1 + 28*2)[:0]
 	ref := string(r.appendString("sha2", r.hash[:], buf))
 	putBuf(buf)
 	return ref
 }
 
+// Schema reports whether r refers to a schema blob.
+func (r Ref) Schema() bool {
+	return r.schema
+}
+
+// Valid reports whether r is a non-zero Ref.
+func (r Ref) Valid() bool {
+	return r != Ref{}
+}
+
+// Digest returns the raw hash digest of r.
+func (r Ref) Digest() []byte {
+	d := r.hash
+	return d[:]
+}
+
+// RefFromDigest returns a Ref for the raw digest d, as returned by Digest.
+func RefFromDigest(d []byte, schema bool) (ref Ref, ok bool) {
+	if len(d) != len(ref.hash) {
+		return
+	}
+	copy(ref.hash[:], d)
+	ref.schema = schema
+	return ref, true
+}
+
+// Size returns the size of the referenced blob.
+func (sr SizedRef) Size() uint32 {
+	return sr.size
+}
+
+// Sized returns a SizedRef for r with the given size.
+func (r Ref) Sized(size uint32) SizedRef {
+	return SizedRef{size: size, Ref: r}
+}
+
+// RefFromHash returns a Ref for the data written to h, which must
+// have been obtained from Ref.Hash or NewHash.
+func RefFromHash(h hash.Hash, schema bool) Ref {
+	var r Ref
+	h.Sum(r.hash[:0])
+	r.schema = schema
+	return r
+}
+
+// NewHash returns a hash.Hash of the kind used for new Refs.
+func NewHash() hash.Hash {
+	return sha512.New512_224()
+}
+
 // HashName returns the name of the hash function used.
 func (r Ref) HashName() string {
 	return "sha2"
@@ -80,14 +130,17 @@ func Parse(s []byte) (ref Ref, ok bool) {
 		return
 	}
 	hex := s[7:]
-	ok := hexBytes(ref.hash[:], hex)
-	if !ok {
-		return
+	if !hexBytes(ref.hash[:], hex) {
+		return Ref{}, false
 	}
-	ref.size
 	return ref, true
 }
 
+// ParseString parses a ref from a string.
+func ParseString(s string) (ref Ref, ok bool) {
+	return Parse([]byte(s))
+}
+
 func hexVal(b byte, bad *bool) byte {
 	if '0' <= b && b <= '9' {
 		return b - '0'
@@ -111,7 +164,7 @@ var null = []byte(`null`)
 
 // UnmarshalJSON implements encoding/json
 func (r *Ref) UnmarshalJSON(d []byte) error {
-	if r.ref != nil {
+	if r.Valid() {
 		return errors.New("Can't UnmarshalJSON into a non-zero Ref")
 	}
 	if len(d) == 0 || bytes.Equal(d, null) {
@@ -121,7 +174,7 @@ func (r *Ref) UnmarshalJSON(d []byte) error {
 		return fmt.Errorf("blob: expecting a JSON string to unmarshal, got %q", d)
 	}
 	d = d[1 : len(d)-1]
-	p, ok := ParseBytes(d)
+	p, ok := Parse(d)
 	if !ok {
 		return fmt.Errorf("blobref: invalid blobref %q (%d)", d, len(d))
 	}
@@ -134,16 +187,19 @@ func (r Ref) MarshalJSON() ([]byte, error) {
 	if !r.Valid() {
 		return null, nil
 	}
-	dname := r.ref.hash()
-	bs := r.ref.bytes()
-	buf := make([]byte, 0, 3+len(dname)+len(bs)*2)
+	buf := make([]byte, 0, 2+1+1+4+1+len(r.hash)*2)
 	buf = append(buf, '"')
-	buf = r.appendString(dname, bs, buf)
+	buf = r.appendString("sha2", r.hash[:], buf)
 	buf = append(buf, '"')
 	return buf, nil
 }
 
 func (r Ref) appendString(dname string, bs, buf []byte) []byte {
+	if r.schema {
+		buf = append(buf, 'S', ':')
+	} else {
+		buf = append(buf, 'd', ':')
+	}
 	buf = append(buf, dname...)
 	buf = append(buf, '-')
 	for _, b := range bs {
@@ -0,0 +1,72 @@
+// Command repair salvages the entries of a corrupt ztream pack into a new
+// pack, and reports the parts of the pack that could not be recovered.
+//
+// Usage:
+//
+//	repair [flags] src dst
+//
+// where src is the corrupt pack and dst the new pack to create. To repair a
+// pack of a disk storage, give its directory with -dicts to read blobs
+// compressed with its dictionaries, replace the pack with the new one and
+// rebuild the index of the storage.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	diskstorage "github.com/vron/compono/storage/disk"
+	"github.com/vron/compono/storage/ztream"
+)
+
+var (
+	size    = flag.Int64("size", 0, "size of the new pack, the same as src if 0")
+	blobs   = flag.Bool("blobs", false, "verify that the entries are named by the ref of their data and hold its metadata, as in a disk storage")
+	verbose = flag.Bool("v", false, "print the entries recovered")
+	dicts   = flag.String("dicts", "", "directory of the disk storage holding the compression dictionaries of the pack")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: repair [flags] src dst")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opt := ztream.Options{FileSize: *size}
+	if *blobs {
+		opt.Verifier = diskstorage.NewVerifier()
+	}
+	if *dicts != "" {
+		d, err := diskstorage.LoadDictionaries(*dicts)
+		if err != nil {
+			fatal(err)
+		}
+		opt.Dictionaries = d
+	}
+	rep, err := ztream.Repair(flag.Arg(0), flag.Arg(1), opt)
+	if err != nil {
+		fatal(err)
+	}
+	if *verbose {
+		for _, e := range rep.Recovered {
+			fmt.Println("recovered", e.Name, e.UncompressedSize)
+		}
+	}
+	lost := int64(0)
+	for _, l := range rep.Lost {
+		fmt.Println("lost", l.Offset, l.End, l.Name, l.Err)
+		lost += l.End - l.Offset
+	}
+	fmt.Fprintf(os.Stderr, "recovered %d entries, lost %d ranges (%d bytes)\n", len(rep.Recovered), len(rep.Lost), lost)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "repair:", err)
+	os.Exit(1)
+}
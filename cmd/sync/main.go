@@ -0,0 +1,95 @@
+// Command sync copies the blobs missing in one storage from another.
+//
+// Usage:
+//
+//	sync [flags] src dst
+//
+// where src and dst are either a directory with a disk storage or the URL of
+// a blob server.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/blobsync"
+	diskstorage "github.com/vron/compono/storage/disk"
+	"github.com/vron/compono/storage/remote"
+)
+
+var (
+	dryRun     = flag.Bool("n", false, "only report what would be copied")
+	diff       = flag.Bool("diff", false, "print the refs missing in dst, implies -n")
+	schemaOnly = flag.Bool("schema", false, "only sync schema blobs")
+	dataOnly   = flag.Bool("data", false, "only sync data blobs")
+	progress   = flag.String("progress", "", "file to save progress in, to allow resuming an interrupted sync")
+	token      = flag.String("token", "", "token to authenticate with to blob servers")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sync [flags] src dst")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 || (*schemaOnly && *dataOnly) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "sync:", err)
+		os.Exit(1)
+	}
+}
+
+// run is split from main such that the storages are closed before exiting.
+func run() error {
+	src, err := open(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := open(flag.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	opt := blobsync.Options{
+		DryRun:             *dryRun || *diff,
+		ExcludeSchemaBlobs: *dataOnly,
+		ExcludeDataBlobs:   *schemaOnly,
+		ProgressFile:       *progress,
+	}
+	if *diff {
+		opt.Missing = func(sr blob.SizedRef) {
+			fmt.Println(sr.Ref, sr.Size())
+		}
+	}
+	st, err := blobsync.Sync(ctx, src, dst, opt)
+	fmt.Fprintf(os.Stderr, "checked %d, missing %d (%d bytes), copied %d\n", st.Checked, st.Missing, st.MissingSize, st.Copied)
+	return err
+}
+
+func open(s string) (storage.Storage, error) {
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		return remote.New(s, nil).WithToken(*token), nil
+	}
+	return diskstorage.Open(s, diskstorage.Options{})
+}
@@ -7,5 +7,6 @@ require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/detailyang/go-fallocate v0.0.0-20180908115635-432fa640bd2e
 	github.com/imdario/mergo v0.3.8
+	github.com/klauspost/compress v1.15.15
 	golang.org/x/tools v0.0.0-20200116203608-1c4842a210a7 // indirect
 )
@@ -0,0 +1,204 @@
+// Package access restricts what a client may do with a storage.Storage, such
+// that e.g. a backup client can be allowed to upload data and its own schema
+// blobs without being able to read anything back or create share claims.
+//
+// Since only schema blobs are interpreted, data blobs are harmless to store
+// and are allowed or denied as a whole. Schema blobs are inspected and only
+// allowed if their type is whitelisted.
+package access
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+)
+
+// ShareType is the type of schema blobs granting access to other blobs. It is
+// never allowed by the "*" wildcard, only if listed explicitly.
+const ShareType = "share"
+
+// Capabilities lists what is allowed. The zero value allows nothing.
+type Capabilities struct {
+	Read      bool // read blob contents
+	Stat      bool // stat blobs, and get the generation of the storage
+	Enumerate bool // enumerate blobs
+	Remove    bool // remove blobs, and reset the generation of the storage
+	PutData   bool // put data blobs
+	// PutSchema is the types of schema blobs that may be put, "*" allows all
+	// types except ShareType.
+	PutSchema []string
+}
+
+// Full allows everything.
+var Full = Capabilities{
+	Read:      true,
+	Stat:      true,
+	Enumerate: true,
+	Remove:    true,
+	PutData:   true,
+	PutSchema: []string{"*", ShareType},
+}
+
+// Backup allows putting data blobs and any schema blobs except shares, and
+// stating blobs to find those already uploaded.
+var Backup = Capabilities{
+	Stat:      true,
+	PutData:   true,
+	PutSchema: []string{"*"},
+}
+
+// allowsSchema reports whether a schema blob of type typ may be put.
+func (c *Capabilities) allowsSchema(typ string) bool {
+	for _, t := range c.PutSchema {
+		if t == typ || (t == "*" && typ != ShareType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Storage enforces capabilities in front of a storage.Storage. Operations
+// not allowed return os.ErrPermission.
+type Storage struct {
+	s    storage.Storage
+	caps Capabilities
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+// Restrict returns a Storage allowing only caps on s, which implements
+// storage.Generationer if s does. Closing it does not close s, such that
+// several clients can be given access to the same storage.
+func Restrict(s storage.Storage, caps Capabilities) storage.Storage {
+	r := &Storage{s: s, caps: caps}
+	if g, ok := s.(storage.Generationer); ok {
+		return &generationStorage{r, g}
+	}
+	return r
+}
+
+func (s *Storage) GetBlobs(ctx context.Context, blobs []blob.Ref) (io.ReadCloser, uint32, error) {
+	if !s.caps.Read {
+		return nil, 0, os.ErrPermission
+	}
+	return s.s.GetBlobs(ctx, blobs)
+}
+
+// PutBlob verifies the blob and, if it is a schema blob, checks its type
+// before passing it on.
+func (s *Storage) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	if !br.Schema() {
+		if !s.caps.PutData {
+			return blob.SizedRef{}, os.ErrPermission
+		}
+		return s.s.PutBlob(ctx, br, after, source)
+	}
+	if len(s.caps.PutSchema) == 0 {
+		return blob.SizedRef{}, os.ErrPermission
+	}
+	// the contents must be verified before inspecting them, or another blob
+	// than the one checked could be stored.
+	data, err := storage.ReadVerified(br, source)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	if typ, ok := schemaType(data); !ok || !s.caps.allowsSchema(typ) {
+		return blob.SizedRef{}, os.ErrPermission
+	}
+	return s.s.PutBlob(ctx, br, after, bytes.NewReader(data))
+}
+
+// schemaType returns the type of a schema blob, and false if it has none that
+// all readers agree on. encoding/json matches keys ignoring case and keeps the
+// last, while other readers may match them exactly or keep the first, so there
+// must be a single key equal to "type" ignoring case and it must be exactly
+// "type".
+func schemaType(data []byte) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return "", false
+	}
+	var typ *string
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return "", false
+		}
+		key, _ := t.(string)
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return "", false
+		}
+		if !strings.EqualFold(key, "type") {
+			continue
+		}
+		if key != "type" || typ != nil {
+			return "", false
+		}
+		typ = new(string)
+		if json.Unmarshal(v, typ) != nil {
+			return "", false
+		}
+	}
+	if t, err := dec.Token(); err != nil || t != json.Delim('}') {
+		return "", false
+	}
+	if _, err := dec.Token(); err != io.EOF || typ == nil {
+		return "", false
+	}
+	return *typ, true
+}
+
+func (s *Storage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	if !s.caps.Stat {
+		return os.ErrPermission
+	}
+	return s.s.StatBlobs(ctx, blobs, fn)
+}
+
+func (s *Storage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, filter storage.Filter) error {
+	if !s.caps.Enumerate {
+		close(dest)
+		return os.ErrPermission
+	}
+	return s.s.EnumerateBlobs(ctx, dest, filter)
+}
+
+func (s *Storage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	if !s.caps.Remove {
+		return os.ErrPermission
+	}
+	return s.s.RemoveBlobs(ctx, blobs)
+}
+
+// Close does nothing, the restricted storage is not closed.
+func (s *Storage) Close() error {
+	return nil
+}
+
+// generationStorage is a Storage of a storage.Generationer.
+type generationStorage struct {
+	*Storage
+	g storage.Generationer
+}
+
+func (s *generationStorage) StorageGeneration() (time.Time, string, error) {
+	if !s.caps.Stat {
+		return time.Time{}, "", os.ErrPermission
+	}
+	return s.g.StorageGeneration()
+}
+
+func (s *generationStorage) ResetStorageGeneration() error {
+	if !s.caps.Remove {
+		return os.ErrPermission
+	}
+	return s.g.ResetStorageGeneration()
+}
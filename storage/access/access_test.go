@@ -0,0 +1,86 @@
+package access
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/memory"
+	"github.com/vron/compono/storage/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (storage.Storage, func()) {
+		m := memory.New()
+		return Restrict(m, Full), func() { m.Close() }
+	})
+}
+
+func schemaBlob(s string) (blob.Ref, []byte) {
+	h := blob.NewHash()
+	h.Write([]byte(s))
+	return blob.RefFromHash(h, true), []byte(s)
+}
+
+func TestBackup(t *testing.T) {
+	m := memory.New()
+	defer m.Close()
+	s := Restrict(m, Backup)
+	ctx := context.Background()
+
+	put := func(br blob.Ref, d []byte) error {
+		_, err := s.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(d))
+		return err
+	}
+	dr, dd := storagetest.Blob("data", false)
+	if err := put(dr, dd); err != nil {
+		t.Error("data blob denied:", err)
+	}
+	sr, sd := storagetest.Blob("file", true)
+	if err := put(sr, sd); err != nil {
+		t.Error("schema blob denied:", err)
+	}
+	for _, s := range []string{`{"type": "share", "target": "x"}`, `{"target": "x"}`, `not json`,
+		// keys matched ignoring case by encoding/json, but not by all readers
+		`{"type":"share","TYPE":"file"}`, `{"Type": "file"}`, `{"type": "file", "type": "share"}`,
+		`{"type": "file"} trailing`} {
+		if err := put(schemaBlob(s)); err != os.ErrPermission {
+			t.Error("expected schema blob to be denied:", s, err)
+		}
+	}
+	if err := put(sr, dd); err != storage.ErrHashMismatch {
+		t.Error("expected hash mismatch, got", err)
+	}
+
+	if _, _, err := s.GetBlobs(ctx, []blob.Ref{dr}); err != os.ErrPermission {
+		t.Error("expected read to be denied, got", err)
+	}
+	ch := make(chan blob.SizedRef)
+	if err := s.EnumerateBlobs(ctx, ch, storage.Filter{}); err != os.ErrPermission {
+		t.Error("expected enumerate to be denied, got", err)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("enumeration channel not closed")
+	}
+	if err := s.RemoveBlobs(ctx, []blob.Ref{dr}); err != os.ErrPermission {
+		t.Error("expected remove to be denied, got", err)
+	}
+	n := 0
+	if err := s.StatBlobs(ctx, []blob.Ref{dr, sr}, func(blob.SizedRef) error { n++; return nil }); err != nil || n != 2 {
+		t.Error("stat failed", err, n)
+	}
+}
+
+func TestShareExplicit(t *testing.T) {
+	m := memory.New()
+	defer m.Close()
+	s := Restrict(m, Capabilities{PutSchema: []string{ShareType}})
+
+	br, d := schemaBlob(`{"type": "share"}`)
+	if _, err := s.PutBlob(context.Background(), br, blob.Ref{}, bytes.NewReader(d)); err != nil {
+		t.Error("explicitly allowed share denied:", err)
+	}
+}
@@ -0,0 +1,261 @@
+// Package blobsync copies the blobs missing in one storage from another.
+//
+// Both storages are enumerated in parallel, which since enumeration is sorted
+// finds the missing blobs without transferring anything but refs. Data blobs
+// are synced before schema blobs, such that a schema blob never arrives before
+// the data it refers to.
+package blobsync
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+)
+
+// Options to configure a sync.
+type Options struct {
+	// DryRun finds the missing blobs without copying them.
+	DryRun bool
+	// ExcludeSchemaBlobs and ExcludeDataBlobs skip syncing those kinds of blobs.
+	ExcludeSchemaBlobs bool
+	ExcludeDataBlobs   bool
+	// ProgressFile, if set, is where progress is saved such that an
+	// interrupted sync can be resumed. It is removed when the sync completes.
+	// The progress is never saved past a blob dst acknowledged with
+	// storage.ErrPending, unless dst can be waited on until it is durable.
+	ProgressFile string
+	// ProgressInterval is the number of blobs copied between saving the
+	// progress. If <= 0 it defaults to 100.
+	ProgressInterval int
+	// Missing, if set, is called for every blob missing in the destination.
+	Missing func(blob.SizedRef)
+}
+
+// Stats summarizes a sync.
+type Stats struct {
+	Checked     int   // blobs found in the source
+	Missing     int   // blobs missing in the destination
+	MissingSize int64 // the total size of the missing blobs
+	Copied      int   // blobs copied to the destination
+}
+
+// progress is saved to the progress file. Each field is the ref after which
+// to continue that pass.
+type progress struct {
+	Data   string `json:"data,omitempty"`
+	Schema string `json:"schema,omitempty"`
+	// DataDone is set when the data pass has completed.
+	DataDone bool `json:"dataDone,omitempty"`
+}
+
+// Sync copies the blobs in src that are missing in dst.
+func Sync(ctx context.Context, src, dst storage.Storage, opt Options) (st Stats, err error) {
+	if opt.ProgressInterval <= 0 {
+		opt.ProgressInterval = 100
+	}
+	var p progress
+	if opt.ProgressFile != "" && !opt.DryRun {
+		if p, err = readProgress(opt.ProgressFile); err != nil {
+			return st, err
+		}
+	}
+
+	done := true
+	if !opt.ExcludeDataBlobs && !p.DataDone {
+		durable, err := syncPass(ctx, src, dst, opt, storage.Filter{After: p.Data, ExcludeSchemaBlobs: true}, &st, func(after string) error {
+			p.Data = after
+			return saveProgress(opt, p)
+		})
+		if err != nil {
+			return st, err
+		}
+		p.DataDone = durable
+		if err := saveProgress(opt, p); err != nil {
+			return st, err
+		}
+		done = durable
+	}
+	if !opt.ExcludeSchemaBlobs {
+		durable, err := syncPass(ctx, src, dst, opt, storage.Filter{After: p.Schema, ExcludeDataBlobs: true}, &st, func(after string) error {
+			p.Schema = after
+			return saveProgress(opt, p)
+		})
+		if err != nil {
+			return st, err
+		}
+		done = done && durable
+	}
+
+	// blobs not known to be durable are checked again when resumed
+	if opt.ProgressFile != "" && !opt.DryRun && done {
+		if err := os.Remove(opt.ProgressFile); err != nil && !os.IsNotExist(err) {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+// durableWaiter is implemented by storages that acknowledge blobs with
+// storage.ErrPending before they are durable, and can wait for them to be,
+// such as the disk storage.
+type durableWaiter interface {
+	WaitDurable(ctx context.Context, br blob.Ref) error
+}
+
+// syncPass syncs the blobs matching filter, calling save with the ref after
+// which to resume every opt.ProgressInterval copied blobs, and reports
+// whether all blobs copied are known to be durable in dst. A blob acknowledged
+// with storage.ErrPending could be lost if dst crashes, so the progress is
+// only saved past it once waited on, if dst is a durableWaiter.
+func syncPass(ctx context.Context, src, dst storage.Storage, opt Options, filter storage.Filter, st *Stats, save func(after string) error) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	srcc, srcErr := enumerate(ctx, src, filter)
+	dstc, dstErr := enumerate(ctx, dst, filter)
+	defer func() {
+		cancel()
+		for range srcc {
+		}
+		for range dstc {
+		}
+	}()
+
+	// an enumeration of dst ending in an error must stop the sync at once,
+	// else every blob after it would be taken as missing and copied.
+	var cur blob.SizedRef
+	more := true
+	next := func() error {
+		if cur, more = <-dstc; !more {
+			return <-dstErr
+		}
+		return nil
+	}
+	if err := next(); err != nil {
+		return false, err
+	}
+
+	waiter, _ := dst.(durableWaiter)
+	var pending []blob.Ref
+	// after is the last blob copied which it and all before are durable
+	after := ""
+	checkpoint := func(last blob.Ref) error {
+		if waiter != nil {
+			for _, br := range pending {
+				if err := waiter.WaitDurable(ctx, br); err != nil {
+					return err
+				}
+			}
+			pending, after = nil, last.String()
+		}
+		if after == "" {
+			return nil
+		}
+		return save(after)
+	}
+	copied := 0
+	var last blob.Ref
+	for sr := range srcc {
+		st.Checked++
+		for more && cur.Less(sr.Ref) {
+			if err := next(); err != nil {
+				return false, err
+			}
+		}
+		if more && cur.Ref == sr.Ref {
+			continue
+		}
+
+		st.Missing++
+		st.MissingSize += int64(sr.Size())
+		if opt.Missing != nil {
+			opt.Missing(sr)
+		}
+		if opt.DryRun {
+			continue
+		}
+		durable, err := copyBlob(ctx, src, dst, sr.Ref)
+		if err != nil {
+			return false, err
+		}
+		if !durable {
+			pending = append(pending, sr.Ref)
+		} else if len(pending) == 0 {
+			after = sr.String()
+		}
+		last = sr.Ref
+		st.Copied++
+		copied++
+		if copied%opt.ProgressInterval == 0 {
+			if err := checkpoint(last); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := <-srcErr; err != nil {
+		return false, err
+	}
+	if copied > 0 {
+		if err := checkpoint(last); err != nil {
+			return false, err
+		}
+	}
+	return len(pending) == 0, nil
+}
+
+func enumerate(ctx context.Context, s storage.Storage, filter storage.Filter) (<-chan blob.SizedRef, <-chan error) {
+	ch := make(chan blob.SizedRef, 256)
+	errc := make(chan error, 1)
+	go func() { errc <- s.EnumerateBlobs(ctx, ch, filter) }()
+	return ch, errc
+}
+
+// copyBlob copies br from src to dst, and reports whether it is durable in
+// dst, which it is not if acknowledged with storage.ErrPending.
+func copyBlob(ctx context.Context, src, dst storage.Storage, br blob.Ref) (bool, error) {
+	rc, _, err := src.GetBlobs(ctx, []blob.Ref{br})
+	if os.IsNotExist(err) {
+		// removed since it was enumerated
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	_, err = dst.PutBlob(ctx, br, blob.Ref{}, storage.VerifyingReader(br, rc))
+	if err == storage.ErrPending {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func readProgress(fn string) (p progress, err error) {
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(b, &p)
+	return p, err
+}
+
+func saveProgress(opt Options, p progress) error {
+	if opt.ProgressFile == "" || opt.DryRun {
+		return nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := opt.ProgressFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, opt.ProgressFile)
+}
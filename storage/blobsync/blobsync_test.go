@@ -0,0 +1,199 @@
+package blobsync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/memory"
+	"github.com/vron/compono/storage/storagetest"
+)
+
+func fill(t *testing.T, s storage.Storage, from, to int) {
+	for i := from; i < to; i++ {
+		br, d := storagetest.Blob(strconv.Itoa(i), i%3 == 0)
+		storagetest.Put(t, s, br, d)
+	}
+}
+
+func TestSync(t *testing.T) {
+	src, dst := memory.New(), memory.New()
+	defer src.Close()
+	defer dst.Close()
+	fill(t, src, 0, 100)
+	fill(t, dst, 50, 120)
+
+	var missing []blob.SizedRef
+	st, err := Sync(context.Background(), src, dst, Options{DryRun: true, Missing: func(sr blob.SizedRef) {
+		missing = append(missing, sr)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Checked != 100 || st.Missing != 50 || st.Copied != 0 || len(missing) != 50 {
+		t.Error("unexpected dry run stats", st, len(missing))
+	}
+	// data blobs are reported before schema blobs
+	if missing[0].Schema() || !missing[len(missing)-1].Schema() {
+		t.Error("expected data blobs to be synced first")
+	}
+
+	st, err = Sync(context.Background(), src, dst, Options{ExcludeSchemaBlobs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Copied == 0 || st.Copied == 50 {
+		t.Error("expected only data blobs to be copied", st)
+	}
+	st, err = Sync(context.Background(), src, dst, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Copied+st.Checked-st.Missing != 100 || len(storagetest.Enumerate(t, dst, storage.Filter{})) != 120 {
+		t.Error("expected all blobs to be synced", st)
+	}
+}
+
+// failing fails all puts after n.
+type failing struct {
+	storage.Storage
+	n int
+}
+
+func (f *failing) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	if f.n == 0 {
+		return blob.SizedRef{}, errors.New("failing")
+	}
+	f.n--
+	return f.Storage.PutBlob(ctx, br, after, source)
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pf := filepath.Join(dir, "progress")
+
+	src, dst := memory.New(), memory.New()
+	defer src.Close()
+	defer dst.Close()
+	fill(t, src, 0, 100)
+
+	opt := Options{ProgressFile: pf, ProgressInterval: 10}
+	if _, err := Sync(context.Background(), src, &failing{dst, 35}, opt); err == nil {
+		t.Fatal("expected the sync to fail")
+	}
+	if _, err := os.Stat(pf); err != nil {
+		t.Fatal("expected progress to be saved", err)
+	}
+
+	st, err := Sync(context.Background(), src, dst, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Checked > 100-30 {
+		t.Error("expected the sync to resume after the saved progress", st)
+	}
+	if n := len(storagetest.Enumerate(t, dst, storage.Filter{})); n != 100 {
+		t.Error("expected all blobs after resuming", n)
+	}
+	if _, err := os.Stat(pf); !os.IsNotExist(err) {
+		t.Error("expected progress file to be removed after completing")
+	}
+}
+
+// brokenEnum fails to enumerate its blobs.
+type brokenEnum struct {
+	storage.Storage
+}
+
+func (b brokenEnum) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, filter storage.Filter) error {
+	close(dest)
+	return errors.New("broken")
+}
+
+func TestDestinationEnumerateError(t *testing.T) {
+	src, dst := memory.New(), memory.New()
+	defer src.Close()
+	defer dst.Close()
+	fill(t, src, 0, 10)
+
+	st, err := Sync(context.Background(), src, brokenEnum{dst}, Options{})
+	if err == nil || st.Copied != 0 {
+		t.Error("expected the sync to stop before copying anything", st, err)
+	}
+	if n := len(storagetest.Enumerate(t, dst, storage.Filter{})); n != 0 {
+		t.Error("expected no blobs to be copied", n)
+	}
+}
+
+// pendingPuts acknowledges all puts with storage.ErrPending.
+type pendingPuts struct {
+	storage.Storage
+}
+
+func (p pendingPuts) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	sr, err := p.Storage.PutBlob(ctx, br, after, source)
+	if err != nil {
+		return sr, err
+	}
+	return sr, storage.ErrPending
+}
+
+// waitedPuts is pendingPuts that can be waited on.
+type waitedPuts struct {
+	pendingPuts
+	waited map[blob.Ref]bool
+}
+
+func (w waitedPuts) WaitDurable(ctx context.Context, br blob.Ref) error {
+	w.waited[br] = true
+	return nil
+}
+
+func TestPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pf := filepath.Join(dir, "progress")
+
+	src := memory.New()
+	defer src.Close()
+	fill(t, src, 0, 100)
+
+	// the progress is not saved past blobs that may be lost
+	dst := memory.New()
+	defer dst.Close()
+	opt := Options{ProgressFile: pf, ProgressInterval: 10}
+	if _, err := Sync(context.Background(), src, pendingPuts{dst}, opt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pf); err != nil {
+		t.Error("expected the progress to be kept", err)
+	}
+	if p, err := readProgress(pf); err != nil || p.Data != "" || p.DataDone || p.Schema != "" {
+		t.Error("expected no progress past pending blobs", p, err)
+	}
+
+	// unless they can be waited on
+	dst2 := memory.New()
+	defer dst2.Close()
+	w := waitedPuts{pendingPuts{dst2}, map[blob.Ref]bool{}}
+	if _, err := Sync(context.Background(), src, w, opt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pf); !os.IsNotExist(err) || len(w.waited) != 100 {
+		t.Error("expected the sync to complete once waited on", len(w.waited), err)
+	}
+}
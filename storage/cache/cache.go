@@ -0,0 +1,373 @@
+// Package cache implements a read-through cache in front of a slow
+// storage.Storage, keeping fetched blobs in a bounded local storage.
+//
+// Eviction uses the GreedyDual algorithm: every cached blob has a priority
+// which is set to the current clock plus its value when it is read, the blob
+// with the lowest priority is evicted and the clock advanced to its priority.
+// The value of a blob grows with the number of distinct blobs it has been read
+// after, since a blob read in many contexts is likely shared between many
+// files, and if it was fetched on its own, since it is then likely stored
+// non-contiguously upstream and expensive to fetch again.
+package cache
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+)
+
+// maxContexts bounds the number of distinct contexts tracked per blob.
+const maxContexts = 8
+
+// Options to configure the cache.
+type Options struct {
+	// MaxSize is the largest total size in bytes of the cached blobs.
+	MaxSize int64
+	// SharedWeight is the value added for each additional distinct blob a
+	// cached blob has been read after.
+	SharedWeight float64
+	// ScatteredWeight is the value added for blobs that were fetched on their
+	// own rather than together with others.
+	ScatteredWeight float64
+}
+
+var DefaultOptions = Options{
+	MaxSize:         1 << 30,
+	SharedWeight:    1,
+	ScatteredWeight: 1,
+}
+
+// Stats are counters of the cache activity.
+type Stats struct {
+	Hits      int64 // blobs read from the cache
+	Misses    int64 // blobs read from upstream
+	Evictions int64 // blobs evicted from the cache
+	Size      int64 // total size of the cached blobs
+	Count     int   // number of cached blobs
+}
+
+// Storage is a caching storage.Storage.
+type Storage struct {
+	upstream storage.Storage
+	local    storage.Storage
+	opt      Options
+
+	m       sync.Mutex // protects all fields below
+	entries map[blob.Ref]*entry
+	queue   priorityQueue
+	clock   float64
+	stats   Stats
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+type entry struct {
+	ref       blob.Ref
+	size      uint32
+	priority  float64
+	index     int // in the priority queue
+	contexts  []blob.Ref
+	scattered bool
+}
+
+func (e *entry) value(opt *Options) float64 {
+	v := 1.0
+	if len(e.contexts) > 1 {
+		v += opt.SharedWeight * float64(len(e.contexts)-1)
+	}
+	if e.scattered {
+		v += opt.ScatteredWeight
+	}
+	return v
+}
+
+// New returns a cache in front of upstream, keeping the cached blobs in
+// local. Any blobs already in local are used. The cache takes ownership of
+// both storages and closes them when closed.
+func New(upstream, local storage.Storage, opt Options) (*Storage, error) {
+	if opt.MaxSize <= 0 {
+		opt.MaxSize = DefaultOptions.MaxSize
+	}
+	if opt.SharedWeight <= 0 {
+		opt.SharedWeight = DefaultOptions.SharedWeight
+	}
+	if opt.ScatteredWeight <= 0 {
+		opt.ScatteredWeight = DefaultOptions.ScatteredWeight
+	}
+	s := &Storage{
+		upstream: upstream,
+		local:    local,
+		opt:      opt,
+		entries:  make(map[blob.Ref]*entry),
+	}
+
+	ch := make(chan blob.SizedRef)
+	errc := make(chan error, 1)
+	go func() { errc <- local.EnumerateBlobs(context.Background(), ch, storage.Filter{}) }()
+	for sr := range ch {
+		s.insert(sr.Ref, sr.Size(), blob.Ref{}, false)
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	if err := s.evict(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Stats returns the current counters.
+func (s *Storage) Stats() Stats {
+	s.m.Lock()
+	defer s.m.Unlock()
+	st := s.stats
+	st.Count = len(s.entries)
+	return st
+}
+
+// GetBlobs reads the cached blobs from the local storage and fetches the rest
+// from upstream, verifying and caching them.
+func (s *Storage) GetBlobs(ctx context.Context, blobs []blob.Ref) (io.ReadCloser, uint32, error) {
+	datas := make([][]byte, len(blobs))
+	var misses []int
+	for i, br := range blobs {
+		var prev blob.Ref
+		if i > 0 {
+			prev = blobs[i-1]
+		}
+		d, err := s.getLocal(ctx, br, prev)
+		if err != nil {
+			return nil, 0, err
+		}
+		if d == nil {
+			misses = append(misses, i)
+			continue
+		}
+		datas[i] = d
+	}
+
+	if len(misses) > 0 {
+		if err := s.fill(ctx, blobs, misses, datas); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	size := 0
+	for _, d := range datas {
+		size += len(d)
+	}
+	buf := make([]byte, 0, size)
+	for _, d := range datas {
+		buf = append(buf, d...)
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), uint32(size), nil
+}
+
+// getLocal returns the contents of br if it is cached, else nil.
+func (s *Storage) getLocal(ctx context.Context, br, prev blob.Ref) ([]byte, error) {
+	s.m.Lock()
+	e, ok := s.entries[br]
+	if ok {
+		s.touch(e, prev)
+	}
+	s.m.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	rc, _, err := s.local.GetBlobs(ctx, []blob.Ref{br})
+	if os.IsNotExist(err) {
+		// evicted concurrently
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	d, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	s.m.Lock()
+	s.stats.Hits++
+	s.m.Unlock()
+	return d, nil
+}
+
+// fill fetches the missing blobs, given by their index in blobs, from
+// upstream in one request and caches them.
+func (s *Storage) fill(ctx context.Context, blobs []blob.Ref, misses []int, datas [][]byte) error {
+	refs := make([]blob.Ref, len(misses))
+	for i, mi := range misses {
+		refs[i] = blobs[mi]
+	}
+	sizes := make(map[blob.Ref]uint32, len(refs))
+	if len(refs) > 1 {
+		// we need the sizes to split the concatenated blobs
+		err := s.upstream.StatBlobs(ctx, refs, func(sr blob.SizedRef) error {
+			sizes[sr.Ref] = sr.Size()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	rc, _, err := s.upstream.GetBlobs(ctx, refs)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	for i, mi := range misses {
+		br := blobs[mi]
+		r := io.Reader(rc)
+		if len(refs) > 1 {
+			size, ok := sizes[br]
+			if !ok {
+				return os.ErrNotExist
+			}
+			r = io.LimitReader(rc, int64(size))
+		}
+		d, err := storage.ReadVerified(br, r)
+		if err != nil {
+			return err
+		}
+		datas[mi] = d
+
+		_, err = s.local.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(d))
+		if err != nil && err != storage.ErrPending {
+			return err
+		}
+		var prev blob.Ref
+		if mi > 0 {
+			prev = blobs[mi-1]
+		}
+		s.m.Lock()
+		s.stats.Misses++
+		s.insert(br, uint32(len(d)), prev, len(refs) == 1 && i == 0)
+		s.m.Unlock()
+	}
+	return s.evict(ctx)
+}
+
+// insert adds br to the cache. The caller is expected to hold the lock.
+func (s *Storage) insert(br blob.Ref, size uint32, prev blob.Ref, scattered bool) {
+	if e, ok := s.entries[br]; ok {
+		s.touch(e, prev)
+		return
+	}
+	e := &entry{ref: br, size: size, scattered: scattered}
+	s.entries[br] = e
+	s.stats.Size += int64(size)
+	e.priority = s.clock
+	heap.Push(&s.queue, e)
+	s.touch(e, prev)
+}
+
+// touch records a read of e after prev and updates its priority. The caller
+// is expected to hold the lock.
+func (s *Storage) touch(e *entry, prev blob.Ref) {
+	if len(e.contexts) < maxContexts {
+		found := false
+		for _, c := range e.contexts {
+			found = found || c == prev
+		}
+		if !found {
+			e.contexts = append(e.contexts, prev)
+		}
+	}
+	e.priority = s.clock + e.value(&s.opt)
+	heap.Fix(&s.queue, e.index)
+}
+
+// evict removes the blobs with the lowest priority until the cache is within
+// its size limit.
+func (s *Storage) evict(ctx context.Context) error {
+	s.m.Lock()
+	var victims []blob.Ref
+	for s.stats.Size > s.opt.MaxSize && s.queue.Len() > 0 {
+		e := heap.Pop(&s.queue).(*entry)
+		s.clock = e.priority
+		delete(s.entries, e.ref)
+		s.stats.Size -= int64(e.size)
+		s.stats.Evictions++
+		victims = append(victims, e.ref)
+	}
+	s.m.Unlock()
+	if len(victims) == 0 {
+		return nil
+	}
+	return s.local.RemoveBlobs(ctx, victims)
+}
+
+// PutBlob writes the blob to upstream, it is not cached until read.
+func (s *Storage) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	return s.upstream.PutBlob(ctx, br, after, source)
+}
+
+func (s *Storage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	return s.upstream.StatBlobs(ctx, blobs, fn)
+}
+
+func (s *Storage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, filter storage.Filter) error {
+	return s.upstream.EnumerateBlobs(ctx, dest, filter)
+}
+
+// RemoveBlobs removes the blobs both upstream and from the cache.
+func (s *Storage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	s.m.Lock()
+	for _, br := range blobs {
+		if e, ok := s.entries[br]; ok {
+			heap.Remove(&s.queue, e.index)
+			delete(s.entries, br)
+			s.stats.Size -= int64(e.size)
+		}
+	}
+	s.m.Unlock()
+	if err := s.local.RemoveBlobs(ctx, blobs); err != nil {
+		return err
+	}
+	return s.upstream.RemoveBlobs(ctx, blobs)
+}
+
+// Close closes both the upstream and the local storage.
+func (s *Storage) Close() error {
+	err := s.local.Close()
+	if e := s.upstream.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// priorityQueue is a min-heap of entries on priority.
+type priorityQueue []*entry
+
+func (q priorityQueue) Len() int           { return len(q) }
+func (q priorityQueue) Less(i, j int) bool { return q[i].priority < q[j].priority }
+func (q priorityQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *priorityQueue) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *priorityQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	e.index = -1
+	return e
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/memory"
+	"github.com/vron/compono/storage/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (storage.Storage, func()) {
+		s, err := New(memory.New(), memory.New(), Options{MaxSize: 1 << 12})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, func() {}
+	})
+}
+
+func get(t *testing.T, s storage.Storage, refs ...blob.Ref) []byte {
+	t.Helper()
+	rc, _, err := s.GetBlobs(context.Background(), refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHitMiss(t *testing.T) {
+	up := memory.New()
+	s, err := New(up, memory.New(), Options{MaxSize: 1 << 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	a, da := storagetest.Blob("a", false)
+	b, db := storagetest.Blob("bb", true)
+	storagetest.Put(t, up, a, da)
+	storagetest.Put(t, up, b, db)
+
+	if got := get(t, s, a, b); !bytes.Equal(got, append(da, db...)) {
+		t.Error("got wrong contents on fill")
+	}
+	if got := get(t, s, b, a); !bytes.Equal(got, append(db, da...)) {
+		t.Error("got wrong contents from cache")
+	}
+	st := s.Stats()
+	if st.Misses != 2 || st.Hits != 2 || st.Count != 2 || st.Size != int64(len(da)+len(db)) {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestEvictShared(t *testing.T) {
+	up := memory.New()
+	s, err := New(up, memory.New(), Options{MaxSize: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	blobs := map[string]blob.Ref{}
+	for _, n := range []string{"a", "b", "c", "shared", "x1", "y1", "x2", "y2"} {
+		br, d := storagetest.Blob(fmt.Sprintf("%10s", n), false)
+		storagetest.Put(t, up, br, d)
+		blobs[n] = br
+	}
+
+	// the shared blob is read after three different blobs, and should then
+	// survive more recently read blobs that are not shared.
+	get(t, s, blobs["a"], blobs["shared"])
+	get(t, s, blobs["b"], blobs["shared"])
+	get(t, s, blobs["c"], blobs["shared"])
+	get(t, s, blobs["x1"], blobs["y1"])
+	get(t, s, blobs["x2"], blobs["y2"])
+
+	st := s.Stats()
+	if st.Size > 40 || st.Evictions != 4 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	get(t, s, blobs["shared"])
+	if s.Stats().Hits != st.Hits+1 {
+		t.Error("shared blob was evicted")
+	}
+}
+
+// corrupt returns the wrong contents for all blobs.
+type corrupt struct {
+	storage.Storage
+}
+
+func (c corrupt) GetBlobs(ctx context.Context, blobs []blob.Ref) (io.ReadCloser, uint32, error) {
+	rc, size, err := c.Storage.GetBlobs(ctx, blobs)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close()
+	b, _ := ioutil.ReadAll(rc)
+	for i := range b {
+		b[i]++
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), size, nil
+}
+
+func TestVerifyFill(t *testing.T) {
+	up := memory.New()
+	s, err := New(corrupt{up}, memory.New(), Options{MaxSize: 1 << 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	br, d := storagetest.Blob("data", false)
+	storagetest.Put(t, up, br, d)
+	if _, _, err := s.GetBlobs(context.Background(), []blob.Ref{br}); err != storage.ErrHashMismatch {
+		t.Error("expected hash mismatch, got", err)
+	}
+	if st := s.Stats(); st.Count != 0 {
+		t.Error("corrupt blob was cached")
+	}
+}
@@ -0,0 +1,188 @@
+// Package cond implements a storage.Storage that keeps schema blobs and data
+// blobs in different backends, e.g. the schema blobs on fast disks and the
+// much larger data blobs on slow ones.
+package cond
+
+import (
+	"context"
+	"io"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+)
+
+// Storage routes blobs to a backend depending on if they are schema blobs.
+type Storage struct {
+	schema storage.Storage
+	data   storage.Storage
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+// New returns a Storage keeping schema blobs in schema and data blobs in data.
+// It takes ownership of the backends and closes them when closed.
+func New(schema, data storage.Storage) *Storage {
+	return &Storage{schema: schema, data: data}
+}
+
+func (s *Storage) backend(br blob.Ref) storage.Storage {
+	if br.Schema() {
+		return s.schema
+	}
+	return s.data
+}
+
+// split returns the refs for the schema and the data backend.
+func split(blobs []blob.Ref) (schema, data []blob.Ref) {
+	for _, br := range blobs {
+		if br.Schema() {
+			schema = append(schema, br)
+		} else {
+			data = append(data, br)
+		}
+	}
+	return schema, data
+}
+
+// GetBlobs reads each run of refs of the same kind from its backend, and
+// returns them concatenated in the order requested.
+func (s *Storage) GetBlobs(ctx context.Context, blobs []blob.Ref) (io.ReadCloser, uint32, error) {
+	var rcs multiReadCloser
+	var size uint32
+	for len(blobs) > 0 {
+		n := 1
+		for n < len(blobs) && blobs[n].Schema() == blobs[0].Schema() {
+			n++
+		}
+		rc, sz, err := s.backend(blobs[0]).GetBlobs(ctx, blobs[:n])
+		if err != nil {
+			rcs.Close()
+			return nil, 0, err
+		}
+		rcs = append(rcs, rc)
+		size += sz
+		blobs = blobs[n:]
+	}
+	if len(rcs) == 1 {
+		return rcs[0], size, nil
+	}
+	return &rcs, size, nil
+}
+
+// PutBlob writes the blob to its backend. After is only passed on if it is
+// stored in the same backend.
+func (s *Storage) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	if after.Valid() && after.Schema() != br.Schema() {
+		after = blob.Ref{}
+	}
+	return s.backend(br).PutBlob(ctx, br, after, source)
+}
+
+func (s *Storage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	schema, data := split(blobs)
+	if len(schema) > 0 {
+		if err := s.schema.StatBlobs(ctx, schema, fn); err != nil {
+			return err
+		}
+	}
+	if len(data) > 0 {
+		return s.data.StatBlobs(ctx, data, fn)
+	}
+	return nil
+}
+
+// EnumerateBlobs enumerates the schema blobs and then the data blobs, which
+// since schema blobs sort first preserves the order.
+func (s *Storage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, filter storage.Filter) error {
+	defer close(dest)
+	if !filter.ExcludeSchemaBlobs {
+		f := filter
+		f.ExcludeDataBlobs = true
+		if err := forward(ctx, s.schema, dest, f); err != nil {
+			return err
+		}
+	}
+	if !filter.ExcludeDataBlobs {
+		f := filter
+		f.ExcludeSchemaBlobs = true
+		if err := forward(ctx, s.data, dest, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forward sends the blobs enumerated by src to dest without closing it.
+func forward(ctx context.Context, src storage.Storage, dest chan<- blob.SizedRef, filter storage.Filter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan blob.SizedRef, 64)
+	errc := make(chan error, 1)
+	go func() { errc <- src.EnumerateBlobs(ctx, ch, filter) }()
+	defer func() {
+		cancel()
+		for range ch {
+		}
+	}()
+	for sr := range ch {
+		select {
+		case dest <- sr:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return <-errc
+}
+
+func (s *Storage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	schema, data := split(blobs)
+	if len(schema) > 0 {
+		if err := s.schema.RemoveBlobs(ctx, schema); err != nil {
+			return err
+		}
+	}
+	if len(data) > 0 {
+		return s.data.RemoveBlobs(ctx, data)
+	}
+	return nil
+}
+
+// Close closes both backends, or only one if they are the same.
+func (s *Storage) Close() error {
+	err := s.schema.Close()
+	if s.data != s.schema {
+		if e := s.data.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// multiReadCloser reads and closes several io.ReadClosers in turn.
+type multiReadCloser []io.ReadCloser
+
+func (m *multiReadCloser) Read(p []byte) (int, error) {
+	for len(*m) > 0 {
+		n, err := (*m)[0].Read(p)
+		if err == io.EOF {
+			(*m)[0].Close()
+			*m = (*m)[1:]
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+func (m *multiReadCloser) Close() error {
+	var err error
+	for _, rc := range *m {
+		if e := rc.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	*m = nil
+	return err
+}
@@ -0,0 +1,48 @@
+package cond
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/memory"
+	"github.com/vron/compono/storage/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (storage.Storage, func()) {
+		return New(memory.New(), memory.New()), func() {}
+	})
+}
+
+func TestRouting(t *testing.T) {
+	schema, data := memory.New(), memory.New()
+	s := New(schema, data)
+	defer s.Close()
+
+	sr, sd := storagetest.Blob("schema", true)
+	dr, dd := storagetest.Blob("data", false)
+	storagetest.Put(t, s, sr, sd)
+	storagetest.Put(t, s, dr, dd)
+
+	if got := storagetest.Enumerate(t, schema, storage.Filter{}); len(got) != 1 || got[0].Ref != sr {
+		t.Error("schema blob not stored in the schema backend")
+	}
+	if got := storagetest.Enumerate(t, data, storage.Filter{}); len(got) != 1 || got[0].Ref != dr {
+		t.Error("data blob not stored in the data backend")
+	}
+
+	rc, size, err := s.GetBlobs(context.Background(), []blob.Ref{dr, sr, dr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, _ := ioutil.ReadAll(rc)
+	want := append(append(append([]byte{}, dd...), sd...), dd...)
+	if !bytes.Equal(b, want) || size != uint32(len(want)) {
+		t.Error("mixed get returned wrong contents")
+	}
+}
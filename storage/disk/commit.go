@@ -0,0 +1,248 @@
+package diskstorage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage/ztream"
+)
+
+// Durability selects when PutBlob acknowledges a blob.
+type Durability int
+
+const (
+	// AckSynced makes PutBlob return once the blob has been synced to disk.
+	AckSynced Durability = iota
+	// AckEarly makes PutBlob return storage.ErrPending as soon as the blob
+	// has been written, before it has been synced to disk. WaitDurable can be
+	// used to wait for it to be synced.
+	AckEarly
+)
+
+// A batch is a group of appended blobs that are synced to disk together, to
+// avoid one disk sync per blob when many are uploaded concurrently.
+type batch struct {
+	done chan struct{} // closed when the batch has been synced
+	err  error         // the result of the sync, valid when done is closed
+	refs []blob.Ref
+	puts map[blob.Ref]uint32 // put times of blobs already stored to update
+}
+
+func newBatch() *batch {
+	return &batch{done: make(chan struct{})}
+}
+
+// A pendingBlob is a blob appended to a pack but not yet synced. It is only
+// added to the index once synced, such that the index never refers to data
+// that may be lost in a crash.
+type pendingBlob struct {
+	batch *batch
+	loc   location
+}
+
+// addPending adds br stored at l to the batch waiting to be synced and wakes
+// the committer. The caller is expected to hold the lock.
+func (s *Storage) addPending(br blob.Ref, l location) *batch {
+	b := s.batch
+	b.refs = append(b.refs, br)
+	s.pending[br] = &pendingBlob{batch: b, loc: l}
+	select {
+	case s.commitc <- struct{}{}:
+	default:
+	}
+	return b
+}
+
+// addPut adds the put time of br, which is already stored, to be updated in
+// the index with the batch waiting to be synced and wakes the committer. The
+// caller is expected to hold the lock.
+func (s *Storage) addPut(br blob.Ref) *batch {
+	b := s.batch
+	if b.puts == nil {
+		b.puts = make(map[blob.Ref]uint32)
+	}
+	b.puts[br] = uint32(time.Now().Unix())
+	select {
+	case s.commitc <- struct{}{}:
+	default:
+	}
+	return b
+}
+
+// lookup returns the location of br, which may not yet be synced. The caller
+// is expected to hold the lock.
+func (s *Storage) lookup(br blob.Ref) (location, bool, error) {
+	if p, ok := s.pending[br]; ok {
+		return p.loc, true, nil
+	}
+	return s.index.get(br)
+}
+
+// committer syncs the batches of appended blobs until the storage is closed.
+// Blobs appended while a batch is being synced are gathered in the next batch.
+// It also merges the index and trains the first dictionary, outside of the
+// lock.
+func (s *Storage) committer() {
+	defer close(s.committerDone)
+	for {
+		select {
+		case <-s.commitc:
+		case <-s.stopc:
+			return
+		}
+		if s.opt.CommitDelay > 0 {
+			time.Sleep(s.opt.CommitDelay)
+		}
+		s.commit()
+		// on errors merging is retried after the next commit
+		s.mergeIndex()
+		s.m.Lock()
+		samples := s.toTrain
+		s.toTrain = nil
+		s.m.Unlock()
+		if samples != nil {
+			// on errors training is retried once more blobs are sampled
+			s.trainDictionary(samples)
+		}
+	}
+}
+
+// commit syncs the packs of the batch, then adds its blobs and put times to
+// the index and syncs it, and marks the batch as done. The packs are synced without holding
+// the lock, such that blobs are appended to the next batch meanwhile. If
+// syncing a pack fails the blobs are dropped without being acknowledged, and
+// are appended again if put again. The caller must not hold the lock.
+func (s *Storage) commit() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	b := s.batch
+	if len(b.refs) == 0 && len(b.puts) == 0 {
+		return
+	}
+	s.batch = newBatch()
+
+	var packs []*ztream.Stream
+	synced := make(map[uint32]bool)
+	for _, br := range b.refs {
+		if p := s.pending[br]; p != nil && p.batch == b && !synced[p.loc.pack] {
+			synced[p.loc.pack] = true
+			pack, ok := s.packs[p.loc.pack]
+			if !ok {
+				b.err = errors.New("diskstorage: pack closed before syncing")
+				break
+			}
+			packs = append(packs, pack)
+		}
+	}
+	if b.err == nil {
+		// the packs are not closed until synced
+		s.packMu.RLock()
+		s.m.Unlock()
+		for _, p := range packs {
+			if b.err = p.Sync(); b.err != nil {
+				break
+			}
+		}
+		s.packMu.RUnlock()
+		s.m.Lock()
+	}
+	for _, br := range b.refs {
+		p := s.pending[br]
+		if p == nil || p.batch != b {
+			// removed while pending
+			continue
+		}
+		delete(s.pending, br)
+		if b.err == nil {
+			b.err = s.index.add(br, p.loc)
+		}
+	}
+	for br, put := range b.puts {
+		if b.err != nil {
+			break
+		}
+		// the blob may have been removed since
+		_, ok, err := s.index.get(br)
+		if err == nil && ok && s.pending[br] == nil {
+			err = s.index.addPut(br, put)
+		}
+		b.err = err
+	}
+	if b.err == nil {
+		b.err = s.index.sync()
+	}
+	close(b.done)
+}
+
+// syncIndex syncs the index, and wakes the committer to merge it if the
+// journal has grown to large. The caller is expected to hold the lock.
+func (s *Storage) syncIndex() error {
+	if err := s.index.sync(); err != nil {
+		return err
+	}
+	if s.index.needsMerge() {
+		select {
+		case s.commitc <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// mergeIndex merges the journal of the index into a new table if it has
+// grown to large. The table is written without holding the lock, so puts and
+// removes are journaled meanwhile, and kept in the journal once it is cut.
+func (s *Storage) mergeIndex() error {
+	s.mergeMu.Lock()
+	defer s.mergeMu.Unlock()
+	s.m.Lock()
+	if s.index == nil || !s.index.needsMerge() {
+		s.m.Unlock()
+		return nil
+	}
+	ix := s.index
+	m, err := ix.startMerge()
+	s.m.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := m.write(); err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	return ix.finishMerge(m)
+}
+
+// WaitDurable waits until br has been synced to disk, and returns any error
+// from syncing it. If br is not stored os.ErrNotExist is returned.
+func (s *Storage) WaitDurable(ctx context.Context, br blob.Ref) error {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return ErrClosed
+	}
+	p, ok := s.pending[br]
+	if !ok {
+		_, found, err := s.index.get(br)
+		s.m.Unlock()
+		if err == nil && !found {
+			err = os.ErrNotExist
+		}
+		return err
+	}
+	s.m.Unlock()
+	return wait(ctx, p.batch)
+}
+
+func wait(ctx context.Context, b *batch) error {
+	select {
+	case <-b.done:
+		return b.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
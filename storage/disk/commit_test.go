@@ -0,0 +1,209 @@
+package diskstorage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/storagetest"
+	"github.com/vron/compono/storage/ztream"
+)
+
+func TestAckEarly(t *testing.T) {
+	opt := tOpt
+	opt.Durability = AckEarly
+	storagetest.Test(t, func(t *testing.T) (storage.Storage, func()) {
+		dir := tempDir(t)
+		s, err := Open(dir, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, func() { os.RemoveAll(dir) }
+	})
+}
+
+func TestWaitDurable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	opt := tOpt
+	opt.Durability = AckEarly
+	s, err := Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			br, d := testBlob(1000, false)
+			sr, err := s.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(d))
+			if err != nil && err != storage.ErrPending {
+				t.Error(err)
+			}
+			if sr.Ref != br {
+				t.Error("expected the sized ref to be returned when pending")
+			}
+			if err := s.WaitDurable(ctx, br); err != nil {
+				t.Error(err)
+			}
+			// once durable putting it again is acknowledged directly
+			if _, err := s.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(d)); err != nil {
+				t.Error("expected no error for durable blob, got:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	missing, _ := testBlob(10, false)
+	if err := s.WaitDurable(ctx, missing); !os.IsNotExist(err) {
+		t.Error("expected not exist, got:", err)
+	}
+
+	// pending blobs are synced at close
+	br, d := testBlob(1000, true)
+	s.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(d))
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	s, err = Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	get(t, s, br, d)
+}
+
+// failingFile is a pack file whose syncs fail while fail is set.
+type failingFile struct {
+	*os.File
+	fail *bool
+}
+
+func (f failingFile) Sync() error {
+	if *f.fail {
+		return syscall.EIO
+	}
+	return f.File.Sync()
+}
+
+func TestSyncFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	fail := false
+	opt := tOpt
+	opt.Ztream.OpenFile = func(name string, flag int, perm os.FileMode) (ztream.File, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return failingFile{f, &fail}, nil
+	}
+	s, err := Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// a blob that failed to sync is not indexed nor acknowledged when put again
+	fail = true
+	br, d := testBlob(1000, false)
+	if _, err := s.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(d)); err == nil {
+		t.Error("expected the failed sync to be returned")
+	}
+	if _, ok, _ := s.index.get(br); ok {
+		t.Error("expected the blob not to be indexed")
+	}
+	if _, err := s.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(d)); err == nil {
+		t.Error("expected putting it again to fail while syncs fail")
+	}
+	fail = false
+	put(t, s, br, d)
+	if _, ok, _ := s.index.get(br); !ok {
+		t.Error("expected the blob to be indexed once synced")
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	s, err = Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	get(t, s, br, d)
+}
+
+// blockingFile is a file whose Sync waits until released once syncing is
+// ready to receive.
+type blockingFile struct {
+	ztream.File
+	syncing chan struct{}
+	release chan struct{}
+}
+
+func (f blockingFile) Sync() error {
+	select {
+	case f.syncing <- struct{}{}:
+		<-f.release
+	default:
+	}
+	return f.File.Sync()
+}
+
+// TestCommitPipelined checks that blobs are put and read while a batch is
+// being synced.
+func TestCommitPipelined(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	syncing, release := make(chan struct{}), make(chan struct{})
+	opt := tOpt
+	opt.Durability = AckEarly
+	opt.Ztream.OpenFile = func(name string, flag int, perm os.FileMode) (ztream.File, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return blockingFile{f, syncing, release}, nil
+	}
+	s, err := Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	br1, d1 := testBlob(1000, false)
+	if _, err := s.PutBlob(ctx, br1, blob.Ref{}, bytes.NewReader(d1)); err != storage.ErrPending {
+		t.Error("expected the blob to be pending", err)
+	}
+	<-syncing
+	done := make(chan struct{})
+	br2, d2 := testBlob(1000, false)
+	go func() {
+		defer close(done)
+		s.PutBlob(ctx, br2, blob.Ref{}, bytes.NewReader(d2))
+		get(t, s, br1, d1)
+		get(t, s, br2, d2)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("expected puts and gets not to wait for a sync")
+	}
+	close(release)
+	for _, br := range []blob.Ref{br1, br2} {
+		if err := s.WaitDurable(ctx, br); err != nil {
+			t.Error(err)
+		}
+	}
+	<-done
+}
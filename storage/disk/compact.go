@@ -0,0 +1,304 @@
+package diskstorage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage/ztream"
+)
+
+// errCompacted is returned by compactPack if the pack is already removed.
+var errCompacted = errors.New("diskstorage: the pack is already compacted")
+
+// CompactStats summarizes a compaction.
+type CompactStats struct {
+	Packs     int   // packs removed
+	Copied    int   // live blobs copied out of them
+	Reclaimed int64 // bytes of disk freed
+}
+
+// Compact copies the live blobs out of sealed packs where less than
+// opt.CompactThreshold of the space is used by live blobs, and then removes
+// those packs. The lock is only held while copying one blob at the time, so
+// reads and writes continue while compacting.
+//
+// A blob copied is appended to the current pack like any other, and the
+// index is switched to the new location and synced before the old pack is
+// removed. If we crash half way the old pack is left with blobs that are no
+// longer referred to by the index, and is removed by the next compaction.
+// Only one compaction runs at the time.
+func (s *Storage) Compact(ctx context.Context) (st CompactStats, err error) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	ids, err := s.sparsePacks()
+	if err != nil {
+		return st, err
+	}
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return st, err
+		}
+		n, size, err := s.compactPack(ctx, id)
+		st.Copied += n
+		if err == errCompacted {
+			continue
+		}
+		if err != nil {
+			return st, err
+		}
+		st.Packs++
+		st.Reclaimed += size
+	}
+	return st, nil
+}
+
+// sparsePacks returns the sealed packs to compact. The packs are scanned
+// without holding the lock, which is only taken to look up each blob.
+func (s *Storage) sparsePacks() ([]uint32, error) {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return nil, ErrClosed
+	}
+	packs := make(map[uint32]*ztream.Stream, len(s.packs))
+	for id, p := range s.packs {
+		if id != s.current {
+			packs[id] = p
+		}
+	}
+	s.m.Unlock()
+
+	var sparse []uint32
+	for _, id := range sortedIDs(packs) {
+		fi, err := os.Stat(s.packPath(id))
+		if os.IsNotExist(err) {
+			// compacted since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		used, err := s.liveSize(id, packs[id])
+		if err != nil {
+			return nil, err
+		}
+		if float64(used) < s.opt.CompactThreshold*float64(fi.Size()) {
+			sparse = append(sparse, id)
+		}
+	}
+	return sparse, nil
+}
+
+// liveSize returns the space used by the entries of pack id that the index
+// refers to.
+func (s *Storage) liveSize(id uint32, p *ztream.Stream) (int64, error) {
+	entries, err := p.Contents()
+	if err != nil {
+		return 0, err
+	}
+	used := int64(0)
+	for _, e := range entries {
+		ref, ok := blob.ParseString(e.Name)
+		if !ok {
+			return 0, errors.New("diskstorage: pack contains invalid name: " + e.Name)
+		}
+		if err := checkMeta(ref, e); err != nil {
+			return 0, err
+		}
+		s.m.Lock()
+		if s.closed {
+			s.m.Unlock()
+			return 0, ErrClosed
+		}
+		live, err := s.isLive(record{ref: ref, loc: location{pack: id, entry: e}})
+		s.m.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if live {
+			used += e.Size()
+		}
+	}
+	return used, nil
+}
+
+// isLive reports whether the location of r is the one stored. The caller is
+// expected to hold the lock.
+func (s *Storage) isLive(r record) (bool, error) {
+	l, ok, err := s.lookup(r.ref)
+	return ok && l.pack == r.loc.pack && l.entry.Offset == r.loc.entry.Offset, err
+}
+
+// compactPack copies the live blobs of pack id to the current pack and
+// removes it, returning the number of blobs copied and the size of the pack.
+func (s *Storage) compactPack(ctx context.Context, id uint32) (n int, size int64, err error) {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return 0, 0, ErrClosed
+	}
+	p, ok := s.packs[id]
+	if !ok {
+		s.m.Unlock()
+		return 0, 0, errCompacted
+	}
+	entries, err := p.Contents()
+	s.m.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var old, copies []record
+	defer func() {
+		s.m.Lock()
+		for _, c := range copies {
+			delete(s.copies, c.ref)
+		}
+		s.m.Unlock()
+	}()
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return n, 0, err
+		}
+		r, c, ok, err := s.copyEntry(id, e)
+		if err != nil {
+			return n, 0, err
+		}
+		if ok {
+			old, copies = append(old, r), append(copies, c)
+		}
+	}
+
+	// the copies must be durable before the index refers to them, and the
+	// index before the old pack is removed. They are synced without holding
+	// the lock, such that reads and writes continue meanwhile.
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return n, 0, ErrClosed
+	}
+	var packs []*ztream.Stream
+	synced := make(map[uint32]bool)
+	for _, c := range copies {
+		if !synced[c.loc.pack] {
+			synced[c.loc.pack] = true
+			packs = append(packs, s.packs[c.loc.pack])
+		}
+	}
+	if len(packs) > 0 {
+		// the packs are not closed until synced
+		s.packMu.RLock()
+		s.m.Unlock()
+		for _, cp := range packs {
+			if err = cp.Sync(); err != nil {
+				break
+			}
+		}
+		s.packMu.RUnlock()
+		s.m.Lock()
+		if err != nil {
+			return n, 0, err
+		}
+		if s.closed {
+			return n, 0, ErrClosed
+		}
+	}
+	for i := range copies {
+		l, ok, err := s.lookup(old[i].ref)
+		if err != nil {
+			return n, 0, err
+		}
+		if !ok || l.pack != id || l.entry.Offset != old[i].loc.entry.Offset {
+			// removed while copying, which also wiped the copy
+			continue
+		}
+		if err := s.index.add(copies[i].ref, copies[i].loc); err != nil {
+			return n, 0, err
+		}
+		n++
+	}
+	if err := s.syncIndex(); err != nil {
+		return n, 0, err
+	}
+	if s.packs[id] != p {
+		return n, 0, errCompacted
+	}
+	fi, err := os.Stat(s.packPath(id))
+	if err != nil {
+		return n, 0, err
+	}
+	s.packMu.Lock()
+	delete(s.packs, id)
+	err = p.Close()
+	s.packMu.Unlock()
+	if err != nil {
+		return n, 0, err
+	}
+	return n, fi.Size(), os.Remove(s.packPath(id))
+}
+
+// copyEntry appends e of pack id to the current pack, unless the blob has
+// been removed since the pack was listed, and returns the old and new record
+// of the blob. The index is updated once the copy is synced, until then the
+// copy is kept in s.copies.
+func (s *Storage) copyEntry(id uint32, e ztream.Entry) (old, nr record, ok bool, err error) {
+	br, ok := blob.ParseString(e.Name)
+	if !ok {
+		return old, nr, false, nil
+	}
+	old = record{ref: br, loc: location{pack: id, entry: e}}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return old, nr, false, ErrClosed
+	}
+	p, ok := s.packs[id]
+	if !ok {
+		return old, nr, false, errCompacted
+	}
+	if ok, err := s.isLive(old); !ok || err != nil {
+		return old, nr, false, err
+	}
+
+	data := make([]byte, e.UncompressedSize)
+	if err := p.Read(e, data); err != nil {
+		return old, nr, false, err
+	}
+	ne, err := s.packs[s.current].Append(e.Name, data, e.Extra)
+	if err == ztream.ErrStreamFull {
+		if err = s.roll(); err == nil {
+			ne, err = s.packs[s.current].Append(e.Name, data, e.Extra)
+		}
+	}
+	if err != nil {
+		return old, nr, false, err
+	}
+	s.copies[br] = s.current
+	return old, record{ref: br, loc: location{pack: s.current, entry: ne}}, true, nil
+}
+
+// compactor compacts the storage every opt.CompactInterval until the storage
+// is closed.
+func (s *Storage) compactor() {
+	defer close(s.compactorDone)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.stopc
+		cancel()
+	}()
+	t := time.NewTicker(s.opt.CompactInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			// errors are retried at the next interval
+			s.Compact(ctx)
+		case <-s.stopc:
+			return
+		}
+	}
+}
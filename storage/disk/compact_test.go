@@ -0,0 +1,281 @@
+package diskstorage
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage/ztream"
+)
+
+func TestCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	refs, datas := []blob.Ref{}, [][]byte{}
+	for i := 0; i < 10; i++ {
+		br, d := testBlob(100<<10, false)
+		put(t, s, br, d)
+		refs, datas = append(refs, br), append(datas, d)
+	}
+	before, _ := listPacks(dir)
+
+	// every other blob is removed, leaving the sealed packs half empty
+	var removed []blob.Ref
+	for i := 0; i < len(refs); i += 2 {
+		removed = append(removed, refs[i])
+	}
+	if err := s.RemoveBlobs(context.Background(), removed); err != nil {
+		t.Error(err)
+	}
+
+	// reads and writes continue while compacting
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < len(refs); i += 2 {
+			get(t, s, refs[i], datas[i])
+		}
+		br, d := testBlob(10<<10, true)
+		put(t, s, br, d)
+		get(t, s, br, d)
+	}()
+	st, err := s.Compact(context.Background())
+	wg.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+	if st.Packs == 0 || st.Copied == 0 || st.Reclaimed == 0 {
+		t.Error("expected packs to be compacted", st)
+	}
+	if after, _ := listPacks(dir); len(after) >= len(before) {
+		t.Error("expected fewer packs after compaction", before, after)
+	}
+	for i := 1; i < len(refs); i += 2 {
+		get(t, s, refs[i], datas[i])
+	}
+	s.Close()
+
+	// the index must refer to the new locations after a restart, also if it
+	// is rebuilt from the packs.
+	s, err = Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	for pass := 0; pass < 2; pass++ {
+		for i := range refs {
+			if i%2 == 1 {
+				get(t, s, refs[i], datas[i])
+			} else if _, _, err := s.GetBlobs(context.Background(), refs[i:i+1]); !os.IsNotExist(err) {
+				t.Error("removed blob found after compaction:", err)
+			}
+		}
+		if err := s.RebuildIndex(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestLiveSize checks that the live size of a pack counts the whole headers
+// of its entries, with their extra fields.
+func TestLiveSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	var refs []blob.Ref
+	for i := 0; i < 10; i++ {
+		br, d := testBlob(100, i%2 == 0)
+		put(t, s, br, d)
+		refs = append(refs, br)
+	}
+	p := s.packs[s.current]
+	entries, _ := p.Contents()
+	last := entries[len(entries)-1]
+	if used, err := s.liveSize(s.current, p); err != nil || used != last.Offset+last.CompressedSize {
+		t.Error("expected all data of the pack to be live", used, last.Offset+last.CompressedSize, err)
+	}
+	if err := s.RemoveBlobs(context.Background(), refs[:1]); err != nil {
+		t.Error(err)
+	}
+	if used, err := s.liveSize(s.current, p); err != nil || used != last.Offset+last.CompressedSize-entries[0].Size() {
+		t.Error("expected the removed entry not to be live", used, err)
+	}
+}
+
+// TestCompactRemoved checks that a blob removed while being copied by a
+// compaction is not added back when opened.
+func TestCompactRemoved(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	br, d := testBlob(100<<10, false)
+	put(t, s, br, d)
+	s.m.Lock()
+	err = s.roll()
+	s.m.Unlock()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// the compaction copies the blob, which is then removed before the copy
+	// is indexed
+	s.m.Lock()
+	l, _, _ := s.lookup(br)
+	s.m.Unlock()
+	if _, _, ok, err := s.copyEntry(l.pack, l.entry); !ok || err != nil {
+		t.Error("expected the blob to be copied", err)
+	}
+	if err := s.RemoveBlobs(context.Background(), []blob.Ref{br}); err != nil {
+		t.Error(err)
+	}
+	s.Close()
+
+	s, err = Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	for pass := 0; pass < 2; pass++ {
+		if _, _, err := s.GetBlobs(context.Background(), []blob.Ref{br}); !os.IsNotExist(err) {
+			t.Error("removed blob found after compaction:", err)
+		}
+		if err := s.RebuildIndex(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCompactConcurrent(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	refs, datas := []blob.Ref{}, [][]byte{}
+	for i := 0; i < 10; i++ {
+		br, d := testBlob(100<<10, false)
+		put(t, s, br, d)
+		refs, datas = append(refs, br), append(datas, d)
+	}
+	var removed []blob.Ref
+	for i := 0; i < len(refs); i += 2 {
+		removed = append(removed, refs[i])
+	}
+	if err := s.RemoveBlobs(context.Background(), removed); err != nil {
+		t.Error(err)
+	}
+
+	// the packs are compacted once, by either of them
+	var wg sync.WaitGroup
+	stats := make([]CompactStats, 4)
+	for i := range stats {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if stats[i], err = s.Compact(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	packs := 0
+	for _, st := range stats {
+		packs += st.Packs
+	}
+	if packs == 0 {
+		t.Error("expected packs to be compacted", stats)
+	}
+	for i := 1; i < len(refs); i += 2 {
+		get(t, s, refs[i], datas[i])
+	}
+}
+
+// TestCompactSyncUnlocked checks that blobs are put and read while the
+// copies of a compaction are being synced.
+func TestCompactSyncUnlocked(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	syncing, release := make(chan struct{}), make(chan struct{})
+	opt := tOpt
+	opt.Ztream.OpenFile = func(name string, flag int, perm os.FileMode) (ztream.File, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return blockingFile{f, syncing, release}, nil
+	}
+	s, err := Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	// the copy of the second blob fits in the current pack with the last
+	refs, datas := []blob.Ref{}, [][]byte{}
+	for i := 0; i < 9; i++ {
+		br, d := testBlob(100<<10, false)
+		put(t, s, br, d)
+		refs, datas = append(refs, br), append(datas, d)
+	}
+	if err := s.RemoveBlobs(ctx, refs[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Compact(ctx)
+		errc <- err
+	}()
+	<-syncing
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		get(t, s, refs[1], datas[1])
+		br, d := testBlob(1000, false)
+		put(t, s, br, d)
+		get(t, s, br, d)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("expected puts and gets not to wait for the sync of a compaction")
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+	<-done
+	for i := 1; i < len(refs); i++ {
+		get(t, s, refs[i], datas[i])
+	}
+}
@@ -0,0 +1,136 @@
+package diskstorage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/vron/compono/storage/ztream"
+)
+
+const dictPattern = "dict-%08d.dat"
+
+// maxSampleSize is the size of the largest schema blobs sampled to train
+// dictionaries from, larger blobs compress well enough without.
+const maxSampleSize = 4 << 10
+
+// LoadDictionaries returns the compression dictionaries stored in the
+// directory dir of a disk storage, which are needed to read its packs.
+func LoadDictionaries(dir string) (*ztream.Dictionaries, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	dicts := ztream.NewDictionaries()
+	for _, fi := range fis {
+		var id uint32
+		if n, err := fmt.Sscanf(fi.Name(), dictPattern, &id); err != nil || n != 1 || id == 0 {
+			continue
+		}
+		if fi.Name() != fmt.Sprintf(dictPattern, id) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		dicts.Add(ztream.Dictionary{ID: id, Data: data})
+	}
+	return dicts, nil
+}
+
+// writeDictionary writes d to dir, replacing it atomically, and syncs dir
+// such that the dictionary is durable before any blob is compressed with it.
+func writeDictionary(dir string, d ztream.Dictionary) error {
+	path := filepath.Join(dir, fmt.Sprintf(dictPattern, d.ID))
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	if _, err := f.Write(d.Data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the entries of the directory dir durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// TrainDictionary trains a new version of the compression dictionary from
+// the schema blobs sampled since the storage was opened, which is then used
+// for the blobs put. The older versions are kept to read the blobs
+// compressed with them.
+func (s *Storage) TrainDictionary() error {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return ErrClosed
+	}
+	samples := append([][]byte(nil), s.samples...)
+	s.m.Unlock()
+	return s.trainDictionary(samples)
+}
+
+// trainDictionary trains a dictionary from samples and adds it as the newest.
+// It is called without holding the lock since training is slow, and the
+// dictionaries are safe for concurrent use.
+func (s *Storage) trainDictionary(samples [][]byte) error {
+	s.trainMu.Lock()
+	defer s.trainMu.Unlock()
+	data := ztream.TrainDictionary(samples, s.opt.DictionarySize)
+	if len(data) == 0 {
+		return nil
+	}
+	d := ztream.Dictionary{ID: 1, Data: data}
+	if l := s.dicts.Latest(); l != nil {
+		d.ID = l.ID + 1
+	}
+	if err := writeDictionary(s.dir, d); err != nil {
+		return err
+	}
+	s.dicts.Add(d)
+	return nil
+}
+
+// sample adds a schema blob to a uniform sample of those put, and has the
+// committer train the first dictionary once opt.DictionarySamples have been
+// sampled. The caller is expected to hold the lock.
+func (s *Storage) sample(data []byte) {
+	if s.opt.DictionarySamples < 0 || len(data) > maxSampleSize {
+		return
+	}
+	s.sampled++
+	if len(s.samples) < s.opt.DictionarySamples {
+		s.samples = append(s.samples, data)
+	} else if i := rand.Intn(s.sampled); i < len(s.samples) {
+		s.samples[i] = data
+	}
+	if s.sampled%s.opt.DictionarySamples == 0 && s.dicts.Latest() == nil {
+		s.toTrain = append([][]byte(nil), s.samples...)
+		select {
+		case s.commitc <- struct{}{}:
+		default:
+		}
+	}
+}
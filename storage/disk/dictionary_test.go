@@ -0,0 +1,79 @@
+package diskstorage
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vron/compono/blob"
+)
+
+func schemaBlob() (blob.Ref, []byte) {
+	ref, _ := testBlob(10, false)
+	d := []byte(fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "fileName": "IMG_%04d.jpg", "unixMtime": "2020-%02d-%02dT10:%02d:00Z", "parts": [{"blobRef": "%s", "size": %d}]}`,
+		rand.Intn(10000), 1+rand.Intn(12), 1+rand.Intn(28), rand.Intn(60), ref, rand.Intn(1<<20)))
+	h := blob.NewHash()
+	h.Write(d)
+	return blob.RefFromHash(h, true), d
+}
+
+func TestDictionary(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opt := tOpt
+	opt.DictionarySamples = 50
+	s, err := Open(dir, opt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	refs, datas := []blob.Ref{}, [][]byte{}
+	putN := func(n int) {
+		for i := 0; i < n; i++ {
+			br, d := schemaBlob()
+			put(t, s, br, d)
+			refs, datas = append(refs, br), append(datas, d)
+		}
+	}
+	putN(50)
+
+	// the dictionary is trained by the committer
+	for i := 0; s.dicts.Latest() == nil && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dict-00000001.dat")); err != nil {
+		t.Error("expected a dictionary to be trained", err)
+	}
+	putN(1)
+	l, _, _ := s.index.get(refs[len(refs)-1])
+	if l.entry.CompressedSize >= l.entry.UncompressedSize/2 {
+		t.Error("expected the blob to be compressed with the dictionary", l.entry)
+	}
+
+	// a new version is used for the blobs put after it
+	if err := s.TrainDictionary(); err != nil {
+		t.Error(err)
+	}
+	br, d := schemaBlob()
+	put(t, s, br, d)
+	refs, datas = append(refs, br), append(datas, d)
+	s.Close()
+
+	dicts, err := LoadDictionaries(dir)
+	if err != nil || dicts.Get(1) == nil || dicts.Latest().ID != 2 {
+		t.Error("expected two versions of the dictionary", err)
+	}
+	s, err = Open(dir, opt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	for i := range refs {
+		get(t, s, refs[i], datas[i])
+	}
+}
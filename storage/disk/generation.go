@@ -0,0 +1,42 @@
+package diskstorage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const generationFile = "GENERATION.dat"
+
+// readGeneration returns the modification time and contents of the
+// generation file in dir, creating it if it does not exist.
+func readGeneration(dir string) (initTime time.Time, random string, err error) {
+	fn := filepath.Join(dir, generationFile)
+	fi, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		if err = writeGeneration(dir); err != nil {
+			return
+		}
+		fi, err = os.Stat(fn)
+	}
+	if err != nil {
+		return
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return
+	}
+	return fi.ModTime(), strings.TrimSpace(string(b)), nil
+}
+
+func writeGeneration(dir string) error {
+	var b [20]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, generationFile), []byte(hex.EncodeToString(b[:])+"\n"), 0644)
+}
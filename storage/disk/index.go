@@ -0,0 +1,865 @@
+package diskstorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage/ztream"
+)
+
+// The index maps refs to their location in the packs. It consists of an
+// immutable table file with fixed size records sorted on ref, that is queried
+// by binary search directly on disk, and a journal of changes since the table
+// was written which is kept in memory. When the journal grows to large it is
+// merged into a new table, which is written without holding the lock.
+//
+// A record is 42 bytes:
+//
+//	[0:28]  the ref digest
+//	[28:31] pack id, the top bit is set if the entry has metadata
+//	[31:36] offset to the data in the pack, the top bit is the schema flag
+//	[36:39] compressed size
+//	[39:42] uncompressed size
+//
+// which makes the table ~840 Mb for 20e6 blobs. The table file starts with
+// a header followed by a fan-out of the number of records up to and including
+// each bucket, where a bucket is given by the schema flag and first digest
+// byte, to cut the number of reads needed for a lookup.
+//
+// The time a blob was first put is kept in its metadata in the pack. The
+// times of blobs put again are kept in memory, expected to be few, and
+// written to a puts file when the index is merged. It holds a header of the
+// magic, the floor of all put times and the number of blobs, followed by a
+// record for each blob with the put time in seconds since the epoch as the
+// offset, and ends with a crc of it all. The floor is the time the index was
+// rebuilt, which blobs stored before are taken to be put at.
+
+const (
+	indexFile   = "index.dat"
+	journalFile = "index.log"
+	putsFile    = "index.puts"
+
+	recordSize        = 42
+	indexVersion      = 5
+	indexBuckets      = 2 * 256
+	indexHeaderSize   = 16 + indexBuckets*8
+	putsHeaderSize    = 4 + 4 + 8
+	journalRecordSize = 1 + recordSize + 4
+
+	maxPackID   = 1<<23 - 1
+	maxOffset   = 1<<39 - 1
+	maxBlobSize = 1<<24 - 1
+
+	// runSize is the number of records sorted in memory at a time when
+	// rebuilding the index.
+	runSize = 1 << 20
+)
+
+var (
+	indexMagic = []byte("ZIDX")
+	putsMagic  = []byte("ZPUT")
+)
+
+var errIndexCorrupt = errors.New("diskstorage: the index is corrupt")
+
+type record struct {
+	ref blob.Ref
+	loc location
+}
+
+func (r *record) encode(b []byte) {
+	copy(b, r.ref.Digest())
+	pack := r.loc.pack
+	if r.loc.entry.Extra != "" {
+		pack |= 1 << 23
+	}
+	putUint24(b[28:], pack)
+	offset := uint64(r.loc.entry.Offset)
+	if r.ref.Schema() {
+		offset |= 1 << 39
+	}
+	b[31] = byte(offset >> 32)
+	binary.LittleEndian.PutUint32(b[32:], uint32(offset))
+	putUint24(b[36:], uint32(r.loc.entry.CompressedSize))
+	putUint24(b[39:], uint32(r.loc.entry.UncompressedSize))
+}
+
+func decodeRecord(b []byte) (r record) {
+	offset := uint64(b[31])<<32 | uint64(binary.LittleEndian.Uint32(b[32:]))
+	r.ref, _ = blob.RefFromDigest(b[:28], offset&(1<<39) != 0)
+	pack := uint24(b[28:])
+	r.loc.pack = pack &^ (1 << 23)
+	r.loc.entry = ztream.Entry{
+		Name:             r.ref.String(),
+		Offset:           int64(offset &^ (1 << 39)),
+		CompressedSize:   int64(uint24(b[36:])),
+		UncompressedSize: int64(uint24(b[39:])),
+	}
+	if pack&(1<<23) != 0 {
+		r.loc.entry.Extra = unreadMeta
+	}
+	return
+}
+
+func (r *record) valid() bool {
+	return r.loc.pack <= maxPackID &&
+		uint64(r.loc.entry.Offset) <= maxOffset &&
+		r.loc.entry.CompressedSize <= maxBlobSize &&
+		r.loc.entry.UncompressedSize <= maxBlobSize
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func bucket(br blob.Ref) int {
+	if br.Schema() {
+		return int(br.Digest()[0])
+	}
+	return 256 + int(br.Digest()[0])
+}
+
+// A table is an immutable sorted index file. It is reference counted since
+// enumerations may still read from it after it has been replaced by a merge.
+type table struct {
+	m    sync.Mutex // protects refs
+	refs int
+
+	file   *os.File
+	count  int64
+	fanout [indexBuckets]int64
+}
+
+func openTable(path string) (*table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &table{file: f, refs: 1}
+	if err := t.readHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *table) readHeader() error {
+	buf := make([]byte, indexHeaderSize)
+	if _, err := io.ReadFull(t.file, buf); err != nil {
+		return errIndexCorrupt
+	}
+	if !bytes.Equal(buf[:4], indexMagic) ||
+		binary.LittleEndian.Uint16(buf[4:]) != indexVersion ||
+		binary.LittleEndian.Uint16(buf[6:]) != recordSize {
+		return errIndexCorrupt
+	}
+	t.count = int64(binary.LittleEndian.Uint64(buf[8:]))
+	prev := int64(0)
+	for i := range t.fanout {
+		t.fanout[i] = int64(binary.LittleEndian.Uint64(buf[16+i*8:]))
+		if t.fanout[i] < prev || t.fanout[i] > t.count {
+			return errIndexCorrupt
+		}
+		prev = t.fanout[i]
+	}
+	if prev != t.count {
+		return errIndexCorrupt
+	}
+	fi, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != indexHeaderSize+t.count*recordSize {
+		return errIndexCorrupt
+	}
+	return nil
+}
+
+func (t *table) acquire() *table {
+	t.m.Lock()
+	t.refs++
+	t.m.Unlock()
+	return t
+}
+
+func (t *table) release() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.refs--
+	if t.refs == 0 {
+		return t.file.Close()
+	}
+	return nil
+}
+
+func (t *table) read(i int64, buf []byte) (record, error) {
+	if _, err := t.file.ReadAt(buf[:recordSize], indexHeaderSize+i*recordSize); err != nil {
+		return record{}, err
+	}
+	return decodeRecord(buf), nil
+}
+
+// search returns the smallest i in [lo, hi) for which less reports false, or hi.
+func (t *table) search(lo, hi int64, less func(blob.Ref) bool) (int64, error) {
+	var buf [recordSize]byte
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		r, err := t.read(mid, buf[:])
+		if err != nil {
+			return 0, err
+		}
+		if less(r.ref) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+func (t *table) get(br blob.Ref) (location, bool, error) {
+	b := bucket(br)
+	lo := int64(0)
+	if b > 0 {
+		lo = t.fanout[b-1]
+	}
+	hi := t.fanout[b]
+	i, err := t.search(lo, hi, func(r blob.Ref) bool { return r.Less(br) })
+	if err != nil || i == hi {
+		return location{}, false, err
+	}
+	var buf [recordSize]byte
+	r, err := t.read(i, buf[:])
+	if err != nil || r.ref != br {
+		return location{}, false, err
+	}
+	return r.loc, true, nil
+}
+
+// scan calls fn for every record in the table whose ref string sorts after
+// after, in order, until fn returns false.
+func (t *table) scan(after string, fn func(record) (bool, error)) error {
+	start, err := t.search(0, t.count, func(r blob.Ref) bool { return r.String() <= after })
+	if err != nil {
+		return err
+	}
+	rd := bufio.NewReaderSize(io.NewSectionReader(t.file, indexHeaderSize+start*recordSize, (t.count-start)*recordSize), 1<<16)
+	var buf [recordSize]byte
+	for i := start; i < t.count; i++ {
+		if _, err := io.ReadFull(rd, buf[:]); err != nil {
+			return err
+		}
+		if ok, err := fn(decodeRecord(buf[:])); !ok || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTable writes the records given by next, which must be sorted, to a new
+// table file at path, replacing it atomically. next returns false when there
+// are no more records.
+func writeTable(path string, next func() (record, bool, error)) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	if _, err := f.Seek(indexHeaderSize, 0); err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1<<16)
+	var fanout [indexBuckets]int64
+	var buf [recordSize]byte
+	count := int64(0)
+	for {
+		r, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if !r.valid() {
+			return errors.New("diskstorage: location can not be stored in the index: " + r.ref.String())
+		}
+		r.encode(buf[:])
+		if _, err := w.Write(buf[:]); err != nil {
+			return err
+		}
+		fanout[bucket(r.ref)]++
+		count++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	header := make([]byte, indexHeaderSize)
+	copy(header, indexMagic)
+	binary.LittleEndian.PutUint16(header[4:], indexVersion)
+	binary.LittleEndian.PutUint16(header[6:], recordSize)
+	binary.LittleEndian.PutUint64(header[8:], uint64(count))
+	sum := int64(0)
+	for i := range fanout {
+		sum += fanout[i]
+		binary.LittleEndian.PutUint64(header[16+i*8:], uint64(sum))
+	}
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// putRecord returns the record the put time of br is stored as.
+func putRecord(br blob.Ref, put uint32) record {
+	return record{ref: br, loc: location{entry: ztream.Entry{Offset: int64(put)}}}
+}
+
+// readPuts reads the puts file at path, returning the floor and put times.
+func readPuts(path string) (floor uint32, puts map[blob.Ref]uint32, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < putsHeaderSize+4 || !bytes.Equal(b[:4], putsMagic) ||
+		crc32.ChecksumIEEE(b[:len(b)-4]) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return 0, nil, errIndexCorrupt
+	}
+	floor = binary.LittleEndian.Uint32(b[4:])
+	count := binary.LittleEndian.Uint64(b[8:])
+	b = b[putsHeaderSize : len(b)-4]
+	if uint64(len(b))%recordSize != 0 || uint64(len(b))/recordSize != count {
+		return 0, nil, errIndexCorrupt
+	}
+	puts = make(map[blob.Ref]uint32, count)
+	for ; len(b) > 0; b = b[recordSize:] {
+		r := decodeRecord(b)
+		puts[r.ref] = uint32(r.loc.entry.Offset)
+	}
+	return floor, puts, nil
+}
+
+// writePuts writes the floor and put times to a new puts file at path,
+// replacing it atomically.
+func writePuts(path string, floor uint32, puts map[blob.Ref]uint32) error {
+	b := make([]byte, putsHeaderSize, putsHeaderSize+len(puts)*recordSize+4)
+	copy(b, putsMagic)
+	binary.LittleEndian.PutUint32(b[4:], floor)
+	binary.LittleEndian.PutUint64(b[8:], uint64(len(puts)))
+	var buf [recordSize]byte
+	for br, put := range puts {
+		r := putRecord(br, put)
+		r.encode(buf[:])
+		b = append(b, buf[:]...)
+	}
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], crc32.ChecksumIEEE(b[:len(b)-4]))
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// index is not safe for concurrent use, the caller is expected to hold the
+// Storage lock.
+type index struct {
+	dir            string
+	table          *table
+	journal        *os.File
+	delta          map[blob.Ref]*location // nil marks a removed ref
+	puts           map[blob.Ref]uint32    // the times of blobs put again
+	floor          uint32                 // the time the index was rebuilt
+	journaledPuts  int                    // the put times in the journal
+	mergeThreshold int
+	buf            [journalRecordSize]byte
+}
+
+// openIndex opens the index in dir. If it is missing or corrupt an error is
+// returned and the index must be rebuilt.
+func openIndex(dir string, mergeThreshold int) (ix *index, err error) {
+	ix = &index{dir: dir, delta: make(map[blob.Ref]*location), mergeThreshold: mergeThreshold}
+	ix.floor, ix.puts, err = readPuts(filepath.Join(dir, putsFile))
+	if err != nil {
+		return nil, err
+	}
+	ix.table, err = openTable(filepath.Join(dir, indexFile))
+	if err != nil {
+		return nil, err
+	}
+	ix.journal, err = os.OpenFile(filepath.Join(dir, journalFile), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		ix.table.release()
+		return nil, err
+	}
+	if err := ix.replay(); err != nil {
+		ix.close()
+		return nil, err
+	}
+	return ix, nil
+}
+
+// replay reads the journal into memory. A torn record at the end, from a
+// crash while writing, is truncated away.
+func (ix *index) replay() error {
+	r := bufio.NewReader(ix.journal)
+	good := int64(0)
+	for {
+		buf := ix.buf[:]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(buf[:1+recordSize]) != binary.LittleEndian.Uint32(buf[1+recordSize:]) {
+			break
+		}
+		rec := decodeRecord(buf[1:])
+		switch buf[0] {
+		case 'a':
+			ix.delta[rec.ref] = &rec.loc
+		case 'r':
+			ix.delta[rec.ref] = nil
+			delete(ix.puts, rec.ref)
+		case 'p':
+			ix.setPut(rec.ref, uint32(rec.loc.entry.Offset))
+			ix.journaledPuts++
+		default:
+			return errIndexCorrupt
+		}
+		good += journalRecordSize
+	}
+	if err := ix.journal.Truncate(good); err != nil {
+		return err
+	}
+	_, err := ix.journal.Seek(good, 0)
+	return err
+}
+
+func (ix *index) get(br blob.Ref) (location, bool, error) {
+	if l, ok := ix.delta[br]; ok {
+		if l == nil {
+			return location{}, false, nil
+		}
+		return *l, true, nil
+	}
+	return ix.table.get(br)
+}
+
+// add records that br is stored at l. The change is not durable until sync
+// is called.
+func (ix *index) add(br blob.Ref, l location) error {
+	rec := record{ref: br, loc: l}
+	if !rec.valid() {
+		return errors.New("diskstorage: location can not be stored in the index: " + br.String())
+	}
+	if err := ix.log('a', rec); err != nil {
+		return err
+	}
+	ix.delta[br] = &rec.loc
+	return nil
+}
+
+// remove records that br is no longer stored. The change is not durable
+// until sync is called.
+func (ix *index) remove(br blob.Ref) error {
+	if err := ix.log('r', record{ref: br}); err != nil {
+		return err
+	}
+	ix.delta[br] = nil
+	delete(ix.puts, br)
+	return nil
+}
+
+// addPut records that br, which is stored, was put again at put. The change
+// is not durable until sync is called.
+func (ix *index) addPut(br blob.Ref, put uint32) error {
+	if err := ix.log('p', putRecord(br, put)); err != nil {
+		return err
+	}
+	ix.setPut(br, put)
+	ix.journaledPuts++
+	return nil
+}
+
+func (ix *index) setPut(br blob.Ref, put uint32) {
+	if put > ix.puts[br] {
+		ix.puts[br] = put
+	}
+}
+
+// putTime returns the time br was last put again or the index rebuilt,
+// whichever is later, and whether br was put again. It is 0 if neither.
+func (ix *index) putTime(br blob.Ref) (uint32, bool) {
+	put, ok := ix.puts[br]
+	if put < ix.floor {
+		put = ix.floor
+	}
+	return put, ok
+}
+
+func (ix *index) log(op byte, rec record) error {
+	buf := ix.buf[:]
+	buf[0] = op
+	rec.encode(buf[1:])
+	binary.LittleEndian.PutUint32(buf[1+recordSize:], crc32.ChecksumIEEE(buf[:1+recordSize]))
+	_, err := ix.journal.Write(buf)
+	return err
+}
+
+// sync makes all changes durable.
+func (ix *index) sync() error {
+	return ix.journal.Sync()
+}
+
+// needsMerge reports whether the journal has grown to large and should be
+// merged into the table.
+func (ix *index) needsMerge() bool {
+	return len(ix.delta)+ix.journaledPuts >= ix.mergeThreshold
+}
+
+// sortedDelta returns the refs in the journal, sorted, with the records of
+// extra replacing those of the same refs.
+func (ix *index) sortedDelta(extra ...record) []record {
+	recs := make([]record, 0, len(ix.delta)+len(extra))
+	replaced := make(map[blob.Ref]bool, len(extra))
+	for _, r := range extra {
+		replaced[r.ref] = true
+		recs = append(recs, r)
+	}
+	for br, l := range ix.delta {
+		if replaced[br] {
+			continue
+		}
+		rec := record{ref: br}
+		if l != nil {
+			rec.loc = *l
+		} else {
+			rec.loc.pack = maxPackID + 1 // marks removal
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].ref.Less(recs[j].ref) })
+	return recs
+}
+
+func removed(r record) bool {
+	return r.loc.pack > maxPackID
+}
+
+// A merge is a snapshot of the table and journal, written to a new table
+// without holding the lock while the journal keeps growing.
+type merge struct {
+	dir     string
+	table   *table
+	delta   []record
+	puts    map[blob.Ref]uint32
+	floor   uint32
+	journal int64 // the length of the journal merged
+}
+
+// startMerge snapshots the index to be merged by write and then finishMerge.
+func (ix *index) startMerge() (*merge, error) {
+	end, err := ix.journal.Seek(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	puts := make(map[blob.Ref]uint32, len(ix.puts))
+	for br, put := range ix.puts {
+		puts[br] = put
+	}
+	return &merge{dir: ix.dir, table: ix.table.acquire(), delta: ix.sortedDelta(), puts: puts, floor: ix.floor, journal: end}, nil
+}
+
+// write writes the new table containing the snapshot, replacing the table
+// file. Until finishMerge the old journal is replayed on top of either table,
+// since it holds all changes in the snapshot. It may be called without
+// holding the lock.
+func (m *merge) write() error {
+	defer m.table.release()
+	next, stop := mergeRecords(m.table, m.delta, "")
+	err := writeTable(filepath.Join(m.dir, indexFile), next)
+	stop()
+	if err == nil {
+		err = writePuts(filepath.Join(m.dir, putsFile), m.floor, m.puts)
+	}
+	if err != nil {
+		return err
+	}
+	// the table must be durable before the journal is cut
+	return syncDir(m.dir)
+}
+
+// finishMerge switches to the table written by m, and replaces the journal
+// with the changes journaled since m was started.
+func (ix *index) finishMerge(m *merge) error {
+	t, err := openTable(filepath.Join(ix.dir, indexFile))
+	if err != nil {
+		return err
+	}
+	end, err := ix.journal.Seek(0, 1)
+	if err == nil {
+		err = ix.cutJournal(m.journal, end)
+	}
+	if err != nil {
+		t.release()
+		return err
+	}
+	ix.table.release()
+	ix.table = t
+	ix.delta = make(map[blob.Ref]*location)
+	ix.journaledPuts = 0
+	return ix.replay()
+}
+
+// cutJournal atomically replaces the journal with its records in [from, to),
+// leaving the new journal at its start.
+func (ix *index) cutJournal(from, to int64) error {
+	buf := make([]byte, to-from)
+	if _, err := ix.journal.ReadAt(buf, from); err != nil {
+		return err
+	}
+	path := filepath.Join(ix.dir, journalFile)
+	f, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path + ".tmp")
+		return err
+	}
+	ix.journal.Close()
+	ix.journal = f
+	return nil
+}
+
+// mergeRecords returns an iterator over the records of t with the sorted
+// delta applied, starting after the ref string after. stop must be called
+// when done with the iterator.
+func mergeRecords(t *table, delta []record, after string) (next func() (record, bool, error), stop func()) {
+	recs := make(chan record, 1024)
+	done := make(chan struct{})
+	var scanErr error
+	go func() {
+		defer close(recs)
+		scanErr = t.scan(after, func(r record) (bool, error) {
+			select {
+			case recs <- r:
+				return true, nil
+			case <-done:
+				return false, nil
+			}
+		})
+	}()
+	stop = func() {
+		close(done)
+		for range recs {
+		}
+	}
+
+	start := sort.Search(len(delta), func(i int) bool { return delta[i].ref.String() > after })
+	delta = delta[start:]
+	cur, more := <-recs
+	next = func() (record, bool, error) {
+		for {
+			var r record
+			switch {
+			case !more && len(delta) == 0:
+				return record{}, false, scanErr
+			case !more || (len(delta) > 0 && !cur.ref.Less(delta[0].ref)):
+				if more && cur.ref == delta[0].ref {
+					cur, more = <-recs
+				}
+				r, delta = delta[0], delta[1:]
+				if removed(r) {
+					continue
+				}
+			default:
+				r = cur
+				cur, more = <-recs
+			}
+			return r, true, nil
+		}
+	}
+	return next, stop
+}
+
+// enumerate calls fn for every ref in the index, and the records of extra,
+// that sorts after after, in order, until fn returns false or an error. The
+// caller must hold the lock when calling enumerate but it will return an
+// iterator that can be used without holding the lock.
+func (ix *index) enumerate(after string, extra []record) (next func() (record, bool, error), stop func()) {
+	t := ix.table.acquire()
+	next, stopMerge := mergeRecords(t, ix.sortedDelta(extra...), after)
+	return next, func() {
+		stopMerge()
+		t.release()
+	}
+}
+
+// rebuildTable writes a new table file in dir from the records given by scan,
+// which may be in any order. To bound the memory used the records are sorted
+// in runs of runSize which are then merged. If a ref is found several times
+// the first one is kept.
+func rebuildTable(dir string, scan func(fn func(record) error) error) error {
+	var runs []*table
+	defer func() {
+		for _, r := range runs {
+			r.release()
+			os.Remove(r.file.Name())
+		}
+	}()
+
+	recs := make([]record, 0, 1024)
+	flush := func() error {
+		sort.SliceStable(recs, func(i, j int) bool { return recs[i].ref.Less(recs[j].ref) })
+		path := filepath.Join(dir, indexFile+".run"+strconv.Itoa(len(runs)))
+		i := 0
+		err := writeTable(path, func() (record, bool, error) {
+			for i < len(recs) {
+				i++
+				if i > 1 && recs[i-1].ref == recs[i-2].ref {
+					continue
+				}
+				return recs[i-1], true, nil
+			}
+			return record{}, false, nil
+		})
+		if err != nil {
+			return err
+		}
+		t, err := openTable(path)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, t)
+		recs = recs[:0]
+		return nil
+	}
+
+	err := scan(func(r record) error {
+		recs = append(recs, r)
+		if len(recs) >= runSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(recs) > 0 || len(runs) == 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	// k-way merge of the runs, keeping the first run's record for duplicates
+	type head struct {
+		cur  record
+		next func() (record, bool, error)
+		stop func()
+	}
+	var heads []*head
+	defer func() {
+		for _, h := range heads {
+			h.stop()
+		}
+	}()
+	for _, r := range runs {
+		next, stop := mergeRecords(r, nil, "")
+		h := &head{next: next, stop: stop}
+		cur, ok, err := next()
+		if err != nil {
+			stop()
+			return err
+		}
+		if !ok {
+			stop()
+			continue
+		}
+		h.cur = cur
+		heads = append(heads, h)
+	}
+	var last blob.Ref
+	return writeTable(filepath.Join(dir, indexFile), func() (record, bool, error) {
+		for len(heads) > 0 {
+			min := 0
+			for i := range heads {
+				if heads[i].cur.ref.Less(heads[min].cur.ref) {
+					min = i
+				}
+			}
+			h := heads[min]
+			r := h.cur
+			cur, ok, err := h.next()
+			if err != nil {
+				return record{}, false, err
+			}
+			if ok {
+				h.cur = cur
+			} else {
+				h.stop()
+				heads = append(heads[:min], heads[min+1:]...)
+			}
+			if r.ref == last {
+				continue
+			}
+			last = r.ref
+			return r, true, nil
+		}
+		return record{}, false, nil
+	})
+}
+
+func (ix *index) close() error {
+	err := ix.journal.Close()
+	if e := ix.table.release(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
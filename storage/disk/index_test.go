@@ -0,0 +1,204 @@
+package diskstorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/ztream"
+)
+
+func enumerate(t *testing.T, s storage.Storage, filter storage.Filter) []blob.Ref {
+	ch := make(chan blob.SizedRef)
+	errc := make(chan error, 1)
+	go func() { errc <- s.EnumerateBlobs(context.Background(), ch, filter) }()
+	var refs []blob.Ref
+	for sr := range ch {
+		refs = append(refs, sr.Ref)
+	}
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+	return refs
+}
+
+func sortedRefs(refs []blob.Ref) []blob.Ref {
+	refs = append([]blob.Ref(nil), refs...)
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Less(refs[j]) })
+	return refs
+}
+
+func equalRefs(a, b []blob.Ref) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestIndexMergeAndRebuild(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opt := tOpt
+	opt.IndexMergeThreshold = 7
+	s, err := Open(dir, opt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	var refs []blob.Ref
+	datas := map[blob.Ref][]byte{}
+	for i := 0; i < 40; i++ {
+		br, d := testBlob(5000+i, i%3 == 0)
+		put(t, s, br, d)
+		refs = append(refs, br)
+		datas[br] = d
+	}
+	if err := s.RemoveBlobs(context.Background(), refs[:5]); err != nil {
+		t.Error(err)
+	}
+	refs = sortedRefs(refs[5:])
+	if got := enumerate(t, s, storage.Filter{}); !equalRefs(got, refs) {
+		t.Error("enumerated refs not matching stored", len(got), len(refs))
+	}
+	if got := enumerate(t, s, storage.Filter{After: refs[10].String()}); !equalRefs(got, refs[11:]) {
+		t.Error("enumerated refs after not matching stored", len(got), len(refs[11:]))
+	}
+	s.Close()
+
+	// both a missing and a corrupt index must be rebuilt from the packs
+	for _, damage := range []func(){
+		func() { os.Remove(filepath.Join(dir, indexFile)) },
+		func() { os.Truncate(filepath.Join(dir, indexFile), 100) },
+	} {
+		damage()
+		s, err = Open(dir, opt)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if got := enumerate(t, s, storage.Filter{}); !equalRefs(got, refs) {
+			t.Error("rebuilt index not matching stored", len(got), len(refs))
+		}
+		for _, br := range refs {
+			get(t, s, br, datas[br])
+		}
+		s.Close()
+	}
+}
+
+func TestIndexTornJournal(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	br1, d1 := testBlob(100, false)
+	br2, d2 := testBlob(100, true)
+	put(t, s, br1, d1)
+	put(t, s, br2, d2)
+	s.Close()
+
+	// a torn last record is discarded, but reconciling with the current
+	// pack adds it back
+	fn := filepath.Join(dir, journalFile)
+	fi, _ := os.Stat(fn)
+	os.Truncate(fn, fi.Size()-3)
+
+	s, err = Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	get(t, s, br1, d1)
+	get(t, s, br2, d2)
+}
+
+func TestIndexMergeConcurrent(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	err := writeTable(filepath.Join(dir, indexFile), func() (record, bool, error) {
+		return record{}, false, nil
+	})
+	if err == nil {
+		err = writePuts(filepath.Join(dir, putsFile), 0, nil)
+	}
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	ix, err := openIndex(dir, 1)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	var refs []blob.Ref
+	add := func(i int) {
+		br, _ := testBlob(100, false)
+		ix.add(br, location{pack: uint32(i), entry: ztream.Entry{Offset: int64(i), CompressedSize: 100, UncompressedSize: 100}})
+		refs = append(refs, br)
+	}
+	for i := 0; i < 10; i++ {
+		add(i)
+	}
+	ix.addPut(refs[0], 100)
+	ix.addPut(refs[1], 100)
+	ix.sync()
+	m, err := ix.startMerge()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// changes while the table is written are kept in the journal
+	for i := 10; i < 15; i++ {
+		add(i)
+	}
+	ix.remove(refs[0])
+	ix.remove(refs[10])
+	ix.addPut(refs[2], 200)
+	ix.sync()
+	if err := m.write(); err != nil {
+		t.Error(err)
+	}
+	if err := ix.finishMerge(m); err != nil {
+		t.Error(err)
+	}
+	if len(ix.delta) != 6 || ix.table.count != 10 {
+		t.Error("expected the changes since the snapshot in the journal", len(ix.delta), ix.table.count)
+	}
+
+	check := func() {
+		for i, br := range refs {
+			l, ok, err := ix.get(br)
+			if err != nil || ok == (i == 0 || i == 10) || ok && l.pack != uint32(i) {
+				t.Error("unexpected location after merge", i, l, ok, err)
+			}
+			want := map[int]uint32{1: 100, 2: 200}[i]
+			if put, again := ix.putTime(br); put != want || again != (want != 0) {
+				t.Error("unexpected put time after merge", i, put, again)
+			}
+		}
+	}
+	check()
+	ix.close()
+	ix, err = openIndex(dir, 1)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer ix.close()
+	check()
+}
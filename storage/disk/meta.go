@@ -0,0 +1,96 @@
+package diskstorage
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage/ztream"
+)
+
+// The metadata of a blob is stored in the Extra of its entry, such that the
+// index can be rebuilt and checked against the packs without reading the
+// data of the blobs. It is 38 bytes:
+//
+//	[0]     metaVersion
+//	[1]     1 for schema blobs, else 0
+//	[2:10]  the time the blob was put, in nanoseconds since the epoch
+//	[10:38] the ref digest
+//
+// Entries of packs written before the metadata was stored have none.
+
+const (
+	metaVersion = 1
+	metaSize    = 38
+)
+
+// putRefresh is how old the put time of a blob in the index must be for it to
+// be updated when put again, to keep the put time close to the last put
+// without journaling every blob put again.
+const putRefresh = time.Hour
+
+// unreadMeta is the Extra of entries looked up in the index, which only keeps
+// whether they have metadata. It has the length needed to find the header of
+// the entry but is not valid metadata, which must be read from the pack.
+var unreadMeta = string(make([]byte, metaSize))
+
+func encodeMeta(br blob.Ref, put int64) string {
+	var b [metaSize]byte
+	b[0] = metaVersion
+	if br.Schema() {
+		b[1] = 1
+	}
+	binary.LittleEndian.PutUint64(b[2:], uint64(put))
+	copy(b[10:], br.Digest())
+	return string(b[:])
+}
+
+func decodeMeta(extra string) (br blob.Ref, put int64, ok bool) {
+	if len(extra) != metaSize || extra[0] != metaVersion || extra[1] > 1 {
+		return br, 0, false
+	}
+	br, ok = blob.RefFromDigest([]byte(extra[10:]), extra[1] == 1)
+	return br, int64(binary.LittleEndian.Uint64([]byte(extra[2:10]))), ok
+}
+
+// checkMeta returns an error if e has metadata that is not that of br.
+func checkMeta(br blob.Ref, e ztream.Entry) error {
+	if e.Extra == "" {
+		return nil
+	}
+	if mr, _, ok := decodeMeta(e.Extra); !ok || mr != br {
+		return errors.New("diskstorage: metadata of entry not matching its name: " + e.Name)
+	}
+	return nil
+}
+
+// NewVerifier returns a ztream.Verifier checking that the entries of a pack
+// are named by the ref of their data, and that their metadata if any is that
+// of the blob.
+func NewVerifier() ztream.Verifier {
+	return &verifier{h: blob.NewHash()}
+}
+
+type verifier struct {
+	h hash.Hash
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	return v.h.Write(p)
+}
+
+func (v *verifier) Reset() {
+	v.h.Reset()
+}
+
+func (v *verifier) Match(name string) bool {
+	br, ok := blob.ParseString(name)
+	return ok && blob.RefFromHash(v.h, br.Schema()) == br
+}
+
+func (v *verifier) MatchExtra(name, extra string) bool {
+	br, _ := blob.ParseString(name)
+	return checkMeta(br, ztream.Entry{Name: name, Extra: extra}) == nil
+}
@@ -0,0 +1,162 @@
+package diskstorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage/gc"
+	"github.com/vron/compono/storage/ztream"
+)
+
+func TestMeta(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	before := time.Now().UnixNano()
+	refs, datas := []blob.Ref{}, [][]byte{}
+	for i := 0; i < 4; i++ {
+		br, d := testBlob(1000, i%2 == 0)
+		put(t, s, br, d)
+		refs, datas = append(refs, br), append(datas, d)
+	}
+	after := time.Now().UnixNano()
+	s.Close()
+
+	// the metadata is stored with the entries, as checked by the verifier
+	opt := tOpt.Ztream
+	opt.Verifier = NewVerifier()
+	p, err := ztream.Open(filepath.Join(dir, "pack-00000000.zip"), opt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	c, _ := p.Contents()
+	p.Close()
+	for i, e := range c {
+		br, put, ok := decodeMeta(e.Extra)
+		if !ok || br != refs[i] || put < before || put > after {
+			t.Error("unexpected metadata", e.Name, br, put)
+		}
+	}
+
+	// the entries are found with the metadata kept in the index, also when
+	// rebuilt from the packs
+	s, err = Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for i := range refs {
+		get(t, s, refs[i], datas[i])
+	}
+	if err := s.RebuildIndex(); err != nil {
+		t.Error(err)
+	}
+	for i := range refs {
+		get(t, s, refs[i], datas[i])
+	}
+	s.Close()
+}
+
+func TestMetaNotMatching(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	br1, d1 := testBlob(1000, false)
+	br2, _ := testBlob(1000, false)
+	p, _ := ztream.Create(filepath.Join(dir, "pack-00000000.zip"), tOpt.Ztream)
+	p.Append(br1.String(), d1, encodeMeta(br2, time.Now().UnixNano()))
+	p.Close()
+
+	if s, err := Open(dir, tOpt); err == nil {
+		s.Close()
+		t.Error("expected metadata not matching the name to fail")
+	}
+	v := NewVerifier()
+	v.Write(d1)
+	if !v.Match(br1.String()) || v.(ztream.ExtraVerifier).MatchExtra(br1.String(), encodeMeta(br2, 1)) {
+		t.Error("expected the verifier to check the metadata")
+	}
+}
+
+var _ gc.PutTimer = (*Storage)(nil)
+
+func TestPutTime(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	// a blob first put long ago, in an index not rebuilt since
+	br, d := testBlob(1000, false)
+	old := time.Now().Add(-2 * putRefresh).Truncate(time.Second)
+	p, _ := ztream.Create(filepath.Join(dir, "pack-00000000.zip"), tOpt.Ztream)
+	p.Append(br.String(), d, encodeMeta(br, old.UnixNano()))
+	p.Close()
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := writePuts(filepath.Join(dir, putsFile), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	opt := tOpt
+	opt.IndexMergeThreshold = 1
+	s, err = Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put, err := s.PutTime(ctx, br); err != nil || !put.Equal(old) {
+		t.Error("expected the put time in the metadata", put, old, err)
+	}
+
+	// putting it again only updates the index, which is merged
+	before := time.Now().Truncate(time.Second)
+	put(t, s, br, d)
+	if put, err := s.PutTime(ctx, br); err != nil || put.Before(before) {
+		t.Error("expected the put time of the last put", put, before, err)
+	}
+	if c, _ := s.packs[s.current].Contents(); len(c) != 1 {
+		t.Error("expected the blob not appended again", len(c))
+	}
+	if _, err := s.PutTime(ctx, blob.Ref{}); !os.IsNotExist(err) {
+		t.Error("expected a missing blob not to exist", err)
+	}
+	s.Close()
+	if s, err = Open(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if put, err := s.PutTime(ctx, br); err != nil || put.Before(before) {
+		t.Error("expected the put time of the last put when opened again", put, before, err)
+	}
+	if _, puts, err := readPuts(filepath.Join(dir, putsFile)); err != nil || len(puts) != 1 {
+		t.Error("expected the put time to be merged", puts, err)
+	}
+
+	// rebuilt put times are those of the rebuild
+	br2, d2 := testBlob(1000, false)
+	put(t, s, br2, d2)
+	if err := s.RemoveBlobs(ctx, []blob.Ref{br}); err != nil {
+		t.Error(err)
+	}
+	before = time.Now().Truncate(time.Second)
+	if err := s.RebuildIndex(); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.PutTime(ctx, br); !os.IsNotExist(err) {
+		t.Error("expected the removed blob not to exist", err)
+	}
+	if put, err := s.PutTime(ctx, br2); err != nil || put.Before(before) {
+		t.Error("expected the put time of the rebuild", put, before, err)
+	}
+}
@@ -0,0 +1,46 @@
+package diskstorage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/vron/compono/storage/ztream"
+)
+
+const packPattern = "pack-%08d.zip"
+
+func (s *Storage) packPath(id uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf(packPattern, id))
+}
+
+// listPacks returns the ids of all the packs in dir, sorted.
+func listPacks(dir string) ([]uint32, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, fi := range fis {
+		var id uint32
+		if n, err := fmt.Sscanf(fi.Name(), packPattern, &id); err != nil || n != 1 {
+			continue
+		}
+		if fi.Name() != fmt.Sprintf(packPattern, id) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func sortedIDs(packs map[uint32]*ztream.Stream) []uint32 {
+	ids := make([]uint32, 0, len(packs))
+	for id := range packs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
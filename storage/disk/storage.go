@@ -1,53 +1,638 @@
+// Package diskstorage implements a storage.Storage that keeps blobs in
+// ztream pack files in a directory on local disk.
 package diskstorage
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/ztream"
 )
 
+var ErrClosed = errors.New("diskstorage: the storage is closed")
+
+// Options to configure the disk storage.
+type Options struct {
+	// Ztream are the options used when creating and opening pack files. The
+	// Dictionaries are set by the storage, and the FileSize can be at most
+	// 1 << 39 for the offsets to fit in the index.
+	Ztream ztream.Options
+	// IndexMergeThreshold is the number of changes kept in the index journal
+	// before they are merged into the index table.
+	IndexMergeThreshold int
+	// Durability selects if PutBlob waits for blobs to be synced to disk.
+	Durability Durability
+	// CommitDelay is the time to wait for more blobs to be appended before
+	// syncing a batch to disk.
+	CommitDelay time.Duration
+	// CompactThreshold is the fraction of a pack that must be used by live
+	// blobs for it not to be compacted.
+	CompactThreshold float64
+	// CompactInterval is how often the storage is compacted in the
+	// background. If zero it is only compacted when Compact is called.
+	CompactInterval time.Duration
+	// DictionarySamples is the number of small schema blobs sampled to train
+	// a compression dictionary from, the first of which is trained once that
+	// many have been put. If negative no dictionaries are trained.
+	DictionarySamples int
+	// DictionarySize is the size of the dictionaries trained, at most
+	// ztream.MaxDictionarySize.
+	DictionarySize int
+}
+
+var DefaultOptions = Options{
+	IndexMergeThreshold: 1 << 16,
+	CompactThreshold:    0.5,
+	DictionarySamples:   1 << 10,
+	DictionarySize:      16 << 10,
+}
+
+// Storage stores blobs appended to pack files, one being written to at the
+// time. When it is full it is sealed and a new pack is created.
 type Storage struct {
+	m sync.Mutex // protects all fields
+
+	dir     string
+	opt     Options
+	packs   map[uint32]*ztream.Stream
+	current uint32 // the pack new blobs are appended to
+	index   *index
+	closed  bool
+
+	mergeMu sync.Mutex // held while merging the index, not protected by m
+
+	// copies are the packs of the copies appended by a compaction that are
+	// not yet indexed, which RemoveBlobs must wipe too, else they would be
+	// added back by reconcile.
+	copies    map[blob.Ref]uint32
+	compactMu sync.Mutex // held while compacting, not protected by m
+
+	// packMu is held for reading while packs are used without holding m,
+	// and for writing, after m, to close them or wipe entries.
+	packMu sync.RWMutex
+
+	dicts   *ztream.Dictionaries // also used by the packs
+	samples [][]byte             // schema blobs sampled to train dictionaries
+	sampled int                  // schema blobs put that could be sampled
+	toTrain [][]byte             // samples for the committer to train from
+	trainMu sync.Mutex           // held while training, not protected by m
+
+	batch         *batch                    // blobs appended but not yet synced
+	pending       map[blob.Ref]*pendingBlob // blobs appended but not yet synced
+	commitc       chan struct{}
+	stopc         chan struct{}
+	committerDone chan struct{}
+	compactorDone chan struct{}
+}
+
+var _ storage.Storage = (*Storage)(nil)
+var _ storage.Generationer = (*Storage)(nil)
+
+type location struct {
+	pack  uint32
+	entry ztream.Entry
+}
+
+// Open opens the storage in the directory dir, creating it if needed.
+func Open(dir string, opt Options) (s *Storage, err error) {
+	if opt.IndexMergeThreshold <= 0 {
+		opt.IndexMergeThreshold = DefaultOptions.IndexMergeThreshold
+	}
+	if opt.CompactThreshold <= 0 {
+		opt.CompactThreshold = DefaultOptions.CompactThreshold
+	}
+	if opt.DictionarySamples == 0 {
+		opt.DictionarySamples = DefaultOptions.DictionarySamples
+	}
+	if opt.DictionarySize <= 0 {
+		opt.DictionarySize = DefaultOptions.DictionarySize
+	}
+	if opt.Ztream.FileSize > maxOffset+1 {
+		return nil, errors.New("diskstorage: to large FileSize, must be at most 1 << 39")
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	dicts, err := LoadDictionaries(dir)
+	if err != nil {
+		return nil, err
+	}
+	opt.Ztream.Dictionaries = dicts
+	s = &Storage{
+		dir:           dir,
+		opt:           opt,
+		dicts:         dicts,
+		packs:         make(map[uint32]*ztream.Stream),
+		batch:         newBatch(),
+		pending:       make(map[blob.Ref]*pendingBlob),
+		copies:        make(map[blob.Ref]uint32),
+		commitc:       make(chan struct{}, 1),
+		stopc:         make(chan struct{}),
+		committerDone: make(chan struct{}),
+		compactorDone: make(chan struct{}),
+	}
+	defer func(s *Storage) {
+		// s itself is nil when returning an error
+		if err != nil {
+			if s.index != nil {
+				s.index.close()
+			}
+			s.closePacks()
+		}
+	}(s)
+
+	ids, err := listPacks(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		p, err := ztream.Open(s.packPath(id), opt.Ztream)
+		if err != nil {
+			return nil, err
+		}
+		s.packs[id] = p
+	}
+
+	s.index, err = openIndex(dir, opt.IndexMergeThreshold)
+	if os.IsNotExist(err) || err == errIndexCorrupt {
+		err = s.rebuildIndex()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		if err := s.createPack(0); err != nil {
+			return nil, err
+		}
+	} else {
+		s.current = ids[len(ids)-1]
+		if err := s.finishWipes(); err != nil {
+			return nil, err
+		}
+		if err := s.reconcile(); err != nil {
+			return nil, err
+		}
+	}
+	go s.committer()
+	if opt.CompactInterval > 0 {
+		go s.compactor()
+	} else {
+		close(s.compactorDone)
+	}
+	return s, nil
+}
+
+// RebuildIndex discards the index and rebuilds it by scanning all packs.
+func (s *Storage) RebuildIndex() error {
+	s.mergeMu.Lock()
+	defer s.mergeMu.Unlock()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.rebuildIndex()
 }
 
-func (s *Storage) FetchBlob(context.Context, blob.Ref) (blob io.ReadCloser, size uint32, err error) {
-	panic("NIY")
+// The packs only store when each blob was first put, so the blobs are taken
+// to be put when the index is rebuilt. The caller is expected to hold the
+// lock.
+func (s *Storage) rebuildIndex() error {
+	if s.index != nil {
+		s.index.close()
+		s.index = nil
+	}
+	floor := uint32(time.Now().Unix())
+	err := rebuildTable(s.dir, func(fn func(record) error) error {
+		for _, id := range sortedIDs(s.packs) {
+			if err := s.scanPack(id, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = writePuts(filepath.Join(s.dir, putsFile), floor, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, journalFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.index, err = openIndex(s.dir, s.opt.IndexMergeThreshold)
+	return err
 }
 
-func (s *Storage) ReceiveBlob(ctx context.Context, br, fl blob.Ref, source io.Reader) (blob.SizedRef, error) {
-	panic("NIY")
+// reconcile adds entries of the current pack missing from the index, which
+// happens if we crashed after syncing the pack but before syncing the index.
+// The caller is expected to hold the lock.
+func (s *Storage) reconcile() error {
+	err := s.scanPack(s.current, func(r record) error {
+		_, ok, err := s.index.get(r.ref)
+		if ok || err != nil {
+			return err
+		}
+		return s.index.add(r.ref, r.loc)
+	})
+	if err != nil {
+		return err
+	}
+	return s.syncIndex()
+}
 
+func (s *Storage) scanPack(id uint32, fn func(record) error) error {
+	entries, err := s.packs[id].Contents()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		ref, ok := blob.ParseString(e.Name)
+		if !ok {
+			return errors.New("diskstorage: pack contains invalid name: " + e.Name)
+		}
+		if err := checkMeta(ref, e); err != nil {
+			return err
+		}
+		if err := fn(record{ref: ref, loc: location{pack: id, entry: e}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBlobs looks up the blobs holding the lock, and then reads them without
+// it, such that reads run concurrently with each other and with writes.
+func (s *Storage) GetBlobs(ctx context.Context, blobs []blob.Ref) (io.ReadCloser, uint32, error) {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return nil, 0, ErrClosed
+	}
+
+	size := 0
+	locs := make([]location, len(blobs))
+	packs := make([]*ztream.Stream, len(blobs))
+	for i, br := range blobs {
+		l, ok, err := s.lookup(br)
+		if err != nil {
+			s.m.Unlock()
+			return nil, 0, err
+		}
+		if !ok {
+			s.m.Unlock()
+			return nil, 0, os.ErrNotExist
+		}
+		locs[i], packs[i] = l, s.packs[l.pack]
+		size += int(l.entry.UncompressedSize)
+	}
+	// the packs are neither closed nor wiped until read
+	s.packMu.RLock()
+	s.m.Unlock()
+	defer s.packMu.RUnlock()
+
+	buf := make([]byte, size)
+	offset := 0
+	for i, l := range locs {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		if err := packs[i].Read(l.entry, buf[offset:]); err != nil {
+			return nil, 0, err
+		}
+		offset += int(l.entry.UncompressedSize)
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), uint32(size), nil
+}
+
+// PutBlob appends the blob to the current pack. Concurrent calls are synced
+// to disk in batches. With AckEarly it returns storage.ErrPending together
+// with the SizedRef if the blob is not yet synced. A blob already stored is
+// not appended again, but the time it was put again is kept in the index,
+// updated if older than putRefresh and synced with the next batch.
+func (s *Storage) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	data, err := storage.ReadVerified(br, source)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return blob.SizedRef{}, ErrClosed
+	}
+	if l, ok, err := s.lookup(br); ok || err != nil {
+		var b *batch
+		if p := s.pending[br]; p != nil {
+			b = p.batch
+		} else if put, _ := s.index.putTime(br); ok && time.Since(time.Unix(int64(put), 0)) >= putRefresh {
+			b = s.addPut(br)
+		}
+		s.m.Unlock()
+		return s.ack(ctx, br.Sized(uint32(l.entry.UncompressedSize)), b, err)
+	}
+	if err := ctx.Err(); err != nil {
+		s.m.Unlock()
+		return blob.SizedRef{}, err
+	}
+
+	now := time.Now()
+	meta := encodeMeta(br, now.UnixNano())
+	e, err := s.packs[s.current].Append(br.String(), data, meta)
+	if err == ztream.ErrStreamFull {
+		if err = s.roll(); err == nil {
+			e, err = s.packs[s.current].Append(br.String(), data, meta)
+		}
+	}
+	if err != nil {
+		s.m.Unlock()
+		return blob.SizedRef{}, err
+	}
+	b := s.addPending(br, location{pack: s.current, entry: e})
+	if br.Schema() {
+		s.sample(data)
+	}
+	s.m.Unlock()
+	return s.ack(ctx, br.Sized(uint32(len(data))), b, nil)
+}
+
+// ack returns the result of PutBlob for a blob pending in b, which may be nil
+// if the blob is already synced.
+func (s *Storage) ack(ctx context.Context, sr blob.SizedRef, b *batch, err error) (blob.SizedRef, error) {
+	if err != nil || b == nil {
+		return sr, err
+	}
+	if s.opt.Durability == AckEarly {
+		select {
+		case <-b.done:
+			return sr, b.err
+		default:
+			return sr, storage.ErrPending
+		}
+	}
+	if err := wait(ctx, b); err != nil {
+		return blob.SizedRef{}, err
+	}
+	return sr, nil
+}
+
+// PutTime returns the time br was last put, at most putRefresh earlier than
+// the last call to PutBlob, or the zero time if it is not known as for blobs
+// put before the time was stored. Blobs put before the index was rebuilt are
+// taken to be put when it was rebuilt. If br is not stored os.ErrNotExist is
+// returned.
+func (s *Storage) PutTime(ctx context.Context, br blob.Ref) (time.Time, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return time.Time{}, ErrClosed
+	}
+	l, ok, err := s.lookup(br)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		return time.Time{}, os.ErrNotExist
+	}
+	put, again := s.index.putTime(br)
+	if again {
+		// put again after it was first put
+		return time.Unix(int64(put), 0), nil
+	}
+	first, err := s.firstPut(l)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if first.Unix() < int64(put) {
+		return time.Unix(int64(put), 0), nil
+	}
+	return first, nil
+}
+
+// firstPut returns the put time stored in the metadata of the entry at l, or
+// the zero time if it has none. The caller is expected to hold the lock,
+// which is released while the metadata is read from the pack.
+func (s *Storage) firstPut(l location) (time.Time, error) {
+	extra := l.entry.Extra
+	if extra == unreadMeta {
+		p := s.packs[l.pack]
+		s.packMu.RLock()
+		s.m.Unlock()
+		var err error
+		extra, err = p.Extra(l.entry)
+		s.packMu.RUnlock()
+		s.m.Lock()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if s.closed {
+			return time.Time{}, ErrClosed
+		}
+	}
+	if extra == "" {
+		return time.Time{}, nil
+	}
+	_, put, ok := decodeMeta(extra)
+	if !ok {
+		return time.Time{}, errors.New("diskstorage: invalid metadata of entry: " + l.entry.Name)
+	}
+	return time.Unix(0, put), nil
 }
 
 func (s *Storage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
-	panic("NIY")
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return ErrClosed
+	}
+	found := make([]blob.SizedRef, 0, len(blobs))
+	for _, br := range blobs {
+		l, ok, err := s.lookup(br)
+		if err != nil {
+			s.m.Unlock()
+			return err
+		}
+		if ok {
+			found = append(found, br.Sized(uint32(l.entry.UncompressedSize)))
+		}
+	}
+	s.m.Unlock()
 
+	for _, sr := range found {
+		if err := fn(sr); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (s *Storage) EnumerateBlobs(ctx context.Context,
-	dest chan<- blob.SizedRef,
-	after string) error {
-	panic("NIY")
+func (s *Storage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, filter storage.Filter) error {
+	defer close(dest)
 
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return ErrClosed
+	}
+	pending := make([]record, 0, len(s.pending))
+	for br, p := range s.pending {
+		pending = append(pending, record{ref: br, loc: p.loc})
+	}
+	next, stop := s.index.enumerate(filter.After, pending)
+	s.m.Unlock()
+	defer stop()
+
+	for {
+		r, ok, err := next()
+		if !ok || err != nil {
+			return err
+		}
+		if !filter.Match(r.ref) {
+			continue
+		}
+		select {
+		case dest <- r.ref.Sized(uint32(r.loc.entry.UncompressedSize)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 func (s *Storage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
-	panic("NIY")
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
 
+	// the removals are made durable in the index before wiping, such that
+	// we never refer to wiped data if we crash half way, and the entries to
+	// wipe before that, such that the wipes are finished when next opened.
+	// The entries are wiped per pack to rewrite its directory once.
+	var packs []uint32
+	names := map[uint32][]string{}
+	var removed []blob.Ref
+	for _, br := range blobs {
+		l, ok, err := s.lookup(br)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if _, ok := names[l.pack]; !ok {
+			packs = append(packs, l.pack)
+		}
+		names[l.pack] = append(names[l.pack], l.entry.Name)
+		if id, ok := s.copies[br]; ok && id != l.pack {
+			if _, ok := names[id]; !ok {
+				packs = append(packs, id)
+			}
+			names[id] = append(names[id], l.entry.Name)
+		}
+		removed = append(removed, br)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := s.logWipes(packs, names); err != nil {
+		return err
+	}
+	for _, br := range removed {
+		if _, ok := s.pending[br]; ok {
+			// it is never added to the index
+			delete(s.pending, br)
+		} else if err := s.index.remove(br); err != nil {
+			return err
+		}
+	}
+	if err := s.syncIndex(); err != nil {
+		return err
+	}
+	return s.finishWipes()
 }
 
-func (s *Storage) StorageGeneration() (initTime time.Time, random string, err error) {
-	panic("NIY")
+// Close syncs and closes all the pack files.
+func (s *Storage) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+	close(s.stopc)
+	s.m.Unlock()
+	<-s.committerDone
+	<-s.compactorDone
+	s.commit()
+	s.m.Lock()
 
+	err := s.index.close()
+	if e := s.closePacks(); e != nil && err == nil {
+		err = e
+	}
+	return err
 }
 
-func (s *Storage) ResetStorageGeneration() error {
-	panic("NIY")
+// the caller is expected to hold the lock.
+func (s *Storage) closePacks() error {
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+	var err error
+	for id, p := range s.packs {
+		if e := p.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(s.packs, id)
+	}
+	return err
+}
 
+// roll seals the current pack and creates a new one to append to. The
+// caller is expected to hold the lock.
+func (s *Storage) roll() error {
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+	id := s.current
+	if err := s.packs[id].Close(); err != nil {
+		return err
+	}
+	p, err := ztream.Open(s.packPath(id), s.opt.Ztream)
+	if err != nil {
+		delete(s.packs, id)
+		return err
+	}
+	s.packs[id] = p
+	return s.createPack(id + 1)
 }
 
-func (s *Storage) Close() error {
-	panic("NIY")
+// the caller is expected to hold the lock.
+func (s *Storage) createPack(id uint32) error {
+	p, err := ztream.Create(s.packPath(id), s.opt.Ztream)
+	if err != nil {
+		return err
+	}
+	s.packs[id] = p
+	s.current = id
+	return nil
+}
 
+// StorageGeneration implements storage.Generationer.
+func (s *Storage) StorageGeneration() (initTime time.Time, random string, err error) {
+	return readGeneration(s.dir)
+}
+
+// ResetStorageGeneration implements storage.Generationer.
+func (s *Storage) ResetStorageGeneration() error {
+	return writeGeneration(s.dir)
 }
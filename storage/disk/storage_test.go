@@ -0,0 +1,252 @@
+package diskstorage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/storagetest"
+	"github.com/vron/compono/storage/ztream"
+)
+
+var tOpt = Options{
+	Ztream: ztream.Options{
+		FileSize:             1 << 18,
+		SampleCompressSize:   1024,
+		CompressionThreshold: 0.8,
+	},
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "diskstorage")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	return dir
+}
+
+func testBlob(size int, schema bool) (blob.Ref, []byte) {
+	d := make([]byte, size)
+	rand.Read(d)
+	h := blob.NewHash()
+	h.Write(d)
+	return blob.RefFromHash(h, schema), d
+}
+
+func put(t *testing.T, s storage.Storage, br blob.Ref, d []byte) {
+	sr, err := s.PutBlob(context.Background(), br, blob.Ref{}, bytes.NewReader(d))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if sr.Ref != br || sr.Size() != uint32(len(d)) {
+		t.Error("unexpected sized ref returned", sr)
+	}
+}
+
+func get(t *testing.T, s storage.Storage, br blob.Ref, d []byte) {
+	rc, size, err := s.GetBlobs(context.Background(), []blob.Ref{br})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Error(err)
+	}
+	if size != uint32(len(d)) || !bytes.Equal(b, d) {
+		t.Error("read data not equal to stored", br)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	br, d := testBlob(1000, false)
+	put(t, s, br, d)
+	get(t, s, br, d)
+
+	wrong, _ := testBlob(10, false)
+	if _, err := s.PutBlob(context.Background(), wrong, blob.Ref{}, bytes.NewReader(d)); err != storage.ErrHashMismatch {
+		t.Error("expected hash mismatch, got:", err)
+	}
+	if _, _, err := s.GetBlobs(context.Background(), []blob.Ref{wrong}); !os.IsNotExist(err) {
+		t.Error("expected not exist, got:", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRollPacks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	refs, datas := []blob.Ref{}, [][]byte{}
+	for i := 0; i < 10; i++ {
+		br, d := testBlob(100<<10, false)
+		put(t, s, br, d)
+		refs, datas = append(refs, br), append(datas, d)
+	}
+	if ids, _ := listPacks(dir); len(ids) < 4 {
+		t.Error("expected the blobs to be spread over several packs", ids)
+	}
+	for i := range refs {
+		get(t, s, refs[i], datas[i])
+	}
+	if err := s.RemoveBlobs(context.Background(), refs[:3]); err != nil {
+		t.Error(err)
+	}
+	s.Close()
+
+	s, err = Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	for i := range refs[3:] {
+		get(t, s, refs[3+i], datas[3+i])
+	}
+	n := 0
+	err = s.StatBlobs(context.Background(), refs, func(blob.SizedRef) error { n++; return nil })
+	if err != nil || n != 7 {
+		t.Error("expected 7 blobs to remain", n, err)
+	}
+}
+
+func TestPutEmpty(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	br1, d1 := testBlob(100, false)
+	br2, d2 := testBlob(0, false)
+	br3, d3 := testBlob(100, false)
+	put(t, s, br1, d1)
+	put(t, s, br2, d2)
+	put(t, s, br3, d3)
+	s.Close()
+
+	// the blobs after it are found when the packs are scanned
+	s, err = Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	if err := s.RebuildIndex(); err != nil {
+		t.Error(err)
+	}
+	get(t, s, br1, d1)
+	get(t, s, br2, d2)
+	get(t, s, br3, d3)
+}
+
+func TestFileSizeTooLarge(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// the offsets of the entries would not fit in the index
+	opt := tOpt
+	opt.Ztream.FileSize = maxOffset + 2
+	if s, err := Open(dir, opt); err == nil {
+		s.Close()
+		t.Error("expected a FileSize larger than the index can address to fail")
+	}
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (storage.Storage, func()) {
+		dir := tempDir(t)
+		s, err := Open(dir, tOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, func() { os.RemoveAll(dir) }
+	})
+}
+
+// blockingRead is a file whose ReadAt waits until released once reading is
+// ready to receive.
+type blockingRead struct {
+	ztream.File
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (f blockingRead) ReadAt(p []byte, off int64) (int, error) {
+	select {
+	case f.reading <- struct{}{}:
+		<-f.release
+	default:
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// TestConcurrentGet checks that blobs are read without holding the lock.
+func TestConcurrentGet(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	reading, release := make(chan struct{}), make(chan struct{})
+	opt := tOpt
+	opt.Ztream.OpenFile = func(name string, flag int, perm os.FileMode) (ztream.File, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return blockingRead{f, reading, release}, nil
+	}
+	s, err := Open(dir, opt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	br1, d1 := testBlob(1000, false)
+	br2, d2 := testBlob(1000, false)
+	put(t, s, br1, d1)
+	put(t, s, br2, d2)
+
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		get(t, s, br1, d1)
+	}()
+	<-reading
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		get(t, s, br2, d2)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("expected a get not to wait for another read")
+	}
+	close(release)
+	<-read
+	<-done
+}
@@ -0,0 +1,101 @@
+package diskstorage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage/ztream"
+)
+
+// wipeFile lists the entries of removed blobs that are to be wiped, one
+// "<pack id> <name>" per line. The removal from the index is only finished
+// once they are wiped, else reconcile would add entries of the current pack
+// back to the index if we fail or crash before.
+const wipeFile = "wipe.log"
+
+// logWipes durably adds the entries names of each pack to the wipe file. The
+// caller is expected to hold the lock.
+func (s *Storage) logWipes(packs []uint32, names map[uint32][]string) error {
+	path := filepath.Join(s.dir, wipeFile)
+	_, err := os.Stat(path)
+	created := os.IsNotExist(err)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, id := range packs {
+		for _, name := range names[id] {
+			fmt.Fprintf(w, "%d %s\n", id, name)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if created {
+		return syncDir(s.dir)
+	}
+	return nil
+}
+
+// finishWipes wipes the entries in the wipe file and removes it. Entries of
+// blobs put again since are left for compaction, as they can not be told
+// apart by name. The caller is expected to hold the lock.
+func (s *Storage) finishWipes() error {
+	path := filepath.Join(s.dir, wipeFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var packs []uint32
+	names := map[uint32][]string{}
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var id uint32
+		var name string
+		if n, err := fmt.Sscanf(string(line), "%d %s\n", &id, &name); err != nil || n != 2 {
+			// a torn write at the end of the file
+			continue
+		}
+		br, ok := blob.ParseString(name)
+		if !ok || s.packs[id] == nil {
+			// the pack has been compacted since
+			continue
+		}
+		if _, ok, err := s.lookup(br); ok || err != nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := names[id]; !ok {
+			packs = append(packs, id)
+		}
+		names[id] = append(names[id], name)
+	}
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+	for _, id := range packs {
+		for _, err := range s.packs[id].WipeMany(names[id]) {
+			if err != nil && err != ztream.ErrNoEntry {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
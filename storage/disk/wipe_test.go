@@ -0,0 +1,68 @@
+package diskstorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vron/compono/storage/ztream"
+)
+
+// TestRemoveInterrupted checks that a blob removed from the index but not yet
+// wiped when we crash is wiped when opened, and not added back by reconcile.
+func TestRemoveInterrupted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	br1, d1 := testBlob(1000, false)
+	br2, d2 := testBlob(1000, false)
+	put(t, s, br1, d1)
+	put(t, s, br2, d2)
+
+	// RemoveBlobs up to the wipe
+	s.m.Lock()
+	l, _, _ := s.lookup(br1)
+	if err := s.logWipes([]uint32{l.pack}, map[uint32][]string{l.pack: {br1.String()}}); err != nil {
+		t.Error(err)
+	}
+	s.index.remove(br1)
+	s.index.sync()
+	s.m.Unlock()
+	s.Close()
+
+	s, err = Open(dir, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if _, ok, _ := s.lookup(br1); ok {
+		t.Error("expected the removed blob not to be added back")
+	}
+	get(t, s, br2, d2)
+	s.Close()
+	if _, err := os.Stat(filepath.Join(dir, wipeFile)); !os.IsNotExist(err) {
+		t.Error("expected the wipes to be finished", err)
+	}
+	p, _ := ztream.Open(filepath.Join(dir, "pack-00000000.zip"), tOpt.Ztream)
+	c, _ := p.Contents()
+	p.Close()
+	if len(c) != 1 || c[0].Name != br2.String() {
+		t.Error("expected the removed blob to be wiped", c)
+	}
+
+	// a blob put again is not wiped by an old removal
+	s, _ = Open(dir, tOpt)
+	put(t, s, br1, d1)
+	s.m.Lock()
+	s.logWipes([]uint32{s.current}, map[uint32][]string{s.current: {br1.String()}})
+	s.m.Unlock()
+	s.Close()
+	s, _ = Open(dir, tOpt)
+	defer s.Close()
+	get(t, s, br1, d1)
+}
@@ -0,0 +1,42 @@
+package gc
+
+import (
+	"encoding/binary"
+
+	"github.com/vron/compono/blob"
+)
+
+// bloomHashes is the number of bits set for each ref.
+const bloomHashes = 7
+
+// bloom is a bloom filter of refs. Since refs are cryptographic hashes the
+// bit positions are taken directly from the digest.
+type bloom []uint64
+
+func newBloom(size int) bloom {
+	return make(bloom, (size+7)/8)
+}
+
+func (b bloom) positions(br blob.Ref, fn func(word int, bit uint64)) {
+	d := br.Digest()
+	h1 := binary.LittleEndian.Uint64(d[0:])
+	h2 := binary.LittleEndian.Uint64(d[8:]) | 1
+	if br.Schema() {
+		h1 ^= 1
+	}
+	n := uint64(len(b)) * 64
+	for i := uint64(0); i < bloomHashes; i++ {
+		p := (h1 + i*h2) % n
+		fn(int(p/64), 1<<(p%64))
+	}
+}
+
+func (b bloom) add(br blob.Ref) {
+	b.positions(br, func(w int, bit uint64) { b[w] |= bit })
+}
+
+func (b bloom) has(br blob.Ref) bool {
+	has := true
+	b.positions(br, func(w int, bit uint64) { has = has && b[w]&bit != 0 })
+	return has
+}
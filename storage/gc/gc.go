@@ -0,0 +1,330 @@
+// Package gc removes the blobs no longer reachable from a set of roots.
+//
+// Collection marks every blob reachable from the roots, by following the refs
+// found in the JSON of schema blobs, and then sweeps the storage removing the
+// blobs not marked. To work with tens of millions of blobs the data blobs are
+// marked in a bloom filter rather than kept in memory; a false positive only
+// means an unreachable blob is kept until a later collection.
+//
+// Since blobs may be uploaded before anything referring to them, an
+// unreachable blob is only removed once it has been found unreachable for a
+// grace period, and, if the storage is a PutTimer, also put longer than the
+// grace period ago. Other storages do not tell when a blob already stored is
+// put again, so such a blob may be removed sooner than the grace period after
+// that put. The progress of the mark phase and the time each unreachable
+// blob was first found are kept in a state directory, such that an
+// interrupted collection can be resumed.
+package gc
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+)
+
+const (
+	markLogName    = "mark.log"
+	candidatesName = "unreachable"
+
+	// batchSize is the number of blobs read or removed at once.
+	batchSize = 100
+)
+
+// Options to configure a collection.
+type Options struct {
+	// StateDir is the directory the state of the collection is kept in.
+	StateDir string
+	// GracePeriod is how long a blob must have been unreachable, and put
+	// before if the storage is a PutTimer, before it is removed.
+	GracePeriod time.Duration
+	// FilterSize is the size in bytes of the filter of marked blobs, used
+	// when a new collection is started. It should be at least 2 bytes per
+	// blob in the storage.
+	FilterSize int
+	// DryRun finds the unreachable blobs without removing them or updating
+	// the time they were first found unreachable.
+	DryRun bool
+	// Unreachable, if set, is called for every unreachable blob found, with
+	// the time it was first found unreachable or last put if later.
+	Unreachable func(sr blob.SizedRef, firstSeen time.Time)
+}
+
+// A PutTimer is a storage that knows when each blob was last put, such as
+// the disk storage. PutTime returns the zero time if it is not known.
+type PutTimer interface {
+	PutTime(ctx context.Context, br blob.Ref) (time.Time, error)
+}
+
+var DefaultOptions = Options{
+	GracePeriod: 24 * time.Hour,
+	FilterSize:  64 << 20,
+}
+
+// Stats summarizes a collection.
+type Stats struct {
+	Marked          int   // reachable blobs marked
+	Unreachable     int   // unreachable blobs found
+	UnreachableSize int64 // the total size of the unreachable blobs
+	Removed         int   // unreachable blobs removed
+}
+
+// Collect removes the blobs in s that are not reachable from roots and have
+// been found unreachable for longer than the grace period. If a previous
+// collection with the same roots was interrupted it is resumed.
+func Collect(ctx context.Context, s storage.Storage, roots []blob.Ref, opt Options) (st Stats, err error) {
+	if opt.StateDir == "" {
+		return st, errors.New("gc: a StateDir is needed")
+	}
+	if opt.GracePeriod <= 0 {
+		opt.GracePeriod = DefaultOptions.GracePeriod
+	}
+	if opt.FilterSize <= 0 {
+		opt.FilterSize = DefaultOptions.FilterSize
+	}
+	if err := os.MkdirAll(opt.StateDir, 0755); err != nil {
+		return st, err
+	}
+
+	l, resumed, err := openMarkLog(filepath.Join(opt.StateDir, markLogName), opt.FilterSize, rootsKey(roots))
+	if err != nil {
+		return st, err
+	}
+	defer func() {
+		if e := l.close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	if !resumed {
+		for _, br := range roots {
+			if err := l.mark(br); err != nil {
+				return st, err
+			}
+		}
+	}
+	if err := mark(ctx, s, l); err != nil {
+		return st, err
+	}
+	st.Marked = l.marked
+
+	if err := sweep(ctx, s, l.filter, opt, &st); err != nil {
+		return st, err
+	}
+	// the collection is complete, the next one starts over.
+	return st, os.Remove(filepath.Join(opt.StateDir, markLogName))
+}
+
+// rootsKey identifies a set of roots, to only resume collections with the
+// same roots.
+func rootsKey(roots []blob.Ref) string {
+	sorted := append([]blob.Ref(nil), roots...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Less(sorted[j]) })
+	h := blob.NewHash()
+	for _, br := range sorted {
+		io.WriteString(h, br.String())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// mark marks everything reachable from the frontier of l.
+func mark(ctx context.Context, s storage.Storage, l *markLog) error {
+	for len(l.frontier) > 0 {
+		n := len(l.frontier)
+		if n > batchSize {
+			n = batchSize
+		}
+		batch := append([]blob.Ref(nil), l.frontier[len(l.frontier)-n:]...)
+		l.frontier = l.frontier[:len(l.frontier)-n]
+
+		datas, err := readBlobs(ctx, s, batch)
+		if err != nil {
+			return err
+		}
+		for _, br := range batch {
+			// missing schema blobs have no refs to follow
+			if d, ok := datas[br]; ok {
+				for _, ref := range refs(d) {
+					if err := l.mark(ref); err != nil {
+						return err
+					}
+				}
+			}
+			if err := l.done(br); err != nil {
+				return err
+			}
+		}
+		if err := l.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBlobs returns the contents of the blobs in s, missing blobs are left out.
+func readBlobs(ctx context.Context, s storage.Storage, blobs []blob.Ref) (map[blob.Ref][]byte, error) {
+	var found []blob.SizedRef
+	err := s.StatBlobs(ctx, blobs, func(sr blob.SizedRef) error {
+		found = append(found, sr)
+		return nil
+	})
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+	refs := make([]blob.Ref, len(found))
+	for i, sr := range found {
+		refs[i] = sr.Ref
+	}
+	rc, _, err := s.GetBlobs(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	datas := make(map[blob.Ref][]byte, len(found))
+	for _, sr := range found {
+		d, err := storage.ReadVerified(sr.Ref, io.LimitReader(rc, int64(sr.Size())))
+		if err != nil {
+			return nil, fmt.Errorf("gc: reading %v: %v", sr.Ref, err)
+		}
+		datas[sr.Ref] = d
+	}
+	return datas, nil
+}
+
+// refs returns the refs found as strings anywhere in the JSON of a schema
+// blob. Invalid JSON has no refs.
+func refs(d []byte) []blob.Ref {
+	var v interface{}
+	if json.Unmarshal(d, &v) != nil {
+		return nil
+	}
+	var found []blob.Ref
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			if br, ok := blob.ParseString(v); ok {
+				found = append(found, br)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+	return found
+}
+
+// sweep enumerates s and removes the blobs not marked in filter that have
+// been unreachable, and put, for longer than the grace period. The others are
+// written to a new candidates file.
+func sweep(ctx context.Context, s storage.Storage, filter bloom, opt Options, st *Stats) error {
+	path := filepath.Join(opt.StateDir, candidatesName)
+	old, err := openCandidates(path)
+	if err != nil {
+		return err
+	}
+	defer old.close()
+
+	var w *bufio.Writer
+	var f *os.File
+	if !opt.DryRun {
+		if f, err = os.Create(path + ".tmp"); err != nil {
+			return err
+		}
+		defer f.Close()
+		w = bufio.NewWriter(f)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan blob.SizedRef, 256)
+	errc := make(chan error, 1)
+	go func() { errc <- s.EnumerateBlobs(ctx, ch, storage.Filter{}) }()
+	defer func() {
+		cancel()
+		for range ch {
+		}
+	}()
+
+	now := time.Now()
+	var remove []blob.Ref
+	for sr := range ch {
+		if filter.has(sr.Ref) {
+			continue
+		}
+		st.Unreachable++
+		st.UnreachableSize += int64(sr.Size())
+		first, ok := old.firstSeen(sr.Ref)
+		if !ok {
+			first = now
+		}
+		if pt, ok := s.(PutTimer); ok && now.Sub(first) >= opt.GracePeriod {
+			// a blob put again counts as first seen then
+			put, err := pt.PutTime(ctx, sr.Ref)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if put.After(first) {
+				first = put
+			}
+		}
+		if opt.Unreachable != nil {
+			opt.Unreachable(sr, first)
+		}
+		if opt.DryRun {
+			continue
+		}
+		if now.Sub(first) < opt.GracePeriod {
+			if _, err := fmt.Fprintf(w, "%d %s\n", first.Unix(), sr.Ref); err != nil {
+				return err
+			}
+			continue
+		}
+		remove = append(remove, sr.Ref)
+		if len(remove) == batchSize {
+			if err := s.RemoveBlobs(ctx, remove); err != nil {
+				return err
+			}
+			st.Removed += len(remove)
+			remove = remove[:0]
+		}
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	if opt.DryRun {
+		return nil
+	}
+	if len(remove) > 0 {
+		if err := s.RemoveBlobs(ctx, remove); err != nil {
+			return err
+		}
+		st.Removed += len(remove)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
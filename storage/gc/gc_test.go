@@ -0,0 +1,232 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/memory"
+	"github.com/vron/compono/storage/storagetest"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func schemaBlob(s string) (blob.Ref, []byte) {
+	h := blob.NewHash()
+	h.Write([]byte(s))
+	return blob.RefFromHash(h, true), []byte(s)
+}
+
+// tree stores a root referring to a data blob and a chain of schema blobs
+// each referring to another data blob, and a blob that is not referred to.
+func tree(t *testing.T, s storage.Storage, depth int) (root, garbage blob.Ref, live []blob.Ref) {
+	var next blob.Ref
+	for i := 0; i < depth; i++ {
+		dr, dd := storagetest.Blob(fmt.Sprint("data", i), false)
+		storagetest.Put(t, s, dr, dd)
+		var sd []byte
+		if next.Valid() {
+			next, sd = schemaBlob(fmt.Sprintf(`{"type": "dir", "parts": [{"ref": %q}], "next": %q}`, dr, next))
+		} else {
+			next, sd = schemaBlob(fmt.Sprintf(`{"type": "file", "parts": [{"ref": %q}]}`, dr))
+		}
+		storagetest.Put(t, s, next, sd)
+		live = append(live, dr, next)
+	}
+	garbage, gd := storagetest.Blob("garbage", false)
+	storagetest.Put(t, s, garbage, gd)
+	return next, garbage, live
+}
+
+func exists(t *testing.T, s storage.Storage, br blob.Ref) bool {
+	found := false
+	err := s.StatBlobs(context.Background(), []blob.Ref{br}, func(blob.SizedRef) error {
+		found = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestCollect(t *testing.T) {
+	s := memory.New()
+	defer s.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	root, garbage, live := tree(t, s, 3)
+	opt := Options{StateDir: dir, GracePeriod: time.Nanosecond}
+
+	// the first collection only records the garbage as unreachable
+	st, err := Collect(context.Background(), s, []blob.Ref{root}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Marked != len(live) || st.Unreachable != 1 || st.Removed != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	if !exists(t, s, garbage) {
+		t.Error("garbage removed before the grace period")
+	}
+
+	st, err = Collect(context.Background(), s, []blob.Ref{root}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Unreachable != 1 || st.Removed != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	if exists(t, s, garbage) {
+		t.Error("garbage not removed")
+	}
+	for _, br := range live {
+		if !exists(t, s, br) {
+			t.Error("reachable blob removed", br)
+		}
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	s := memory.New()
+	defer s.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	root, garbage, _ := tree(t, s, 1)
+	opt := Options{StateDir: dir, GracePeriod: time.Hour}
+	for i := 0; i < 2; i++ {
+		if _, err := Collect(context.Background(), s, []blob.Ref{root}, opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !exists(t, s, garbage) {
+		t.Error("garbage removed before the grace period")
+	}
+}
+
+// putTimes is a storage where the blobs in again are put again whenever
+// their put time is asked for.
+type putTimes struct {
+	storage.Storage
+	again map[blob.Ref]bool
+}
+
+func (p putTimes) PutTime(ctx context.Context, br blob.Ref) (time.Time, error) {
+	if p.again[br] {
+		return time.Now(), nil
+	}
+	return time.Time{}, nil
+}
+
+func TestPutTime(t *testing.T) {
+	s := memory.New()
+	defer s.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	root, garbage, _ := tree(t, s, 1)
+	opt := Options{StateDir: dir, GracePeriod: time.Nanosecond}
+	p := putTimes{Storage: s, again: map[blob.Ref]bool{garbage: true}}
+	for i := 0; i < 3; i++ {
+		if _, err := Collect(context.Background(), p, []blob.Ref{root}, opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !exists(t, s, garbage) {
+		t.Error("garbage removed before the grace period since it was put")
+	}
+	p.again[garbage] = false
+	if _, err := Collect(context.Background(), p, []blob.Ref{root}, opt); err != nil {
+		t.Fatal(err)
+	}
+	if exists(t, s, garbage) {
+		t.Error("garbage not removed")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	s := memory.New()
+	defer s.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	root, garbage, _ := tree(t, s, 2)
+	var found []blob.Ref
+	opt := Options{StateDir: dir, GracePeriod: time.Nanosecond, DryRun: true, Unreachable: func(sr blob.SizedRef, _ time.Time) {
+		found = append(found, sr.Ref)
+	}}
+	for i := 0; i < 2; i++ {
+		if _, err := Collect(context.Background(), s, []blob.Ref{root}, opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(found) != 2 || found[0] != garbage || found[1] != garbage {
+		t.Error("unexpected unreachable blobs reported", found)
+	}
+	if !exists(t, s, garbage) {
+		t.Error("dry run removed garbage")
+	}
+}
+
+// failing fails reading blobs after a number of reads.
+type failing struct {
+	storage.Storage
+	reads int
+}
+
+func (f *failing) GetBlobs(ctx context.Context, blobs []blob.Ref) (io.ReadCloser, uint32, error) {
+	if f.reads == 0 {
+		return nil, 0, errors.New("failing read")
+	}
+	f.reads--
+	return f.Storage.GetBlobs(ctx, blobs)
+}
+
+func TestResume(t *testing.T) {
+	s := memory.New()
+	defer s.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	root, garbage, live := tree(t, s, 5)
+	opt := Options{StateDir: dir, GracePeriod: time.Nanosecond}
+	if _, err := Collect(context.Background(), &failing{Storage: s, reads: 2}, []blob.Ref{root}, opt); err == nil {
+		t.Fatal("expected the collection to fail")
+	}
+
+	// resuming only reads the schema blobs not yet done
+	f := &failing{Storage: s, reads: 3}
+	st, err := Collect(context.Background(), f, []blob.Ref{root}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.reads != 0 || st.Marked != len(live) || st.Unreachable != 1 {
+		t.Errorf("unexpected stats %+v, %d reads left", st, f.reads)
+	}
+	if _, err := Collect(context.Background(), s, []blob.Ref{root}, opt); err != nil {
+		t.Fatal(err)
+	}
+	if exists(t, s, garbage) {
+		t.Error("garbage not removed")
+	}
+	for _, br := range live {
+		if !exists(t, s, br) {
+			t.Error("reachable blob removed", br)
+		}
+	}
+}
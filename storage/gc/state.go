@@ -0,0 +1,211 @@
+package gc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vron/compono/blob"
+)
+
+// markLog persists the progress of the mark phase. It starts with the size of
+// the filter and a key identifying the roots, followed by a line "+ref" for every marked ref and "=ref" for
+// every schema blob whose references have all been marked. The schema blobs
+// marked but not done are the frontier to continue from when resuming.
+type markLog struct {
+	f      *os.File
+	w      *bufio.Writer
+	filter bloom
+	// schema is all marked schema blobs, and if they are done.
+	schema   map[blob.Ref]bool
+	frontier []blob.Ref
+	marked   int
+}
+
+// openMarkLog opens the log at path, or creates it with a filter of
+// filterSize bytes if it does not exist or is for other roots than key. A
+// torn last line is truncated.
+func openMarkLog(path string, filterSize int, key string) (l *markLog, resumed bool, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	l = &markLog{f: f, schema: make(map[blob.Ref]bool)}
+	if err := l.replay(filterSize, key); err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	resumed = l.marked > 0
+	for br, done := range l.schema {
+		if !done {
+			l.frontier = append(l.frontier, br)
+		}
+	}
+	return l, resumed, nil
+}
+
+func (l *markLog) replay(filterSize int, key string) error {
+	r := bufio.NewReader(l.f)
+	var off int64
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var size int
+	var k string
+	if _, e := fmt.Sscanf(line, "filter %d %s\n", &size, &k); err == nil && e == nil && k == key && size > 0 {
+		filterSize = size
+		off += int64(len(line))
+	}
+	l.filter = newBloom(filterSize)
+
+	for off > 0 {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(line) < 2 || (line[0] != '+' && line[0] != '=') {
+			break
+		}
+		br, ok := blob.ParseString(line[1 : len(line)-1])
+		if !ok {
+			break
+		}
+		off += int64(len(line))
+		if line[0] == '=' {
+			l.schema[br] = true
+			continue
+		}
+		l.marked++
+		l.filter.add(br)
+		if br.Schema() && !l.schema[br] {
+			l.schema[br] = false
+		}
+	}
+
+	if err := l.f.Truncate(off); err != nil {
+		return err
+	}
+	if _, err := l.f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	l.w = bufio.NewWriter(l.f)
+	if off == 0 {
+		_, err := fmt.Fprintf(l.w, "filter %d %s\n", filterSize, key)
+		return err
+	}
+	return nil
+}
+
+// mark marks br as reachable, adding schema blobs to the frontier.
+func (l *markLog) mark(br blob.Ref) error {
+	if br.Schema() {
+		if _, ok := l.schema[br]; ok {
+			return nil
+		}
+		l.schema[br] = false
+		l.frontier = append(l.frontier, br)
+	} else if l.filter.has(br) {
+		// possibly a false positive, but then the blob is kept in any
+		// case since the filter is what the sweep uses.
+		return nil
+	}
+	l.filter.add(br)
+	l.marked++
+	_, err := fmt.Fprintf(l.w, "+%s\n", br)
+	return err
+}
+
+// done records that all references of the schema blob br have been marked.
+func (l *markLog) done(br blob.Ref) error {
+	l.schema[br] = true
+	_, err := fmt.Fprintf(l.w, "=%s\n", br)
+	return err
+}
+
+func (l *markLog) flush() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *markLog) close() error {
+	err := l.w.Flush()
+	if e := l.f.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// candidates reads the file of unreachable blobs found by earlier
+// collections, with the time they were first found. The file has a line
+// "<unix time> <ref>" for each blob, sorted by ref.
+type candidates struct {
+	f   *os.File
+	r   *bufio.Reader
+	cur blob.Ref
+	t   time.Time
+	ok  bool
+}
+
+func openCandidates(path string) (*candidates, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &candidates{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &candidates{f: f, r: bufio.NewReader(f)}
+	c.next()
+	return c, nil
+}
+
+// next advances to the next candidate, an invalid line ends the file.
+func (c *candidates) next() {
+	c.ok = false
+	if c.r == nil {
+		return
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return
+	}
+	sec, err := strconv.ParseInt(line[:i], 10, 64)
+	if err != nil {
+		return
+	}
+	c.cur, c.ok = blob.ParseString(strings.TrimSuffix(line[i+1:], "\n"))
+	c.t = time.Unix(sec, 0)
+}
+
+// firstSeen returns when br was first found unreachable, if it was. It must
+// be called with refs in increasing order.
+func (c *candidates) firstSeen(br blob.Ref) (time.Time, bool) {
+	for c.ok && c.cur.Less(br) {
+		c.next()
+	}
+	if c.ok && c.cur == br {
+		return c.t, true
+	}
+	return time.Time{}, false
+}
+
+func (c *candidates) close() error {
+	if c.f == nil {
+		return nil
+	}
+	return c.f.Close()
+}
@@ -14,7 +14,16 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package interface
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/vron/compono/blob"
+)
 
 // Fetcher is the interface for fetching blobs.
 type Fetcher interface {
@@ -104,7 +113,6 @@ type Generationer interface {
 	ResetStorageGeneration() error
 }
 
-
 // stretch cases to think about
 /*
 
@@ -116,18 +124,19 @@ type Generationer interface {
 
 // search is very important
 
-
 // can we do compression client side? of schema? - e.g possibility to seperate the storages?
 
-
 // Storage is the interface that must be implemented by a blobserver
 // storage type.
 type Storage interface {
 	Close() error
 
+	// GetBlobs returns the contents of the blobs, concatenated in the
+	// order given, and their total size. If any of the blobs is
+	// missing os.ErrNotExist is returned.
 	GetBlobs(context.Context, []blob.Ref) (blob io.ReadCloser, size uint32, err error)
 
-	PutBlob(ctx context.Context, br, after, blob.Ref, source io.Reader) (blob.SizedRef, error)
+	PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error)
 
 	StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error
 
@@ -135,7 +144,6 @@ type Storage interface {
 		dest chan<- blob.SizedRef,
 		filter Filter) error
 
-
 	RemoveBlobs(ctx context.Context, blobs []blob.Ref) error
 }
 
@@ -147,6 +155,8 @@ type BlobReceiver interface {
 	PutBlob()
 }
 
+// ErrPending is returned by PutBlob together with a valid SizedRef when the
+// blob has been accepted but not yet synced to durable storage.
 var ErrPending = errors.New("the blob is pending sync to durable storage")
 
 type Filter struct {
@@ -154,5 +164,16 @@ type Filter struct {
 	After string
 
 	ExcludeSchemaBlobs bool
-	ExcludeDataBlobs bool
-}
\ No newline at end of file
+	ExcludeDataBlobs   bool
+}
+
+// Match reports whether r passes the filter.
+func (f Filter) Match(r blob.Ref) bool {
+	if r.Schema() && f.ExcludeSchemaBlobs {
+		return false
+	}
+	if !r.Schema() && f.ExcludeDataBlobs {
+		return false
+	}
+	return f.After == "" || r.String() > f.After
+}
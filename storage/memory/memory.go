@@ -0,0 +1,201 @@
+// Package memory implements a storage.Storage that keeps all blobs in memory.
+// It is intended for tests and ephemeral servers, and serves as the reference
+// for the semantics of the storage.Storage interface.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+)
+
+var ErrClosed = errors.New("memory: the storage is closed")
+
+// Storage is an in memory storage.Storage, safe for concurrent use.
+type Storage struct {
+	m sync.RWMutex // protects all fields
+
+	blobs  map[blob.Ref][]byte
+	sorted []blob.Ref // sorted refs of blobs, nil if it must be recomputed
+	closed bool
+
+	genTime   time.Time
+	genRandom string
+}
+
+var _ storage.Storage = (*Storage)(nil)
+var _ storage.Generationer = (*Storage)(nil)
+
+// New returns an empty Storage.
+func New() *Storage {
+	return &Storage{blobs: make(map[blob.Ref][]byte)}
+}
+
+func (s *Storage) GetBlobs(ctx context.Context, blobs []blob.Ref) (io.ReadCloser, uint32, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.closed {
+		return nil, 0, ErrClosed
+	}
+
+	var buf bytes.Buffer
+	for _, br := range blobs {
+		d, ok := s.blobs[br]
+		if !ok {
+			return nil, 0, os.ErrNotExist
+		}
+		buf.Write(d)
+	}
+	return ioutil.NopCloser(&buf), uint32(buf.Len()), nil
+}
+
+func (s *Storage) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	data, err := storage.ReadVerified(br, source)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return blob.SizedRef{}, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return blob.SizedRef{}, ErrClosed
+	}
+	if _, ok := s.blobs[br]; !ok {
+		s.blobs[br] = data
+		s.sorted = nil
+	}
+	return br.Sized(uint32(len(data))), nil
+}
+
+func (s *Storage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	s.m.RLock()
+	if s.closed {
+		s.m.RUnlock()
+		return ErrClosed
+	}
+	found := make([]blob.SizedRef, 0, len(blobs))
+	for _, br := range blobs {
+		if d, ok := s.blobs[br]; ok {
+			found = append(found, br.Sized(uint32(len(d))))
+		}
+	}
+	s.m.RUnlock()
+
+	for _, sr := range found {
+		if err := fn(sr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, filter storage.Filter) error {
+	defer close(dest)
+
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return ErrClosed
+	}
+	if s.sorted == nil {
+		s.sorted = make([]blob.Ref, 0, len(s.blobs))
+		for br := range s.blobs {
+			s.sorted = append(s.sorted, br)
+		}
+		sort.Slice(s.sorted, func(i, j int) bool { return s.sorted[i].Less(s.sorted[j]) })
+	}
+	// the sorted slice is never modified, only replaced, so it is safe to
+	// keep using it after unlocking.
+	sorted := s.sorted
+	sizes := make([]uint32, 0, len(sorted))
+	start := sort.Search(len(sorted), func(i int) bool { return sorted[i].String() > filter.After })
+	sorted = sorted[start:]
+	for _, br := range sorted {
+		sizes = append(sizes, uint32(len(s.blobs[br])))
+	}
+	s.m.Unlock()
+
+	for i, br := range sorted {
+		if !filter.Match(br) {
+			continue
+		}
+		select {
+		case dest <- br.Sized(sizes[i]):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *Storage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for _, br := range blobs {
+		if _, ok := s.blobs[br]; ok {
+			delete(s.blobs, br)
+			s.sorted = nil
+		}
+	}
+	return nil
+}
+
+// Close releases all the blobs held.
+func (s *Storage) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+	s.blobs = nil
+	s.sorted = nil
+	return nil
+}
+
+// StorageGeneration implements storage.Generationer.
+func (s *Storage) StorageGeneration() (initTime time.Time, random string, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.genRandom == "" {
+		if err := s.resetGeneration(); err != nil {
+			return time.Time{}, "", err
+		}
+	}
+	return s.genTime, s.genRandom, nil
+}
+
+// ResetStorageGeneration implements storage.Generationer.
+func (s *Storage) ResetStorageGeneration() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.resetGeneration()
+}
+
+// the caller is expected to hold the lock.
+func (s *Storage) resetGeneration() error {
+	var b [20]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	s.genTime = time.Now()
+	s.genRandom = hex.EncodeToString(b[:])
+	return nil
+}
@@ -0,0 +1,86 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/storagetest"
+)
+
+func testBlob(s string, schema bool) (blob.Ref, []byte) {
+	h := blob.NewHash()
+	h.Write([]byte(s))
+	return blob.RefFromHash(h, schema), []byte(s)
+}
+
+func TestConcurrent(t *testing.T) {
+	s := New()
+	defer s.Close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				br, d := testBlob(string(rune('a'+i))+string(rune('a'+j)), j%2 == 0)
+				if _, err := s.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(d)); err != nil {
+					t.Error(err)
+				}
+				rc, _, err := s.GetBlobs(ctx, []blob.Ref{br})
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				b, _ := ioutil.ReadAll(rc)
+				if !bytes.Equal(b, d) {
+					t.Error("read data not equal to stored")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ch := make(chan blob.SizedRef)
+	go s.EnumerateBlobs(ctx, ch, storage.Filter{})
+	n := 0
+	var last blob.Ref
+	for sr := range ch {
+		if n > 0 && !last.Less(sr.Ref) {
+			t.Error("enumeration not sorted")
+		}
+		last = sr.Ref
+		n++
+	}
+	if n != 8*50 {
+		t.Error("expected all blobs to be enumerated", n)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	s := New()
+	defer s.Close()
+	ctx := context.Background()
+
+	br, d := testBlob("data", false)
+	s.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(d))
+	if err := s.RemoveBlobs(ctx, []blob.Ref{br, br}); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := s.GetBlobs(ctx, []blob.Ref{br}); !os.IsNotExist(err) {
+		t.Error("expected not exist, got:", err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (storage.Storage, func()) {
+		return New(), func() {}
+	})
+}
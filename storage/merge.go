@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/vron/compono/blob"
+)
+
+// MergeEnumerate enumerates the blobs of all srcs matching filter into dest,
+// merged in sorted order and without duplicates. Like EnumerateBlobs it always
+// closes dest.
+func MergeEnumerate(ctx context.Context, dest chan<- blob.SizedRef, filter Filter, srcs ...Storage) error {
+	defer close(dest)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type source struct {
+		ch   chan blob.SizedRef
+		errc chan error
+		cur  blob.SizedRef
+		ok   bool
+	}
+	sources := make([]*source, len(srcs))
+	for i, s := range srcs {
+		src := &source{ch: make(chan blob.SizedRef, 64), errc: make(chan error, 1)}
+		sources[i] = src
+		go func(s Storage) { src.errc <- s.EnumerateBlobs(ctx, src.ch, filter) }(s)
+	}
+	// on return all sources must be drained for their goroutines to exit
+	defer func() {
+		cancel()
+		for _, src := range sources {
+			for range src.ch {
+			}
+		}
+	}()
+
+	// advance reads the next ref of src, returning any error from the source
+	// once it is exhausted.
+	advance := func(src *source) error {
+		src.cur, src.ok = <-src.ch
+		if !src.ok {
+			return <-src.errc
+		}
+		return nil
+	}
+	for _, src := range sources {
+		if err := advance(src); err != nil {
+			return err
+		}
+	}
+
+	var last blob.Ref
+	sent := false
+	for {
+		var min *source
+		for _, src := range sources {
+			if src.ok && (min == nil || src.cur.Less(min.cur.Ref)) {
+				min = src
+			}
+		}
+		if min == nil {
+			return nil
+		}
+		sr := min.cur
+		if err := advance(min); err != nil {
+			return err
+		}
+		if sent && sr.Ref == last {
+			continue
+		}
+		select {
+		case dest <- sr:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		last, sent = sr.Ref, true
+	}
+}
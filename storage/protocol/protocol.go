@@ -0,0 +1,76 @@
+// Package protocol defines the messages and paths of the HTTP blob server
+// protocol, shared by the server and the remote client.
+//
+// The endpoints are:
+//
+//	GET  /blobs?ref=R1&ref=R2  the concatenated contents of the blobs, with
+//	                           their total size in the HeaderSize header
+//	PUT  /blob/R?after=A       store the body as the blob R, returns a SizedRef
+//	                           with status 202 if it is not yet durable
+//	POST /stat                 a JSON list of refs, returns the []SizedRef found
+//	GET  /enumerate?after=A&limit=N&noschema=1&nodata=1
+//	                           returns an EnumerateResponse
+//	POST /remove               a JSON list of refs to remove
+//	GET  /generation           returns a Generation
+//	POST /generation/reset     resets the generation
+//
+// Errors are returned with a non 2xx status code and an Error as body.
+//
+// A server may require credentials, given as a token in the header
+// "Authorization: Bearer <token>". Requests without a valid token get status
+// 401, and operations not allowed for the token status 403.
+package protocol
+
+import (
+	"time"
+
+	"github.com/vron/compono/blob"
+)
+
+const (
+	PathBlobs           = "/blobs"
+	PathBlob            = "/blob/"
+	PathStat            = "/stat"
+	PathEnumerate       = "/enumerate"
+	PathRemove          = "/remove"
+	PathGeneration      = "/generation"
+	PathGenerationReset = "/generation/reset"
+
+	// AuthScheme prefixes the token in the Authorization header.
+	AuthScheme = "Bearer "
+	// HeaderSize is the header giving the total size of the blobs returned
+	// by a get request, which is sent even if Content-Length is not.
+	HeaderSize = "Blobs-Size"
+
+	// MaxEnumerateLimit is the largest number of refs returned by a single
+	// enumerate request.
+	MaxEnumerateLimit = 10000
+	// MaxRefs is the largest number of refs accepted in a single get, stat
+	// or remove request.
+	MaxRefs = 1000
+)
+
+// SizedRef is the wire format of a blob.SizedRef.
+type SizedRef struct {
+	Ref  blob.Ref `json:"ref"`
+	Size uint32   `json:"size"`
+}
+
+// EnumerateResponse is returned by the enumerate endpoint. If Continue is
+// non-empty there may be more refs and it should be used as after in the next
+// request.
+type EnumerateResponse struct {
+	Blobs    []SizedRef `json:"blobs"`
+	Continue string     `json:"continue,omitempty"`
+}
+
+// Generation is returned by the generation endpoint.
+type Generation struct {
+	InitTime time.Time `json:"initTime"`
+	Random   string    `json:"random"`
+}
+
+// Error is the body of all error responses.
+type Error struct {
+	Error string `json:"error"`
+}
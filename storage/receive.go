@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/vron/compono/blob"
+)
+
+var (
+	ErrTooLarge     = errors.New("storage: blob is larger than blob.MaxSize")
+	ErrHashMismatch = errors.New("storage: blob contents does not match its ref")
+)
+
+// ReadVerified reads all of source, ensuring that it is no larger than
+// blob.MaxSize and that it hashes to br.
+func ReadVerified(br blob.Ref, source io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	h := br.Hash()
+	n, err := io.Copy(io.MultiWriter(&buf, h), io.LimitReader(source, blob.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > blob.MaxSize {
+		return nil, ErrTooLarge
+	}
+	if blob.RefFromHash(h, br.Schema()) != br {
+		return nil, ErrHashMismatch
+	}
+	return buf.Bytes(), nil
+}
+
+// VerifyingReader returns a reader that reads from source but returns
+// ErrHashMismatch instead of io.EOF if the data read does not hash to br,
+// and ErrTooLarge if more than blob.MaxSize bytes are read. It allows a
+// blob to be streamed to a Storage while being verified.
+func VerifyingReader(br blob.Ref, source io.Reader) io.Reader {
+	return &verifyingReader{br: br, h: br.Hash(), r: io.LimitReader(source, blob.MaxSize+1)}
+}
+
+type verifyingReader struct {
+	br  blob.Ref
+	h   hash.Hash
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	if vr.err != nil {
+		return 0, vr.err
+	}
+	n, err := vr.r.Read(p)
+	vr.h.Write(p[:n])
+	vr.n += int64(n)
+	if vr.n > blob.MaxSize {
+		vr.err = ErrTooLarge
+		return n, vr.err
+	}
+	if err == io.EOF && blob.RefFromHash(vr.h, vr.br.Schema()) != vr.br {
+		err = ErrHashMismatch
+	}
+	vr.err = err
+	return n, err
+}
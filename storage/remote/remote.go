@@ -0,0 +1,265 @@
+// Package remote implements a storage.Storage that talks to a blob server
+// over HTTP, as specified by the protocol package.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/protocol"
+)
+
+var ErrTooManyRefs = errors.New("remote: too many refs requested at once")
+
+// A Client is a storage.Storage backed by a remote blob server.
+type Client struct {
+	base   string
+	client *http.Client
+	token  string
+}
+
+var _ storage.Storage = (*Client)(nil)
+var _ storage.Generationer = (*Client)(nil)
+
+// New returns a Client for the blob server at base, e.g.
+// "https://example.com/blobs". If client is nil http.DefaultClient is used.
+func New(base string, client *http.Client) *Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Client{base: strings.TrimSuffix(base, "/"), client: client}
+}
+
+// WithToken returns a copy of c authenticating with token.
+func (c *Client) WithToken(token string) *Client {
+	cc := *c
+	cc.token = token
+	return &cc
+}
+
+func (c *Client) GetBlobs(ctx context.Context, blobs []blob.Ref) (io.ReadCloser, uint32, error) {
+	if len(blobs) > protocol.MaxRefs {
+		return nil, 0, ErrTooManyRefs
+	}
+	q := url.Values{}
+	for _, br := range blobs {
+		q.Add("ref", br.String())
+	}
+	resp, err := c.do(ctx, http.MethodGet, protocol.PathBlobs+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := strconv.ParseUint(resp.Header.Get(protocol.HeaderSize), 10, 32)
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, errors.New("remote: missing or invalid size in response")
+	}
+	return &sizedBody{ReadCloser: resp.Body, left: int64(size)}, uint32(size), nil
+}
+
+// sizedBody is the body of a get response, which fails unless it is exactly
+// as long as the size given in the response.
+type sizedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *sizedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		n += int(b.left)
+		b.left = 0
+		return n, errors.New("remote: response longer than its size")
+	}
+	if err == io.EOF && b.left > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *Client) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	path := protocol.PathBlob + br.String()
+	if after.Valid() {
+		path += "?after=" + url.QueryEscape(after.String())
+	}
+	resp, err := c.do(ctx, http.MethodPut, path, source)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	defer resp.Body.Close()
+	var sr protocol.SizedRef
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return blob.SizedRef{}, err
+	}
+	if sr.Ref != br {
+		return blob.SizedRef{}, errors.New("remote: server stored unexpected ref " + sr.Ref.String())
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		return br.Sized(sr.Size), storage.ErrPending
+	}
+	return br.Sized(sr.Size), nil
+}
+
+func (c *Client) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	for len(blobs) > 0 {
+		n := len(blobs)
+		if n > protocol.MaxRefs {
+			n = protocol.MaxRefs
+		}
+		var found []protocol.SizedRef
+		if err := c.postJSON(ctx, protocol.PathStat, blobs[:n], &found); err != nil {
+			return err
+		}
+		for _, sr := range found {
+			if err := fn(sr.Ref.Sized(sr.Size)); err != nil {
+				return err
+			}
+		}
+		blobs = blobs[n:]
+	}
+	return nil
+}
+
+func (c *Client) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, filter storage.Filter) error {
+	defer close(dest)
+
+	q := url.Values{}
+	if filter.ExcludeSchemaBlobs {
+		q.Set("noschema", "1")
+	}
+	if filter.ExcludeDataBlobs {
+		q.Set("nodata", "1")
+	}
+	after := filter.After
+	for {
+		q.Set("after", after)
+		var er protocol.EnumerateResponse
+		if err := c.getJSON(ctx, protocol.PathEnumerate+"?"+q.Encode(), &er); err != nil {
+			return err
+		}
+		for _, sr := range er.Blobs {
+			select {
+			case dest <- sr.Ref.Sized(sr.Size):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if er.Continue == "" {
+			return nil
+		}
+		after = er.Continue
+	}
+}
+
+func (c *Client) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	for len(blobs) > 0 {
+		n := len(blobs)
+		if n > protocol.MaxRefs {
+			n = protocol.MaxRefs
+		}
+		if err := c.postJSON(ctx, protocol.PathRemove, blobs[:n], nil); err != nil {
+			return err
+		}
+		blobs = blobs[n:]
+	}
+	return nil
+}
+
+// Close releases idle connections.
+func (c *Client) Close() error {
+	if t, ok := c.client.Transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
+// StorageGeneration implements storage.Generationer.
+func (c *Client) StorageGeneration() (initTime time.Time, random string, err error) {
+	var g protocol.Generation
+	if err := c.getJSON(context.Background(), protocol.PathGeneration, &g); err != nil {
+		return time.Time{}, "", err
+	}
+	return g.InitTime, g.Random, nil
+}
+
+// ResetStorageGeneration implements storage.Generationer.
+func (c *Client) ResetStorageGeneration() error {
+	return c.postJSON(context.Background(), protocol.PathGenerationReset, nil, nil)
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) postJSON(ctx context.Context, path string, body, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends a request and returns the response if it has a 2xx status code,
+// else the body is decoded into an error.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.token != "" {
+		req.Header.Set("Authorization", protocol.AuthScheme+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var pe protocol.Error
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if json.Unmarshal(b, &pe) != nil || pe.Error == "" {
+		pe.Error = resp.Status
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, os.ErrPermission
+	case http.StatusRequestEntityTooLarge:
+		return nil, storage.ErrTooLarge
+	}
+	if pe.Error == storage.ErrHashMismatch.Error() {
+		return nil, storage.ErrHashMismatch
+	}
+	return nil, errors.New("remote: " + pe.Error)
+}
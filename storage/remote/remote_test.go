@@ -0,0 +1,116 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/access"
+	"github.com/vron/compono/storage/memory"
+	"github.com/vron/compono/storage/protocol"
+	"github.com/vron/compono/storage/server"
+	"github.com/vron/compono/storage/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (storage.Storage, func()) {
+		m := memory.New()
+		ts := httptest.NewServer(server.New(m))
+		return New(ts.URL, nil), func() {
+			ts.Close()
+			m.Close()
+		}
+	})
+}
+
+func TestEnumeratePages(t *testing.T) {
+	m := memory.New()
+	defer m.Close()
+	ts := httptest.NewServer(server.New(m))
+	defer ts.Close()
+	c := New(ts.URL, nil)
+
+	n := protocol.MaxEnumerateLimit + 10
+	for i := 0; i < n; i++ {
+		br, d := storagetest.Blob(string(rune(i)), i%2 == 0)
+		storagetest.Put(t, m, br, d)
+	}
+	if refs := storagetest.Enumerate(t, c, storage.Filter{}); len(refs) != n {
+		t.Error("expected all refs to be enumerated over several pages", len(refs), n)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	m := memory.New()
+	defer m.Close()
+	ts := httptest.NewServer(server.NewRestricted(m, map[string]access.Capabilities{
+		"admin":  access.Full,
+		"backup": access.Backup,
+	}))
+	defer ts.Close()
+	c := New(ts.URL, nil)
+	ctx := context.Background()
+
+	br, d := storagetest.Blob("data", false)
+	if _, err := c.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(d)); err != os.ErrPermission {
+		t.Error("expected put without token to be denied, got", err)
+	}
+	storagetest.Put(t, c.WithToken("backup"), br, d)
+	if _, _, err := c.WithToken("backup").GetBlobs(ctx, []blob.Ref{br}); err != os.ErrPermission {
+		t.Error("expected backup client read to be denied, got", err)
+	}
+	storagetest.Get(t, c.WithToken("admin"), br, d)
+}
+
+func TestGetSize(t *testing.T) {
+	br, d := storagetest.Blob("data", false)
+	for _, tc := range []struct {
+		name, size string
+		ok         bool
+	}{
+		{"exact", "4", true},
+		{"missing", "", false},
+		{"short", "5", false},
+		{"long", "3", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.size != "" {
+					w.Header().Set(protocol.HeaderSize, tc.size)
+				}
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush() // no Content-Length
+				w.Write(d)
+			}))
+			defer ts.Close()
+			rc, size, err := New(ts.URL, nil).GetBlobs(context.Background(), []blob.Ref{br})
+			if err != nil {
+				if tc.ok || tc.size != "" {
+					t.Fatal("unexpected get error", err)
+				}
+				return
+			}
+			defer rc.Close()
+			b, err := ioutil.ReadAll(rc)
+			if tc.ok {
+				if err != nil || !bytes.Equal(b, d) || size != uint32(len(d)) {
+					t.Error("expected the blob", err, b, size)
+				}
+				return
+			}
+			if err == nil {
+				t.Error("expected the body not matching its size to fail", b, size)
+			}
+			if tc.name == "short" && err != io.ErrUnexpectedEOF {
+				t.Error("expected unexpected EOF, got", err)
+			}
+		})
+	}
+}
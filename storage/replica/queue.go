@@ -0,0 +1,268 @@
+package replica
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+)
+
+// A queue is a persistent FIFO of refs to write to an async backend. It is
+// kept as a log file with one line per operation, "+ref" when a ref is added
+// and "-ref" when it is done or removed, which is compacted as it grows.
+type queue struct {
+	backend storage.Storage
+	wake    chan struct{} // signaled when a ref is added
+
+	// copying is held while a ref is written to the backend, such that a
+	// removal can wait for a copy of a removed ref to finish.
+	copying sync.Mutex
+
+	m       sync.Mutex // protects all fields below
+	path    string
+	file    *os.File
+	refs    []blob.Ref // in the order added, may contain refs no longer queued
+	set     map[blob.Ref]bool
+	held    map[blob.Ref]int      // refs not to replicate yet, see add
+	backoff map[blob.Ref]*backoff // refs that failed to be written
+	lines   int                   // number of lines in the file
+}
+
+// A backoff holds a ref that failed to be written back from replication for
+// a time doubling with each failure.
+type backoff struct {
+	failures uint
+	until    time.Time
+}
+
+func openQueue(dir string, i int, backend storage.Storage) (*queue, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	q := &queue{
+		backend: backend,
+		wake:    make(chan struct{}, 1),
+		path:    filepath.Join(dir, fmt.Sprintf("queue-%d.log", i)),
+		set:     make(map[blob.Ref]bool),
+		held:    make(map[blob.Ref]int),
+		backoff: make(map[blob.Ref]*backoff),
+	}
+
+	f, err := os.Open(q.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := sc.Bytes()
+			if len(line) < 2 {
+				continue
+			}
+			br, ok := blob.Parse(line[1:])
+			if !ok {
+				// a torn write at the end of the file
+				continue
+			}
+			switch line[0] {
+			case '+':
+				if !q.set[br] {
+					q.set[br] = true
+					q.refs = append(q.refs, br)
+				}
+			case '-':
+				delete(q.set, br)
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// always start from a compacted file
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// add queues br and syncs the queue to disk, before the blob is written
+// anywhere such that it is replicated even after a crash. The ref is held back
+// from replication until released, since until then the blob may not be found
+// to copy. After a restart all refs are replicated.
+func (q *queue) add(br blob.Ref) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if !q.set[br] {
+		if err := q.write('+', br); err != nil {
+			return err
+		}
+		if err := q.file.Sync(); err != nil {
+			return err
+		}
+		q.set[br] = true
+		q.refs = append(q.refs, br)
+	}
+	q.held[br]++
+	return nil
+}
+
+// release lets br added to the queue be replicated.
+func (q *queue) release(br blob.Ref) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.held[br]--; q.held[br] <= 0 {
+		delete(q.held, br)
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the oldest ref in the queue not held back. If there is none,
+// wait is the time until the backoff of a ref ends, or 0 if none is backed off.
+func (q *queue) next() (br blob.Ref, ok bool, wait time.Duration) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for len(q.refs) > 0 && !q.set[q.refs[0]] {
+		q.refs = q.refs[1:]
+	}
+	now := time.Now()
+	for _, br := range q.refs {
+		if !q.set[br] || q.held[br] > 0 {
+			continue
+		}
+		if b := q.backoff[br]; b != nil && b.until.After(now) {
+			if d := b.until.Sub(now); wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		return br, true, 0
+	}
+	return blob.Ref{}, false, wait
+}
+
+// queued reports whether br is in the queue.
+func (q *queue) queued(br blob.Ref) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.set[br]
+}
+
+// retry moves br, which failed to be written, to the back of the queue and
+// holds it back for min, doubled for each earlier failure up to max.
+func (q *queue) retry(br blob.Ref, min, max time.Duration) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if !q.set[br] {
+		return
+	}
+	for i, r := range q.refs {
+		if r == br {
+			q.refs = append(q.refs[:i:i], q.refs[i+1:]...)
+			break
+		}
+	}
+	q.refs = append(q.refs, br)
+	b := q.backoff[br]
+	if b == nil {
+		b = &backoff{}
+		q.backoff[br] = b
+	}
+	d := max
+	if b.failures < 32 && min<<b.failures < max {
+		d = min << b.failures
+	}
+	b.failures++
+	b.until = time.Now().Add(d)
+}
+
+// done removes br from the queue, it does not need to be synced since writing
+// a blob twice is harmless.
+func (q *queue) done(br blob.Ref) error {
+	return q.remove([]blob.Ref{br})
+}
+
+func (q *queue) remove(refs []blob.Ref) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for _, br := range refs {
+		if !q.set[br] {
+			continue
+		}
+		delete(q.set, br)
+		delete(q.backoff, br)
+		if err := q.write('-', br); err != nil {
+			return err
+		}
+	}
+	if q.lines > 2*len(q.set)+1024 {
+		return q.compact()
+	}
+	return nil
+}
+
+func (q *queue) len() int {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return len(q.set)
+}
+
+// the caller is expected to hold the lock.
+func (q *queue) write(op byte, br blob.Ref) error {
+	_, err := q.file.WriteString(string(op) + br.String() + "\n")
+	q.lines++
+	return err
+}
+
+// compact rewrites the file with only the queued refs. The caller is expected
+// to hold the lock.
+func (q *queue) compact() error {
+	tmp := q.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var refs []blob.Ref
+	for _, br := range q.refs {
+		if q.set[br] {
+			refs = append(refs, br)
+			w.WriteString("+" + br.String() + "\n")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		f.Close()
+		return err
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = f
+	q.refs = refs
+	q.lines = len(refs)
+	return nil
+}
+
+func (q *queue) close() error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.file.Close()
+}
@@ -0,0 +1,370 @@
+// Package replica implements a storage.Storage that writes every blob to
+// several backends. Backends are either written before PutBlob returns, or in
+// the background through a persistent queue that survives restarts, such that
+// slow or unreliable backups eventually catch up.
+package replica
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+)
+
+var ErrClosed = errors.New("replica: the storage is closed")
+
+// A Backend is one of the storages blobs are replicated to.
+type Backend struct {
+	Storage storage.Storage
+	// Async makes blobs be written to the backend in the background,
+	// retried until they succeed, instead of before PutBlob returns.
+	Async bool
+}
+
+// Options to configure the replica storage.
+type Options struct {
+	// QueueDir is the directory the queues of blobs not yet written to
+	// async backends are kept in. The queues are identified by the position
+	// of the backend, so the order of the backends must not be changed.
+	QueueDir string
+	// RetryInterval is the time to wait after a failed write to an async
+	// backend before writing to it again. The blob that failed is moved to
+	// the back of the queue and retried after RetryInterval, doubled for
+	// each time it has failed up to MaxRetryInterval, such that a blob that
+	// keeps failing does not hold back the others.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+}
+
+var DefaultOptions = Options{
+	RetryInterval:    10 * time.Second,
+	MaxRetryInterval: time.Hour,
+}
+
+// Storage replicates blobs to several backends. It takes ownership of the
+// backends and closes them when closed.
+type Storage struct {
+	opt      Options
+	backends []Backend
+	sync     []storage.Storage // the backends written before PutBlob returns
+	queues   []*queue          // a queue for each async backend
+	stopc    chan struct{}
+	wg       sync.WaitGroup
+
+	m      sync.Mutex // protects closed
+	closed bool
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+// New returns a Storage replicating to backends, of which at least one must
+// not be async. Async backends are caught up with anything left in their
+// queues in the background.
+func New(backends []Backend, opt Options) (*Storage, error) {
+	if opt.RetryInterval <= 0 {
+		opt.RetryInterval = DefaultOptions.RetryInterval
+	}
+	if opt.MaxRetryInterval <= 0 {
+		opt.MaxRetryInterval = DefaultOptions.MaxRetryInterval
+	}
+	if opt.MaxRetryInterval < opt.RetryInterval {
+		opt.MaxRetryInterval = opt.RetryInterval
+	}
+	s := &Storage{opt: opt, backends: backends, stopc: make(chan struct{})}
+	for i, b := range backends {
+		if !b.Async {
+			s.sync = append(s.sync, b.Storage)
+			continue
+		}
+		if opt.QueueDir == "" {
+			s.closeQueues()
+			return nil, errors.New("replica: a QueueDir is needed for async backends")
+		}
+		q, err := openQueue(opt.QueueDir, i, b.Storage)
+		if err != nil {
+			s.closeQueues()
+			return nil, err
+		}
+		s.queues = append(s.queues, q)
+	}
+	if len(s.sync) == 0 {
+		s.closeQueues()
+		return nil, errors.New("replica: at least one backend must not be async")
+	}
+	for _, q := range s.queues {
+		s.wg.Add(1)
+		go s.replicate(q)
+	}
+	return s, nil
+}
+
+func (s *Storage) isClosed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.closed
+}
+
+// GetBlobs tries each backend in turn until one has all the blobs.
+func (s *Storage) GetBlobs(ctx context.Context, blobs []blob.Ref) (io.ReadCloser, uint32, error) {
+	if s.isClosed() {
+		return nil, 0, ErrClosed
+	}
+	var err error = os.ErrNotExist
+	for _, b := range s.backends {
+		rc, size, e := b.Storage.GetBlobs(ctx, blobs)
+		if e == nil {
+			return rc, size, nil
+		}
+		if !os.IsNotExist(e) {
+			err = e
+		}
+	}
+	return nil, 0, err
+}
+
+// PutBlob queues the blob for the async backends and writes it to all sync
+// ones. If any sync backend returns storage.ErrPending so does PutBlob.
+func (s *Storage) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	if s.isClosed() {
+		return blob.SizedRef{}, ErrClosed
+	}
+	data, err := storage.ReadVerified(br, source)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+
+	// queued first such that a blob in a sync backend is never missing from
+	// the queues after a crash, a blob queued but not written is dropped from
+	// the queue when not found to copy
+	for i, q := range s.queues {
+		if err := q.add(br); err != nil {
+			for _, q := range s.queues[:i] {
+				q.release(br)
+			}
+			return blob.SizedRef{}, err
+		}
+	}
+	defer func() {
+		for _, q := range s.queues {
+			q.release(br)
+		}
+	}()
+
+	errs := make([]error, len(s.sync))
+	var wg sync.WaitGroup
+	for i, b := range s.sync {
+		wg.Add(1)
+		go func(i int, b storage.Storage) {
+			defer wg.Done()
+			_, errs[i] = b.PutBlob(ctx, br, after, bytes.NewReader(data))
+		}(i, b)
+	}
+	wg.Wait()
+	pending := false
+	for _, err := range errs {
+		if err == storage.ErrPending {
+			pending = true
+		} else if err != nil {
+			return blob.SizedRef{}, err
+		}
+	}
+
+	sr := br.Sized(uint32(len(data)))
+	if pending {
+		return sr, storage.ErrPending
+	}
+	return sr, nil
+}
+
+// StatBlobs stats the blobs in all backends.
+func (s *Storage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	seen := make(map[blob.Ref]bool, len(blobs))
+	remaining := blobs
+	for _, b := range s.backends {
+		if len(remaining) == 0 {
+			break
+		}
+		err := b.Storage.StatBlobs(ctx, remaining, func(sr blob.SizedRef) error {
+			if seen[sr.Ref] {
+				return nil
+			}
+			seen[sr.Ref] = true
+			return fn(sr)
+		})
+		if err != nil {
+			return err
+		}
+		var next []blob.Ref
+		for _, br := range remaining {
+			if !seen[br] {
+				next = append(next, br)
+			}
+		}
+		remaining = next
+	}
+	return nil
+}
+
+// EnumerateBlobs merges the enumerations of all backends.
+func (s *Storage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, filter storage.Filter) error {
+	if s.isClosed() {
+		close(dest)
+		return ErrClosed
+	}
+	srcs := make([]storage.Storage, len(s.backends))
+	for i, b := range s.backends {
+		srcs[i] = b.Storage
+	}
+	return storage.MergeEnumerate(ctx, dest, filter, srcs...)
+}
+
+// RemoveBlobs removes the blobs from the queues of async backends, and then
+// from all backends once any copy of them in flight to an async backend has
+// finished, such that it is not written again after being removed.
+func (s *Storage) RemoveBlobs(ctx context.Context, blobs []blob.Ref) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	for _, q := range s.queues {
+		if err := q.remove(blobs); err != nil {
+			return err
+		}
+		q.copying.Lock()
+		defer q.copying.Unlock()
+	}
+	var err error
+	for _, b := range s.backends {
+		if e := b.Storage.RemoveBlobs(ctx, blobs); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close stops the background replication and closes all backends. Blobs left
+// in the queues are replicated when the storage is next created.
+func (s *Storage) Close() error {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	s.m.Unlock()
+
+	close(s.stopc)
+	s.wg.Wait()
+	err := s.closeQueues()
+	for _, b := range s.backends {
+		if e := b.Storage.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *Storage) closeQueues() error {
+	var err error
+	for _, q := range s.queues {
+		if e := q.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Pending returns the number of blobs not yet written to each async backend,
+// in the order the async backends were given.
+func (s *Storage) Pending() []int {
+	n := make([]int, len(s.queues))
+	for i, q := range s.queues {
+		n[i] = q.len()
+	}
+	return n
+}
+
+// replicate writes the blobs in q to its backend until the storage is closed.
+func (s *Storage) replicate(q *queue) {
+	defer s.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.stopc
+		cancel()
+	}()
+
+	for {
+		br, ok, wait := q.next()
+		if !ok {
+			var retry <-chan time.Time
+			if wait > 0 {
+				retry = time.After(wait)
+			}
+			select {
+			case <-q.wake:
+			case <-retry:
+			case <-s.stopc:
+				return
+			}
+			continue
+		}
+		q.copying.Lock()
+		var err error
+		if q.queued(br) {
+			// else removed since found
+			err = s.copyTo(ctx, q.backend, br)
+		}
+		q.copying.Unlock()
+		if err != nil {
+			q.retry(br, s.opt.RetryInterval, s.opt.MaxRetryInterval)
+			select {
+			case <-time.After(s.opt.RetryInterval):
+				continue
+			case <-s.stopc:
+				return
+			}
+		}
+		if err := q.done(br); err != nil {
+			select {
+			case <-time.After(s.opt.RetryInterval):
+			case <-s.stopc:
+				return
+			}
+		}
+	}
+}
+
+// copyTo reads br from any sync backend and writes it to dst. A blob that no
+// longer exists in any sync backend is considered copied.
+func (s *Storage) copyTo(ctx context.Context, dst storage.Storage, br blob.Ref) error {
+	for _, b := range s.sync {
+		rc, _, err := b.GetBlobs(ctx, []blob.Ref{br})
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		_, err = dst.PutBlob(ctx, br, blob.Ref{}, bytes.NewReader(data))
+		if err == storage.ErrPending {
+			err = nil
+		}
+		return err
+	}
+	return nil
+}
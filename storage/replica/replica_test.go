@@ -0,0 +1,265 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/memory"
+	"github.com/vron/compono/storage/storagetest"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (storage.Storage, func()) {
+		dir := tempDir(t)
+		s, err := New([]Backend{
+			{Storage: memory.New()},
+			{Storage: memory.New()},
+			{Storage: memory.New(), Async: true},
+		}, Options{QueueDir: dir, RetryInterval: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, func() { os.RemoveAll(dir) }
+	})
+}
+
+// flaky fails all puts while failing is set.
+type flaky struct {
+	storage.Storage
+	failing int32
+}
+
+func (f *flaky) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	if atomic.LoadInt32(&f.failing) != 0 {
+		return blob.SizedRef{}, errors.New("flaky: failing")
+	}
+	return f.Storage.PutBlob(ctx, br, after, source)
+}
+
+// Close does not close the underlying storage, such that it can be reused.
+func (f *flaky) Close() error { return nil }
+
+// blocking blocks puts until unblock is closed, signaling entered if set
+// when a put starts.
+type blocking struct {
+	storage.Storage
+	unblock chan struct{}
+	entered chan struct{}
+}
+
+func (b *blocking) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	if b.entered != nil {
+		b.entered <- struct{}{}
+	}
+	<-b.unblock
+	return b.Storage.PutBlob(ctx, br, after, source)
+}
+
+// poisoned fails all puts of one blob.
+type poisoned struct {
+	storage.Storage
+	ref blob.Ref
+}
+
+func (p *poisoned) PutBlob(ctx context.Context, br, after blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	if br == p.ref {
+		return blob.SizedRef{}, errors.New("poisoned: failing")
+	}
+	return p.Storage.PutBlob(ctx, br, after, source)
+}
+
+func waitPending(t *testing.T, s *Storage) {
+	for i := 0; i < 1000; i++ {
+		if s.Pending()[0] == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("async backend did not catch up")
+}
+
+func TestAsyncRetryAfterRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	primary, backup := memory.New(), &flaky{Storage: memory.New(), failing: 1}
+	defer primary.Close()
+	defer backup.Storage.Close()
+	backends := []Backend{
+		{Storage: &flaky{Storage: primary}},
+		{Storage: backup, Async: true},
+	}
+	opt := Options{QueueDir: dir, RetryInterval: time.Millisecond}
+
+	s, err := New(backends, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []blob.Ref
+	for i := 0; i < 10; i++ {
+		br, d := storagetest.Blob(string(rune('a'+i)), false)
+		storagetest.Put(t, s, br, d)
+		refs = append(refs, br)
+	}
+	if p := s.Pending()[0]; p != 10 {
+		t.Error("expected all blobs to be pending for the failing backup", p)
+	}
+	s.Close()
+
+	// the queue survives a restart and the backup catches up once it works
+	atomic.StoreInt32(&backup.failing, 0)
+	s, err = New(backends, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	waitPending(t, s)
+	n := 0
+	backup.StatBlobs(context.Background(), refs, func(blob.SizedRef) error { n++; return nil })
+	if n != len(refs) {
+		t.Error("expected all blobs to be replicated to the backup", n)
+	}
+}
+
+func TestQueuedBeforeWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	primary, backup := &blocking{Storage: memory.New(), unblock: make(chan struct{})}, memory.New()
+	s, err := New([]Backend{
+		{Storage: primary},
+		{Storage: backup, Async: true},
+	}, Options{QueueDir: dir, RetryInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the blob is queued before it is written, but not replicated until then
+	br, d := storagetest.Blob("queued", false)
+	done := make(chan error)
+	go func() {
+		_, err := s.PutBlob(context.Background(), br, blob.Ref{}, bytes.NewReader(d))
+		done <- err
+	}()
+	for i := 0; s.Pending()[0] == 0 && i < 1000; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if p := s.Pending()[0]; p != 1 {
+		t.Error("expected the blob to be queued while written", p)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if p := s.Pending()[0]; p != 1 {
+		t.Error("expected the blob not to be replicated before written", p)
+	}
+	close(primary.unblock)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	waitPending(t, s)
+	storagetest.Get(t, backup, br, d)
+}
+
+// TestRemoveWhileCopying checks that a blob removed while being copied to an
+// async backend is removed from it once copied.
+func TestRemoveWhileCopying(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	backup := &blocking{Storage: memory.New(), unblock: make(chan struct{}), entered: make(chan struct{})}
+	s, err := New([]Backend{
+		{Storage: memory.New()},
+		{Storage: backup, Async: true},
+	}, Options{QueueDir: dir, RetryInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	br, d := storagetest.Blob("removed", false)
+	storagetest.Put(t, s, br, d)
+	<-backup.entered
+	done := make(chan error)
+	go func() { done <- s.RemoveBlobs(context.Background(), []blob.Ref{br}) }()
+	select {
+	case <-done:
+		t.Error("expected the remove to wait for the copy")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(backup.unblock)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if _, _, err := backup.GetBlobs(context.Background(), []blob.Ref{br}); !os.IsNotExist(err) {
+		t.Error("expected the blob to be removed from the backup", err)
+	}
+	if p := s.Pending()[0]; p != 0 {
+		t.Error("expected the blob not to be queued", p)
+	}
+}
+
+// TestRetryBackoff checks that a blob failing to be copied does not hold back
+// the blobs queued after it.
+func TestRetryBackoff(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	bad, bd := storagetest.Blob("bad", false)
+	backup := &poisoned{Storage: memory.New(), ref: bad}
+	s, err := New([]Backend{
+		{Storage: memory.New()},
+		{Storage: backup, Async: true},
+	}, Options{QueueDir: dir, RetryInterval: time.Millisecond, MaxRetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	storagetest.Put(t, s, bad, bd)
+	var refs []blob.Ref
+	for i := 0; i < 10; i++ {
+		br, d := storagetest.Blob(string(rune('a'+i)), false)
+		storagetest.Put(t, s, br, d)
+		refs = append(refs, br)
+	}
+	for i := 0; s.Pending()[0] > 1 && i < 1000; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if p := s.Pending()[0]; p != 1 {
+		t.Fatal("expected only the failing blob to be pending", p)
+	}
+	n := 0
+	backup.StatBlobs(context.Background(), refs, func(blob.SizedRef) error { n++; return nil })
+	if n != len(refs) {
+		t.Error("expected the other blobs to be replicated to the backup", n)
+	}
+}
+
+func TestReadFallback(t *testing.T) {
+	a, b := memory.New(), memory.New()
+	s, err := New([]Backend{{Storage: a}, {Storage: b}}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	br, d := storagetest.Blob("only in b", false)
+	b.PutBlob(context.Background(), br, blob.Ref{}, bytes.NewReader(d))
+	storagetest.Get(t, s, br, d)
+	if refs := storagetest.Enumerate(t, s, storage.Filter{}); len(refs) != 1 {
+		t.Error("expected blob only in one backend to be enumerated", len(refs))
+	}
+}
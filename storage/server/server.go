@@ -0,0 +1,278 @@
+// Package server exposes a storage.Storage over HTTP, as specified by the
+// protocol package.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/access"
+	"github.com/vron/compono/storage/protocol"
+)
+
+// maxRefsBody is the largest body accepted for requests taking a list of refs.
+const maxRefsBody = protocol.MaxRefs * 70
+
+// A Handler serves the blob protocol for a Storage.
+type Handler struct {
+	s storage.Storage
+	// clients are the handlers for each token, if credentials are required.
+	clients map[string]*Handler
+}
+
+// New returns a Handler serving s to anyone.
+func New(s storage.Storage) *Handler {
+	return &Handler{s: s}
+}
+
+// NewRestricted returns a Handler serving s only to clients presenting one of
+// the tokens in clients, which are allowed the capabilities of their token.
+func NewRestricted(s storage.Storage, clients map[string]access.Capabilities) *Handler {
+	h := &Handler{clients: make(map[string]*Handler, len(clients))}
+	for token, caps := range clients {
+		h.clients[token] = New(access.Restrict(s, caps))
+	}
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.clients == nil {
+		h.serve(w, r)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	c, ok := h.clients[strings.TrimPrefix(auth, protocol.AuthScheme)]
+	if !ok || !strings.HasPrefix(auth, protocol.AuthScheme) {
+		writeError(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	c.serve(w, r)
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	switch p := r.URL.Path; {
+	case p == protocol.PathBlobs && r.Method == http.MethodGet:
+		h.get(w, r)
+	case strings.HasPrefix(p, protocol.PathBlob) && r.Method == http.MethodPut:
+		h.put(w, r)
+	case p == protocol.PathStat && r.Method == http.MethodPost:
+		h.stat(w, r)
+	case p == protocol.PathEnumerate && r.Method == http.MethodGet:
+		h.enumerate(w, r)
+	case p == protocol.PathRemove && r.Method == http.MethodPost:
+		h.remove(w, r)
+	case p == protocol.PathGeneration && r.Method == http.MethodGet:
+		h.generation(w, r)
+	case p == protocol.PathGenerationReset && r.Method == http.MethodPost:
+		h.resetGeneration(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	refs, ok := parseRefs(r.URL.Query()["ref"])
+	if !ok || len(refs) == 0 || len(refs) > protocol.MaxRefs {
+		writeError(w, http.StatusBadRequest, "invalid refs")
+		return
+	}
+	rc, size, err := h.s.GetBlobs(r.Context(), refs)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(protocol.HeaderSize, strconv.FormatUint(uint64(size), 10))
+	w.Header().Set("Content-Length", strconv.FormatUint(uint64(size), 10))
+	io.Copy(w, rc)
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request) {
+	br, ok := blob.ParseString(strings.TrimPrefix(r.URL.Path, protocol.PathBlob))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid ref")
+		return
+	}
+	var after blob.Ref
+	if a := r.URL.Query().Get("after"); a != "" {
+		if after, ok = blob.ParseString(a); !ok {
+			writeError(w, http.StatusBadRequest, "invalid after ref")
+			return
+		}
+	}
+	if r.ContentLength > blob.MaxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, storage.ErrTooLarge.Error())
+		return
+	}
+
+	sr, err := h.s.PutBlob(r.Context(), br, after, storage.VerifyingReader(br, r.Body))
+	if err == storage.ErrPending {
+		writeJSON(w, http.StatusAccepted, protocol.SizedRef{Ref: sr.Ref, Size: sr.Size()})
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, protocol.SizedRef{Ref: sr.Ref, Size: sr.Size()})
+}
+
+func (h *Handler) stat(w http.ResponseWriter, r *http.Request) {
+	refs, ok := readRefs(w, r)
+	if !ok {
+		return
+	}
+	found := []protocol.SizedRef{}
+	err := h.s.StatBlobs(r.Context(), refs, func(sr blob.SizedRef) error {
+		found = append(found, protocol.SizedRef{Ref: sr.Ref, Size: sr.Size()})
+		return nil
+	})
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+func (h *Handler) enumerate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := protocol.MaxEnumerateLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	filter := storage.Filter{
+		After:              q.Get("after"),
+		ExcludeSchemaBlobs: q.Get("noschema") == "1",
+		ExcludeDataBlobs:   q.Get("nodata") == "1",
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	ch := make(chan blob.SizedRef)
+	errc := make(chan error, 1)
+	go func() { errc <- h.s.EnumerateBlobs(ctx, ch, filter) }()
+
+	resp := protocol.EnumerateResponse{Blobs: []protocol.SizedRef{}}
+	for sr := range ch {
+		if len(resp.Blobs) == limit {
+			resp.Continue = resp.Blobs[len(resp.Blobs)-1].Ref.String()
+			cancel()
+			for range ch {
+			}
+			break
+		}
+		resp.Blobs = append(resp.Blobs, protocol.SizedRef{Ref: sr.Ref, Size: sr.Size()})
+	}
+	if err := <-errc; err != nil && resp.Continue == "" {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) remove(w http.ResponseWriter, r *http.Request) {
+	refs, ok := readRefs(w, r)
+	if !ok {
+		return
+	}
+	if err := h.s.RemoveBlobs(r.Context(), refs); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) generation(w http.ResponseWriter, r *http.Request) {
+	g, ok := h.s.(storage.Generationer)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "storage does not support generations")
+		return
+	}
+	t, random, err := g.StorageGeneration()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, protocol.Generation{InitTime: t, Random: random})
+}
+
+func (h *Handler) resetGeneration(w http.ResponseWriter, r *http.Request) {
+	g, ok := h.s.(storage.Generationer)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "storage does not support generations")
+		return
+	}
+	if err := g.ResetStorageGeneration(); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseRefs(ss []string) ([]blob.Ref, bool) {
+	refs := make([]blob.Ref, len(ss))
+	for i, s := range ss {
+		var ok bool
+		if refs[i], ok = blob.ParseString(s); !ok {
+			return nil, false
+		}
+	}
+	return refs, true
+}
+
+// readRefs decodes a JSON list of refs from the body, writing an error
+// response if it is not valid.
+func readRefs(w http.ResponseWriter, r *http.Request) ([]blob.Ref, bool) {
+	var refs []blob.Ref
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRefsBody)).Decode(&refs); err != nil || len(refs) > protocol.MaxRefs {
+		writeError(w, http.StatusBadRequest, "invalid list of refs")
+		return nil, false
+	}
+	for _, br := range refs {
+		if !br.Valid() {
+			writeError(w, http.StatusBadRequest, "invalid list of refs")
+			return nil, false
+		}
+	}
+	return refs, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, protocol.Error{Error: msg})
+}
+
+func writeStorageError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		writeError(w, http.StatusNotFound, err.Error())
+	case os.IsPermission(err):
+		writeError(w, http.StatusForbidden, err.Error())
+	case err == storage.ErrHashMismatch:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case err == storage.ErrTooLarge:
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+	"github.com/vron/compono/storage/access"
+	"github.com/vron/compono/storage/memory"
+	"github.com/vron/compono/storage/protocol"
+	"github.com/vron/compono/storage/storagetest"
+)
+
+func TestPutVerified(t *testing.T) {
+	m := memory.New()
+	defer m.Close()
+	h := New(m)
+
+	br, d := storagetest.Blob("data", false)
+	for _, tc := range []struct {
+		path   string
+		body   []byte
+		status int
+	}{
+		{protocol.PathBlob + br.String(), d, http.StatusOK},
+		{protocol.PathBlob + br.String(), []byte("other"), http.StatusBadRequest},
+		{protocol.PathBlob + br.String(), make([]byte, blob.MaxSize+1), http.StatusRequestEntityTooLarge},
+		{protocol.PathBlob + "d:sha2-00", d, http.StatusBadRequest},
+		{protocol.PathBlob + br.String() + "?after=bad", d, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, tc.path, bytes.NewReader(tc.body))
+		r.ContentLength = -1 // ensure the size is checked while streaming
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Error(tc.path, "expected status", tc.status, "got", w.Code, w.Body.String())
+		}
+	}
+	if refs := storagetest.Enumerate(t, m, storage.Filter{}); len(refs) != 1 {
+		t.Error("expected only the valid blob to be stored", len(refs))
+	}
+}
+
+func TestRestrictedGeneration(t *testing.T) {
+	m := memory.New()
+	defer m.Close()
+	h := NewRestricted(m, map[string]access.Capabilities{
+		"backup": access.Backup,
+		"none":   {},
+		"full":   access.Full,
+	})
+
+	for _, tc := range []struct {
+		token, method, path string
+		status              int
+	}{
+		{"backup", http.MethodGet, protocol.PathGeneration, http.StatusOK},
+		{"none", http.MethodGet, protocol.PathGeneration, http.StatusForbidden},
+		{"backup", http.MethodPost, protocol.PathGenerationReset, http.StatusForbidden},
+		{"full", http.MethodPost, protocol.PathGenerationReset, http.StatusNoContent},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		r.Header.Set("Authorization", protocol.AuthScheme+tc.token)
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Error(tc.token, tc.path, "expected status", tc.status, "got", w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,406 @@
+// Package storagetest tests that implementations of storage.Storage follow
+// the rules documented in the storage package.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vron/compono/blob"
+	"github.com/vron/compono/storage"
+)
+
+// Test runs all the conformance tests against storages returned by
+// newStorage. Each test gets a new empty storage and calls cleanup when done,
+// after having closed the storage.
+func Test(t *testing.T, newStorage func(t *testing.T) (s storage.Storage, cleanup func())) {
+	for _, tc := range []struct {
+		name string
+		fn   func(*testing.T, storage.Storage)
+	}{
+		{"PutGet", testPutGet},
+		{"PutEmpty", testPutEmpty},
+		{"PutMismatch", testPutMismatch},
+		{"GetMissing", testGetMissing},
+		{"Stat", testStat},
+		{"Enumerate", testEnumerate},
+		{"EnumerateAfter", testEnumerateAfter},
+		{"EnumerateFilter", testEnumerateFilter},
+		{"EnumerateCanceled", testEnumerateCanceled},
+		{"Remove", testRemove},
+		{"Concurrent", testConcurrent},
+		{"Generation", testGeneration},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s, cleanup := newStorage(t)
+			defer cleanup()
+			tc.fn(t, s)
+			if err := s.Close(); err != nil {
+				t.Error("close:", err)
+			}
+		})
+	}
+}
+
+// Blob returns a Ref and contents for a test blob derived from s.
+func Blob(s string, schema bool) (blob.Ref, []byte) {
+	d := []byte(s)
+	if schema {
+		d = []byte(`{"type": "test", "value": ` + strconv.Quote(s) + `}`)
+	}
+	h := blob.NewHash()
+	h.Write(d)
+	return blob.RefFromHash(h, schema), d
+}
+
+// Put stores d under br in s, failing the test on any error.
+func Put(t *testing.T, s storage.Storage, br blob.Ref, d []byte) {
+	t.Helper()
+	sr, err := s.PutBlob(context.Background(), br, blob.Ref{}, bytes.NewReader(d))
+	if err != nil && err != storage.ErrPending {
+		t.Fatal("put:", err)
+	}
+	if sr.Ref != br || sr.Size() != uint32(len(d)) {
+		t.Error("put returned wrong sized ref:", sr.Ref, sr.Size())
+	}
+}
+
+// Get checks that br is stored in s with the contents d.
+func Get(t *testing.T, s storage.Storage, br blob.Ref, d []byte) {
+	t.Helper()
+	rc, size, err := s.GetBlobs(context.Background(), []blob.Ref{br})
+	if err != nil {
+		t.Error("get:", err)
+		return
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Error("get:", err)
+	}
+	if size != uint32(len(d)) || !bytes.Equal(b, d) {
+		t.Error("got contents not matching stored for", br)
+	}
+}
+
+// Enumerate returns all refs enumerated by s with filter, failing the test if
+// the enumeration returns an error.
+func Enumerate(t *testing.T, s storage.Storage, filter storage.Filter) []blob.SizedRef {
+	t.Helper()
+	ch := make(chan blob.SizedRef)
+	errc := make(chan error, 1)
+	go func() { errc <- s.EnumerateBlobs(context.Background(), ch, filter) }()
+	var refs []blob.SizedRef
+	for sr := range ch {
+		refs = append(refs, sr)
+	}
+	if err := <-errc; err != nil {
+		t.Error("enumerate:", err)
+	}
+	return refs
+}
+
+type testBlob struct {
+	ref  blob.Ref
+	data []byte
+}
+
+// putMany stores n schema and n data blobs and returns them sorted.
+func putMany(t *testing.T, s storage.Storage, n int) []testBlob {
+	var bs []testBlob
+	for i := 0; i < n; i++ {
+		for _, schema := range []bool{true, false} {
+			br, d := Blob("blob"+strconv.Itoa(i), schema)
+			Put(t, s, br, d)
+			bs = append(bs, testBlob{br, d})
+		}
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].ref.Less(bs[j].ref) })
+	return bs
+}
+
+func expectRefs(t *testing.T, got []blob.SizedRef, want []testBlob) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Error("expected", len(want), "refs, got", len(got))
+		return
+	}
+	for i := range got {
+		if got[i].Ref != want[i].ref || got[i].Size() != uint32(len(want[i].data)) {
+			t.Error("ref", i, "not as expected:", got[i].Ref, want[i].ref)
+			return
+		}
+	}
+}
+
+func testPutGet(t *testing.T, s storage.Storage) {
+	br, d := Blob("hello", false)
+	Put(t, s, br, d)
+	Get(t, s, br, d)
+	// putting the same blob again is not an error
+	Put(t, s, br, d)
+	Get(t, s, br, d)
+
+	sbr, sd := Blob("hello", true)
+	Put(t, s, sbr, sd)
+	Get(t, s, sbr, sd)
+
+	// several blobs are concatenated in the order given
+	rc, size, err := s.GetBlobs(context.Background(), []blob.Ref{sbr, br})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, _ := ioutil.ReadAll(rc)
+	if int(size) != len(sd)+len(d) || !bytes.Equal(b, append(append([]byte{}, sd...), d...)) {
+		t.Error("concatenated blobs not as expected")
+	}
+}
+
+func testPutEmpty(t *testing.T, s storage.Storage) {
+	br1, d1 := Blob("before", false)
+	empty, d := Blob("", false)
+	br2, d2 := Blob("after", false)
+	Put(t, s, br1, d1)
+	Put(t, s, empty, d)
+	Put(t, s, br2, d2)
+	Get(t, s, empty, d)
+	Get(t, s, br2, d2)
+
+	rc, size, err := s.GetBlobs(context.Background(), []blob.Ref{br1, empty, br2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, _ := ioutil.ReadAll(rc)
+	if int(size) != len(d1)+len(d2) || !bytes.Equal(b, append(append([]byte{}, d1...), d2...)) {
+		t.Error("concatenated blobs not as expected")
+	}
+	found := false
+	err = s.StatBlobs(context.Background(), []blob.Ref{empty}, func(sr blob.SizedRef) error {
+		found = sr.Ref == empty && sr.Size() == 0
+		return nil
+	})
+	if err != nil || !found {
+		t.Error("expected the empty blob to be found by stat", err)
+	}
+	if refs := Enumerate(t, s, storage.Filter{}); len(refs) != 3 {
+		t.Error("expected 3 blobs to be enumerated, got", len(refs))
+	}
+}
+
+func testPutMismatch(t *testing.T, s storage.Storage) {
+	br, _ := Blob("one", false)
+	_, d := Blob("two", false)
+	if _, err := s.PutBlob(context.Background(), br, blob.Ref{}, bytes.NewReader(d)); err == nil || err == storage.ErrPending {
+		t.Error("expected an error putting contents not matching the ref")
+	}
+	if refs := Enumerate(t, s, storage.Filter{}); len(refs) != 0 {
+		t.Error("a mismatching blob was stored")
+	}
+}
+
+func testGetMissing(t *testing.T, s storage.Storage) {
+	br, d := Blob("exists", false)
+	Put(t, s, br, d)
+	missing, _ := Blob("missing", false)
+
+	if _, _, err := s.GetBlobs(context.Background(), []blob.Ref{missing}); !os.IsNotExist(err) {
+		t.Error("expected os.ErrNotExist, got:", err)
+	}
+	if _, _, err := s.GetBlobs(context.Background(), []blob.Ref{br, missing}); !os.IsNotExist(err) {
+		t.Error("expected os.ErrNotExist when one blob is missing, got:", err)
+	}
+}
+
+func testStat(t *testing.T, s storage.Storage) {
+	bs := putMany(t, s, 5)
+	missing, _ := Blob("missing", false)
+
+	refs := []blob.Ref{missing}
+	for _, b := range bs {
+		refs = append(refs, b.ref)
+	}
+	seen := map[blob.Ref]bool{}
+	err := s.StatBlobs(context.Background(), refs, func(sr blob.SizedRef) error {
+		if seen[sr.Ref] {
+			t.Error("stat returned duplicate:", sr.Ref)
+		}
+		seen[sr.Ref] = true
+		if sr.Ref == missing {
+			t.Error("stat returned missing blob")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error("stat:", err)
+	}
+	if len(seen) != len(bs) {
+		t.Error("expected", len(bs), "blobs to be found, got", len(seen))
+	}
+
+	// an error from fn is returned and stops further calls
+	stop := errors.New("stop")
+	calls := 0
+	err = s.StatBlobs(context.Background(), refs, func(blob.SizedRef) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Error("expected stat to stop at first error, got:", err, calls)
+	}
+
+	// only missing blobs is not an error
+	err = s.StatBlobs(context.Background(), []blob.Ref{missing}, func(blob.SizedRef) error {
+		t.Error("called for missing blob")
+		return nil
+	})
+	if err != nil {
+		t.Error("stat of missing blob:", err)
+	}
+}
+
+func testEnumerate(t *testing.T, s storage.Storage) {
+	expectRefs(t, Enumerate(t, s, storage.Filter{}), nil)
+
+	bs := putMany(t, s, 20)
+	got := Enumerate(t, s, storage.Filter{})
+	expectRefs(t, got, bs)
+
+	// schema blobs must be first
+	data := false
+	for _, sr := range got {
+		if sr.Schema() && data {
+			t.Error("schema blob enumerated after data blob")
+		}
+		data = data || !sr.Schema()
+	}
+}
+
+func testEnumerateAfter(t *testing.T, s storage.Storage) {
+	bs := putMany(t, s, 10)
+
+	for i := range bs {
+		got := Enumerate(t, s, storage.Filter{After: bs[i].ref.String()})
+		expectRefs(t, got, bs[i+1:])
+	}
+	// after does not need to be a valid ref
+	expectRefs(t, Enumerate(t, s, storage.Filter{After: "S:"}), bs)
+	expectRefs(t, Enumerate(t, s, storage.Filter{After: "d:"}), bs[len(bs)/2:])
+	expectRefs(t, Enumerate(t, s, storage.Filter{After: "e"}), nil)
+}
+
+func testEnumerateFilter(t *testing.T, s storage.Storage) {
+	bs := putMany(t, s, 10)
+	schema, data := bs[:len(bs)/2], bs[len(bs)/2:]
+
+	expectRefs(t, Enumerate(t, s, storage.Filter{ExcludeDataBlobs: true}), schema)
+	expectRefs(t, Enumerate(t, s, storage.Filter{ExcludeSchemaBlobs: true}), data)
+	expectRefs(t, Enumerate(t, s, storage.Filter{ExcludeSchemaBlobs: true, ExcludeDataBlobs: true}), nil)
+	expectRefs(t, Enumerate(t, s, storage.Filter{After: schema[2].ref.String(), ExcludeSchemaBlobs: true}), data)
+	expectRefs(t, Enumerate(t, s, storage.Filter{After: schema[2].ref.String(), ExcludeDataBlobs: true}), schema[3:])
+}
+
+func testEnumerateCanceled(t *testing.T, s storage.Storage) {
+	putMany(t, s, 10)
+
+	// the channel must be closed even if the context is canceled and
+	// nobody reads from it
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan blob.SizedRef)
+	errc := make(chan error, 1)
+	go func() { errc <- s.EnumerateBlobs(ctx, ch, storage.Filter{}) }()
+	<-ch
+	cancel()
+	select {
+	case <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("enumerate did not return after cancel")
+	}
+	for range ch {
+	}
+}
+
+func testRemove(t *testing.T, s storage.Storage) {
+	bs := putMany(t, s, 5)
+	missing, _ := Blob("missing", false)
+
+	// removing a mix of existing and missing blobs removes the existing
+	if err := s.RemoveBlobs(context.Background(), []blob.Ref{bs[0].ref, missing, bs[3].ref}); err != nil {
+		t.Error("remove:", err)
+	}
+	if err := s.RemoveBlobs(context.Background(), []blob.Ref{missing}); err != nil {
+		t.Error("remove of missing blob:", err)
+	}
+	if err := s.RemoveBlobs(context.Background(), nil); err != nil {
+		t.Error("remove of no blobs:", err)
+	}
+	for _, b := range []testBlob{bs[0], bs[3]} {
+		if _, _, err := s.GetBlobs(context.Background(), []blob.Ref{b.ref}); !os.IsNotExist(err) {
+			t.Error("expected removed blob to not exist, got:", err)
+		}
+	}
+	rest := append(append([]testBlob{}, bs[1:3]...), bs[4:]...)
+	expectRefs(t, Enumerate(t, s, storage.Filter{}), rest)
+	for _, b := range rest {
+		Get(t, s, b.ref, b.data)
+	}
+
+	// a removed blob can be put again
+	Put(t, s, bs[0].ref, bs[0].data)
+	Get(t, s, bs[0].ref, bs[0].data)
+}
+
+func testConcurrent(t *testing.T, s storage.Storage) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				br, d := Blob(strconv.Itoa(i)+"-"+strconv.Itoa(j), j%2 == 0)
+				sr, err := s.PutBlob(context.Background(), br, blob.Ref{}, bytes.NewReader(d))
+				if (err != nil && err != storage.ErrPending) || sr.Ref != br {
+					t.Error("put:", err)
+					return
+				}
+				Get(t, s, br, d)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if refs := Enumerate(t, s, storage.Filter{}); len(refs) != 8*20 {
+		t.Error("expected all blobs to be stored, got", len(refs))
+	}
+}
+
+func testGeneration(t *testing.T, s storage.Storage) {
+	g, ok := s.(storage.Generationer)
+	if !ok {
+		t.Skip("storage does not implement storage.Generationer")
+	}
+	_, r1, err := g.StorageGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, r2, err := g.StorageGeneration()
+	if err != nil || r1 != r2 || r1 == "" {
+		t.Error("expected a stable non-empty generation", r1, r2, err)
+	}
+	if err := g.ResetStorageGeneration(); err != nil {
+		t.Fatal(err)
+	}
+	_, r3, err := g.StorageGeneration()
+	if err != nil || r3 == r1 {
+		t.Error("expected a new generation after reset", r1, r3, err)
+	}
+}
@@ -33,7 +33,7 @@ func BenchmarkSequential(b *testing.B) {
 				os.Remove(fn)
 				s, err := Create(fn, Options{})
 				for err == nil {
-					_, err = s.Append("a", buf)
+					_, err = s.Append("a", buf, "")
 					no++
 				}
 				if err != ErrStreamFull {
@@ -57,7 +57,7 @@ func BenchmarkSequential(b *testing.B) {
 				os.Remove(fn)
 				s, err := Create(fn, Options{})
 				for err == nil {
-					_, err = s.Append("a", buf)
+					_, err = s.Append("a", buf, "")
 					if err != nil {
 						if err := s.Sync(); err != nil {
 							b.Error(err)
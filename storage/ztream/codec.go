@@ -0,0 +1,166 @@
+package ztream
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Zip compression methods of the codecs provided.
+const (
+	MethodStore   = 0
+	MethodDeflate = 8
+	MethodZstd    = 93
+)
+
+// A Codec compresses the data of entries, which are stored with the zip
+// compression method of the codec. The codecs used when appending are given
+// by Options.Codecs, and entries compressed by any of them or a registered
+// codec can be read. A Codec must be safe for concurrent use.
+type Codec interface {
+	// Method returns the zip compression method of the data compressed.
+	Method() uint16
+	NewCompressor() (Compressor, error)
+	NewDecompressor() (Decompressor, error)
+}
+
+// A Compressor compresses the data written to it to the writer it was last
+// reset to. Close flushes the compressed data, without closing the writer.
+type Compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// A Decompressor decompresses the data read from the reader it was last reset
+// to, holding n bytes of compressed data.
+type Decompressor interface {
+	io.Reader
+	Reset(r io.Reader, n int64) error
+}
+
+var errUnknownMethod = errors.New("zstream: unknown compression method")
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[uint16]Codec{
+		MethodDeflate: Deflate(flate.BestSpeed),
+		MethodZstd:    Zstd(1),
+	}
+)
+
+// RegisterCodec registers c such that entries compressed with its method can
+// be read, replacing any codec registered for the method. Deflate and zstd
+// are registered by default.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Method()] = c
+}
+
+// codec returns the codec to use for reading data compressed with method,
+// or nil if there is none.
+func (s *Stream) codec(method uint16) Codec {
+	for _, c := range s.opt.Codecs {
+		if c.Method() == method {
+			return c
+		}
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[method]
+}
+
+// decompressors holds a decompressor for each method used, to reuse them.
+type decompressors map[uint16]Decompressor
+
+// get returns a decompressor reset to read n bytes of data compressed with
+// method from r.
+func (d decompressors) get(s *Stream, method uint16, r io.Reader, n int64) (Decompressor, error) {
+	dec, ok := d[method]
+	if !ok {
+		c := s.codec(method)
+		if c == nil {
+			return nil, errUnknownMethod
+		}
+		var err error
+		if dec, err = c.NewDecompressor(); err != nil {
+			return nil, err
+		}
+		d[method] = dec
+	}
+	return dec, dec.Reset(r, n)
+}
+
+type deflateCodec int
+
+// Deflate returns a codec for deflate at the given level of the flate
+// package.
+func Deflate(level int) Codec {
+	return deflateCodec(level)
+}
+
+func (c deflateCodec) Method() uint16 {
+	return MethodDeflate
+}
+
+func (c deflateCodec) NewCompressor() (Compressor, error) {
+	return flate.NewWriter(nil, int(c))
+}
+
+func (c deflateCodec) NewDecompressor() (Decompressor, error) {
+	return &deflateDecompressor{flate.NewReader(nil)}, nil
+}
+
+type deflateDecompressor struct {
+	io.ReadCloser
+}
+
+func (d *deflateDecompressor) Reset(r io.Reader, n int64) error {
+	return d.ReadCloser.(flate.Resetter).Reset(r, nil)
+}
+
+type zstdCodec int
+
+// Zstd returns a codec for zstd at the given level, as given by the zstd
+// command line tool.
+func Zstd(level int) Codec {
+	return zstdCodec(level)
+}
+
+func (c zstdCodec) Method() uint16 {
+	return MethodZstd
+}
+
+func (c zstdCodec) NewCompressor() (Compressor, error) {
+	// the zip crc code is enough
+	return zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(int(c))),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderCRC(false),
+		zstd.WithLowerEncoderMem(true))
+}
+
+func (c zstdCodec) NewDecompressor() (Decompressor, error) {
+	d, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdDecompressor{d}, nil
+}
+
+// zstdDecompressor streams the data through a decoder of its own, which with
+// a concurrency of one decodes as it is read without running any goroutines.
+type zstdDecompressor struct {
+	d *zstd.Decoder
+}
+
+func (d *zstdDecompressor) Reset(r io.Reader, n int64) error {
+	return d.d.Reset(io.LimitReader(r, n))
+}
+
+func (d *zstdDecompressor) Read(p []byte) (int, error) {
+	return d.d.Read(p)
+}
@@ -0,0 +1,156 @@
+package ztream
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	// so that the zip package can check what we write
+	zip.RegisterDecompressor(MethodZstd, func(r io.Reader) io.ReadCloser {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return ioutil.NopCloser(r)
+		}
+		return d.IOReadCloser()
+	})
+}
+
+func TestZstd(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	opt := tOpt
+	opt.Codecs = []Codec{Zstd(3)}
+	s, _ := Create(fn, opt)
+	d1, d2, d3 := data(20000, true), data(20000, false), bytes.Repeat([]byte("compono "), 12500)
+	e1, err := s.Append("test1", d1, "")
+	if err != nil {
+		t.Error(err)
+	}
+	e2, err := s.Append("test2", d2, "")
+	if err != nil {
+		t.Error(err)
+	}
+	e3, err := s.AppendFrom("test3", bytes.NewReader(d3), int64(len(d3)), "")
+	if err != nil {
+		t.Error(err)
+	}
+	if e1.CompressedSize >= e1.UncompressedSize || e2.CompressedSize != e2.UncompressedSize || e3.CompressedSize >= e3.UncompressedSize {
+		t.Error("unexpected compression", e1, e2, e3)
+	}
+	s.Sync()
+	goroutines := runtime.NumGoroutine()
+	for _, c := range []struct {
+		e Entry
+		d []byte
+	}{{e1, d1}, {e2, d2}, {e3, d3}} {
+		buf := make([]byte, c.e.UncompressedSize)
+		if err := s.Read(c.e, buf); err != nil || !bytes.Equal(buf, c.d) {
+			t.Error("read not equal", c.e.Name, err)
+		}
+		r, err := s.Open(c.e)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if buf, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(buf, c.d) {
+			t.Error("open not equal", c.e.Name, err)
+		}
+		r.Close()
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Error("expected decompressing to run no goroutines", n-goroutines)
+	}
+	s.Close()
+
+	validZip(t, fn, 3)
+	contains(t, fn, "test1", d1)
+	contains(t, fn, "test3", d3)
+
+	// reading the data when loading from the directory as well as scanning
+	// the data, for which the default options are enough
+	for _, v := range []Verifier{nil, new(ver)} {
+		opt := tOpt
+		opt.Verifier = v
+		s, err := Open(fn, opt)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		c, err := s.Contents()
+		if err != nil || len(c) != 3 || c[0] != e1 || c[1] != e2 || c[2] != e3 {
+			t.Error("unexpected contents", c, err)
+		}
+		s.Close()
+	}
+}
+
+func TestChooseCodec(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	// zstd compresses the long repeats better than deflate at its fastest
+	opt := tOpt
+	opt.Codecs = []Codec{Deflate(1), Zstd(3)}
+	s, _ := Create(fn, opt)
+	defer s.Close()
+	d := bytes.Repeat(data(300, false), 100)
+	if _, err := s.Append("test", d, ""); err != nil {
+		t.Error(err)
+	}
+	if m := s.pending[0].method; m != MethodZstd {
+		t.Error("expected zstd to be chosen", m)
+	}
+}
+
+// otherCodec is deflate under another method.
+type otherCodec struct{ Codec }
+
+func (otherCodec) Method() uint16 { return 1313 }
+
+func TestUnknownMethod(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	d := bytes.Repeat([]byte("compono "), 2500)
+	e, _ := s.Append("test1", d, "")
+	s.Close()
+
+	// change the method of the entry to one that is not registered
+	f, _ := os.OpenFile(fn, os.O_RDWR, 0)
+	f.WriteAt([]byte{0x21, 0x05}, e.headerOffset()+8)
+	f.Close()
+	s, _ = Open(fn, tOpt)
+	if err := s.Read(e, make([]byte, len(d))); err == nil {
+		t.Error("expected an unknown method to fail")
+	}
+	s.Close()
+
+	RegisterCodec(otherCodec{Deflate(1)})
+	defer func() {
+		codecsMu.Lock()
+		delete(codecs, 1313)
+		codecsMu.Unlock()
+	}()
+	o := tOpt
+	o.Verifier = new(ver)
+	s, err := Open(fn, o)
+	if err != nil {
+		t.Error("expected a registered method to be read", err)
+		t.FailNow()
+	}
+	defer s.Close()
+	buf := make([]byte, len(d))
+	if err := s.Read(e, buf); err != nil || !bytes.Equal(buf, d) {
+		t.Error("read not equal", err)
+	}
+}
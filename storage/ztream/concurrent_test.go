@@ -0,0 +1,166 @@
+package ztream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentRead reads entries from several goroutines while appending,
+// and is intended to be run with -race.
+func TestConcurrentRead(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	defer s.Close()
+	var entries []Entry
+	var datas [][]byte
+	for i := 0; i < 20; i++ {
+		d := data(2000, i%2 == 0)
+		e, err := s.Append("test"+string(rune('a'+i)), d, "")
+		if err != nil {
+			t.Error(err)
+		}
+		entries, datas = append(entries, e), append(datas, d)
+	}
+	s.Sync()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			buf := make([]byte, 2000)
+			for n := 0; n < 5; n++ {
+				// every other goroutine reads sequentially to use the fast path
+				for i := range entries {
+					if g%2 == 1 {
+						i = (i*7 + g) % len(entries)
+					}
+					if err := s.Read(entries[i], buf); err != nil || !bytes.Equal(buf, datas[i]) {
+						t.Error("read not equal", i, err)
+					}
+				}
+				r, err := s.Open(entries[g])
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, datas[g]) {
+					t.Error("open not equal", g, err)
+				}
+				r.Close()
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if _, err := s.Append("appended"+string(rune('a'+i)), data(2000, i%2 == 0), ""); err != nil {
+				t.Error(err)
+			}
+			if err := s.Sync(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	// a read completes while an append waits for its data
+	pr, pw := io.Pipe()
+	appended := make(chan error)
+	go func() {
+		_, err := s.AppendFrom("blocked", pr, 4000, "")
+		appended <- err
+	}()
+	pw.Write(data(2000, false))
+	read := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 2000)
+		read <- s.Read(entries[0], buf)
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected a read not to wait for an append")
+	}
+	pw.Write(data(2000, false))
+	if err := <-appended; err != nil {
+		t.Error(err)
+	}
+}
+
+// blockingSync is a File whose Sync waits until released.
+type blockingSync struct {
+	File
+	syncing chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingSync) Sync() error {
+	select {
+	case f.syncing <- struct{}{}:
+		<-f.release
+	default:
+	}
+	return f.File.Sync()
+}
+
+// TestConcurrentSync checks that appends and reads continue while syncing,
+// and that what is appended meanwhile is left for the next sync.
+func TestConcurrentSync(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	f := &blockingSync{syncing: make(chan struct{}), release: make(chan struct{})}
+	opt := tOpt
+	opt.OpenFile = func(name string, flag int, perm os.FileMode) (File, error) {
+		var err error
+		f.File, err = os.OpenFile(name, flag, perm)
+		return f, err
+	}
+	s, _ := Create(fn, opt)
+	defer s.Close()
+	d1 := data(2000, false)
+	e1, _ := s.Append("test1", d1, "")
+
+	synced := make(chan error)
+	go func() { synced <- s.Sync() }()
+	<-f.syncing
+	done := make(chan error, 1)
+	go func() {
+		if _, err := s.Append("test2", data(2000, false), ""); err != nil {
+			done <- err
+			return
+		}
+		done <- s.Read(e1, make([]byte, 2000))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected appends and reads not to wait for a sync")
+	}
+	close(f.release)
+	if err := <-synced; err != nil {
+		t.Error(err)
+	}
+	if c, _ := s.Contents(); len(c) != 1 || c[0].Name != "test1" {
+		t.Error("expected only the entry appended before syncing to be synced", c)
+	}
+	s.Sync()
+	if c, _ := s.Contents(); len(c) != 2 {
+		t.Error("expected both entries to be synced", c)
+	}
+}
@@ -0,0 +1,454 @@
+package ztream
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A memFS holds files in memory and simulates what survives a crash. The
+// write and sync operations are counted, and the operation failAt fails as
+// given by fault, as do all later operations since we then crash.
+type memFS struct {
+	files  map[string]*memFile
+	rand   *rand.Rand
+	ops    int
+	failAt int
+	fault  int
+	failed bool
+}
+
+const (
+	faultNoSpace    = iota // nothing is written, ENOSPC
+	faultShortWrite        // part of the data is written, ENOSPC
+	faultIO                // the write or sync may be partially done, EIO
+	noFaults
+)
+
+type write struct {
+	offset int64
+	data   []byte
+}
+
+// memFile is a File in a memFS.
+type memFile struct {
+	fs      *memFS
+	name    string
+	data    []byte  // the data as read
+	synced  []byte  // the data as of the last sync
+	pending []write // writes since the last sync
+	pos     int64
+}
+
+func newMemFS(seed int64) *memFS {
+	return &memFS{files: map[string]*memFile{}, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, ok := fs.files[name]
+	if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 && ok {
+		return nil, os.ErrExist
+	}
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		f = &memFile{fs: fs, name: name}
+		fs.files[name] = f
+	}
+	f.pos = 0
+	return f, nil
+}
+
+// op counts an operation, returning the error to fail it with if any.
+func (fs *memFS) op() error {
+	fs.ops++
+	if fs.failAt > 0 && fs.ops >= fs.failAt {
+		fs.failed = true
+		if fs.fault == faultIO {
+			return syscall.EIO
+		}
+		return syscall.ENOSPC
+	}
+	return nil
+}
+
+// crash returns a new memFS holding what may be found on disk after a crash.
+// Writes not synced may be lost, or torn such that only a part is written.
+func (fs *memFS) crash() *memFS {
+	nfs := newMemFS(fs.rand.Int63())
+	for name, f := range fs.files {
+		data := append([]byte(nil), f.synced...)
+		for _, w := range f.pending {
+			switch fs.rand.Intn(3) {
+			case 0:
+				continue
+			case 1:
+				w.data = w.data[:fs.rand.Intn(len(w.data)+1)]
+			}
+			data = writeAt(data, w.data, w.offset)
+		}
+		nfs.files[name] = &memFile{fs: nfs, name: name, data: data, synced: append([]byte(nil), data...)}
+	}
+	return nfs
+}
+
+func writeAt(data, p []byte, offset int64) []byte {
+	if end := offset + int64(len(p)); end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	copy(data[offset:], p)
+	return data
+}
+
+func (f *memFile) write(p []byte, offset int64) (int, error) {
+	if err := f.fs.op(); err != nil {
+		n := 0
+		if f.fs.fault == faultShortWrite {
+			n = f.fs.rand.Intn(len(p) + 1)
+		}
+		f.data = writeAt(f.data, p[:n], offset)
+		m := n
+		if f.fs.fault == faultIO {
+			// the write may reach the disk even if it failed
+			m = len(p)
+		}
+		f.pending = append(f.pending, write{offset, append([]byte(nil), p[:m]...)})
+		return n, err
+	}
+	f.data = writeAt(f.data, p, offset)
+	f.pending = append(f.pending, write{offset, append([]byte(nil), p...)})
+	return len(p), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	n, err := f.write(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, offset int64) (int, error) {
+	return f.write(p, offset)
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("memfile: negative offset")
+	}
+	if offset >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return f.pos, errors.New("memfile: negative offset")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.fs.op(); err != nil {
+		return err
+	}
+	// a ztream is only truncated to grow it when created, so that is all
+	// we simulate
+	f.data = writeAt(f.data, nil, size)
+	f.pending = append(f.pending, write{size, nil})
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	if err := f.fs.op(); err != nil {
+		return err
+	}
+	f.synced = append(f.synced[:0], f.data...)
+	f.pending = nil
+	return nil
+}
+
+func (f *memFile) Name() string               { return f.name }
+func (f *memFile) Stat() (os.FileInfo, error) { return memInfo{f}, nil }
+func (f *memFile) Close() error               { return nil }
+
+type memInfo struct{ f *memFile }
+
+func (i memInfo) Name() string       { return i.f.name }
+func (i memInfo) Size() int64        { return int64(len(i.f.data)) }
+func (i memInfo) Mode() os.FileMode  { return 0777 }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return false }
+func (i memInfo) Sys() interface{}   { return nil }
+
+// crashRun is the outcome of running a workload until the first failure.
+type crashRun struct {
+	data     map[string][]byte // all entries appended
+	synced   map[string]bool   // entries appended and synced
+	wiped    map[string]bool   // entries wiped
+	wiping   map[string]bool   // entries being wiped when failing
+	failedIn string            // the operation that failed, if any
+}
+
+// crashWorkload appends, syncs, wipes and closes a stream, stopping at the
+// first error.
+func crashWorkload(fs *memFS) *crashRun {
+	run := &crashRun{data: map[string][]byte{}, synced: map[string]bool{}, wiped: map[string]bool{}}
+	opt := tOpt
+	opt.OpenFile = fs.OpenFile
+	s, err := Create("pack", opt)
+	if err != nil {
+		run.failedIn = "create"
+		return run
+	}
+	var appended []string
+	appendN := func(n int) bool {
+		for i := 0; i < n; i++ {
+			name := "test" + strconv.Itoa(len(run.data))
+			d := data(500+fs.rand.Intn(5000), len(run.data)%2 == 0)
+			if len(run.data) == 5 {
+				d = nil // an entry without data is only checked by its header
+			}
+			run.data[name] = d
+			if _, err := s.Append(name, d, ""); err != nil {
+				run.failedIn = "append"
+				return false
+			}
+			appended = append(appended, name)
+		}
+		if err := s.Sync(); err != nil {
+			run.failedIn = "sync"
+			return false
+		}
+		for _, name := range appended {
+			run.synced[name] = true
+		}
+		return true
+	}
+	wipe := func(names ...string) bool {
+		run.wiping = map[string]bool{}
+		for _, name := range names {
+			run.wiping[name] = true
+		}
+		for _, err := range s.WipeMany(names) {
+			if err != nil {
+				run.failedIn = "wipe"
+				return false
+			}
+		}
+		for _, name := range names {
+			run.wiped[name] = true
+		}
+		run.wiping = nil
+		return true
+	}
+
+	if !appendN(3) || !appendN(2) || !wipe("test1") || !appendN(2) || !wipe("test4", "test0", "test6") {
+		return run
+	}
+	if err := s.Close(); err != nil {
+		run.failedIn = "close"
+		return run
+	}
+
+	// reopen and append to a closed stream
+	s, err = Open("pack", opt)
+	if err != nil {
+		run.failedIn = "open"
+		return run
+	}
+	if !appendN(2) || !wipe("test3") {
+		return run
+	}
+	if err := s.Close(); err != nil {
+		run.failedIn = "close"
+	}
+	return run
+}
+
+// anyName is a Verifier matching any name.
+type anyName struct{}
+
+func (anyName) Write(p []byte) (int, error) { return len(p), nil }
+func (anyName) Reset()                      {}
+func (anyName) Match(name string) bool      { return true }
+
+// checkCrash checks the stream found after a crash against what was done.
+func checkCrash(t *testing.T, fs *memFS, run *crashRun) {
+	if run.failedIn == "create" {
+		return
+	}
+	opt := tOpt
+	opt.OpenFile = fs.OpenFile
+	s, err := Open("pack", opt)
+	if err != nil {
+		t.Error("open after crash:", err)
+		return
+	}
+	defer s.Close()
+	c, err := s.Contents()
+	if _, ok := err.(*CorruptError); ok {
+		// entries appended after a torn one made it to disk, which can only
+		// be told from corruption by verifying
+		opt.Verifier, opt.ContinueOnError = anyName{}, true
+		s2, verr := Open("pack", opt)
+		if _, ok := verr.(*VerifyError); !ok {
+			t.Error("expected a verify error after", err, "got", verr)
+			return
+		}
+		defer s2.Close()
+		s = s2
+		c, err = s.Contents()
+	}
+	if err != nil {
+		t.Error("load after crash:", err)
+		return
+	}
+
+	found := map[string]bool{}
+	for _, e := range c {
+		found[e.Name] = true
+		d, ok := run.data[e.Name]
+		if !ok || run.wiped[e.Name] {
+			t.Error("unexpected entry found:", e.Name)
+			continue
+		}
+		buf := make([]byte, e.UncompressedSize)
+		if err := s.Read(e, buf); err != nil || !bytes.Equal(buf, d) {
+			t.Error("entry not intact:", e.Name, err)
+		}
+	}
+	for name := range run.synced {
+		if !found[name] && !run.wiped[name] && !run.wiping[name] {
+			t.Error("synced entry lost:", name)
+		}
+	}
+
+	// the data of wiped entries must be gone, as must that of an entry being
+	// wiped unless still found. The incompressible ones are stored as is so
+	// we can look for them.
+	image := fs.files["pack"].data
+	for name, d := range run.data {
+		if (run.wiped[name] || run.wiping[name] && !found[name]) && len(d) > 0 && bytes.Contains(image, d[len(d)-64:]) {
+			t.Error("wiped data found:", name)
+		}
+	}
+}
+
+// TestCrash runs a workload failing at every write and sync, as well as not
+// failing at all, with every kind of fault. After a crash every synced entry
+// must be intact, and no wiped entries found.
+func TestCrash(t *testing.T) {
+	for fault := faultNoSpace; fault <= noFaults; fault++ {
+		for failAt := 1; ; failAt++ {
+			fs := newMemFS(int64(failAt*10 + fault))
+			if fault != noFaults {
+				fs.fault, fs.failAt = fault, failAt
+			}
+			run := crashWorkload(fs)
+			for i := 0; i < 3; i++ {
+				checkCrash(t, fs.crash(), run)
+			}
+			if t.Failed() {
+				t.Log("fault", fault, "at operation", failAt, "in", run.failedIn)
+				t.FailNow()
+			}
+			if !fs.failed {
+				break
+			}
+		}
+	}
+}
+
+// TestTornTail checks that a bad entry is only taken to be torn by a crash
+// when no valid entry follows it, also in packs never closed, and then
+// skipped when loading without a verifier, also if it holds what looks like a
+// later entry.
+func TestTornTail(t *testing.T) {
+	for _, c := range []struct {
+		flip    int  // the entry to flip a bit of
+		closed  bool // if the entries are closed before appending one more
+		zip     bool // if the data of the entries is a zip file
+		entries int
+	}{{2, false, false, 2}, {2, false, true, 2}, {1, false, false, -1}, {1, false, true, -1}, {1, true, false, -1}} {
+		fs := newMemFS(1)
+		opt := tOpt
+		opt.OpenFile = fs.OpenFile
+		s, _ := Create("pack", opt)
+		var es []Entry
+		for i := 0; i < 3; i++ {
+			d := data(1000, false)
+			if c.zip {
+				d = zipFile(t, d)
+			}
+			e, _ := s.Append("test"+strconv.Itoa(i), d, "")
+			es = append(es, e)
+		}
+		if c.closed {
+			s.Close()
+			s, _ = Open("pack", opt)
+			s.Append("test3", data(1000, false), "")
+		}
+		s.Sync()
+		// the end of a zip file is its directory, after the local header
+		e := es[c.flip]
+		fs.files["pack"].data[e.Offset+e.CompressedSize-10] ^= 1
+
+		s, err := Open("pack", opt)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		got, err := s.Contents()
+		if c.entries < 0 {
+			if _, ok := err.(*CorruptError); !ok {
+				t.Error("expected a bad entry followed by others to be corrupt", err)
+			}
+		} else if err != nil || len(got) != c.entries {
+			t.Error("expected a torn tail to be skipped", len(got), err)
+		}
+		s.Close()
+	}
+}
+
+// zipFile returns a zip file storing d.
+func zipFile(t *testing.T, d []byte) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "inner", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(d)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,279 @@
+package ztream
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// MethodDeflateDict is the compression method of data compressed by deflate
+// with a preset dictionary. The data starts with the id of the dictionary as
+// a uvarint.
+const MethodDeflateDict = 0x6f64
+
+// MaxDictionarySize is the largest dictionary deflate can make use of.
+const MaxDictionarySize = 32 << 10
+
+var errUnknownDictionary = errors.New("zstream: unknown compression dictionary")
+
+// A Dictionary is a preset dictionary to compress small entries with, which
+// must not be modified once added to a set of Dictionaries.
+type Dictionary struct {
+	ID   uint32 // > 0, a dictionary of a larger id is newer
+	Data []byte
+}
+
+// Dictionaries is a set of dictionaries, the newest of which is used when
+// compressing. It is safe for concurrent use.
+type Dictionaries struct {
+	m      sync.RWMutex
+	dicts  map[uint32]*Dictionary
+	latest *Dictionary
+}
+
+// NewDictionaries returns a set of the given dictionaries.
+func NewDictionaries(dicts ...Dictionary) *Dictionaries {
+	ds := &Dictionaries{dicts: make(map[uint32]*Dictionary)}
+	for _, d := range dicts {
+		ds.Add(d)
+	}
+	return ds
+}
+
+// Add adds d to the set, replacing any dictionary of the same id.
+func (ds *Dictionaries) Add(d Dictionary) {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+	ds.dicts[d.ID] = &d
+	if ds.latest == nil || d.ID >= ds.latest.ID {
+		ds.latest = &d
+	}
+}
+
+// Get returns the dictionary of the given id, or nil if there is none.
+func (ds *Dictionaries) Get(id uint32) *Dictionary {
+	ds.m.RLock()
+	defer ds.m.RUnlock()
+	return ds.dicts[id]
+}
+
+// Latest returns the newest dictionary, or nil if there is none.
+func (ds *Dictionaries) Latest() *Dictionary {
+	ds.m.RLock()
+	defer ds.m.RUnlock()
+	return ds.latest
+}
+
+type deflateDictCodec struct {
+	level int
+	dicts *Dictionaries
+}
+
+// DeflateDict returns a codec for deflate at the given level of the flate
+// package, compressing with the newest of dicts and decompressing with the
+// one referred to by the data. The fastest levels do not use dictionaries,
+// and are raised to flate.DefaultCompression. A Stream does not choose the
+// codec until there is a dictionary to compress with.
+func DeflateDict(level int, dicts *Dictionaries) Codec {
+	if !dictLevel(level) {
+		level = flate.DefaultCompression
+	}
+	return deflateDictCodec{level, dicts}
+}
+
+// dictLevel reports whether the flate level uses dictionaries.
+func dictLevel(level int) bool {
+	return level != flate.HuffmanOnly && level != flate.NoCompression && level != flate.BestSpeed
+}
+
+func (c deflateDictCodec) Method() uint16 {
+	return MethodDeflateDict
+}
+
+func (c deflateDictCodec) NewCompressor() (Compressor, error) {
+	fw, err := flate.NewWriterDict(nil, c.level, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &deflateDictCompressor{c: c, fw: fw}, nil
+}
+
+func (c deflateDictCodec) NewDecompressor() (Decompressor, error) {
+	return &deflateDictDecompressor{dicts: c.dicts, fr: flate.NewReader(nil)}, nil
+}
+
+type deflateDictCompressor struct {
+	c      deflateDictCodec
+	dict   *Dictionary // the dictionary fw uses
+	fw     *flate.Writer
+	w      io.Writer
+	header bool // if the id of the dictionary has been written
+}
+
+func (c *deflateDictCompressor) Reset(w io.Writer) {
+	c.w, c.header = w, false
+	if d := c.c.dicts.Latest(); d != nil && d != c.dict {
+		// the level is already checked
+		c.fw, _ = flate.NewWriterDict(w, c.c.level, d.Data)
+		c.dict = d
+		return
+	}
+	c.fw.Reset(w)
+}
+
+func (c *deflateDictCompressor) writeHeader() error {
+	if c.header {
+		return nil
+	}
+	if c.dict == nil {
+		return errUnknownDictionary
+	}
+	var b [binary.MaxVarintLen32]byte
+	if _, err := c.w.Write(b[:binary.PutUvarint(b[:], uint64(c.dict.ID))]); err != nil {
+		return err
+	}
+	c.header = true
+	return nil
+}
+
+func (c *deflateDictCompressor) Write(p []byte) (int, error) {
+	if err := c.writeHeader(); err != nil {
+		return 0, err
+	}
+	return c.fw.Write(p)
+}
+
+func (c *deflateDictCompressor) Close() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	return c.fw.Close()
+}
+
+type deflateDictDecompressor struct {
+	dicts *Dictionaries
+	fr    io.ReadCloser
+}
+
+func (d *deflateDictDecompressor) Reset(r io.Reader, n int64) error {
+	id, err := binary.ReadUvarint(byteReader{r})
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	dict := d.dicts.Get(uint32(id))
+	if dict == nil || uint64(dict.ID) != id {
+		return errUnknownDictionary
+	}
+	return d.fr.(flate.Resetter).Reset(r, dict.Data)
+}
+
+func (d *deflateDictDecompressor) Read(p []byte) (int, error) {
+	return d.fr.Read(p)
+}
+
+// byteReader reads single bytes from a reader, without reading ahead.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// dictSegmentLen is the length of the substrings counted when training a
+// dictionary.
+const dictSegmentLen = 8
+
+// TrainDictionary returns a dictionary of at most size bytes holding the
+// substrings most common to the samples, for compressing data similar to
+// them. It returns nil if the samples have nothing in common.
+func TrainDictionary(samples [][]byte, size int) []byte {
+	if size > MaxDictionarySize {
+		size = MaxDictionarySize
+	}
+
+	// count the number of samples each segment is found in
+	freq := make(map[string]int)
+	for _, s := range samples {
+		seen := make(map[string]bool)
+		for i := 0; i+dictSegmentLen <= len(s); i++ {
+			g := string(s[i : i+dictSegmentLen])
+			if !seen[g] {
+				seen[g] = true
+				freq[g]++
+			}
+		}
+	}
+
+	// the candidates are the longest runs of segments found in more than one
+	// sample, scored by how common their segments are
+	type candidate struct {
+		data  []byte
+		score int
+	}
+	var cands []candidate
+	for _, s := range samples {
+		for i := 0; i+dictSegmentLen <= len(s); {
+			j, score := i, 0
+			for ; j+dictSegmentLen <= len(s); j++ {
+				f := freq[string(s[j:j+dictSegmentLen])]
+				if f < 2 {
+					break
+				}
+				score += f
+			}
+			if j == i {
+				i++
+				continue
+			}
+			cands = append(cands, candidate{s[i : j+dictSegmentLen-1], score})
+			i = j
+		}
+	}
+	sort.SliceStable(cands, func(i, j int) bool { return cands[i].score > cands[j].score })
+
+	// pick the best candidates mostly made of segments not already picked
+	picked := make(map[string]bool)
+	var parts [][]byte
+	total := 0
+	for _, c := range cands {
+		if total >= size {
+			break
+		}
+		segments, found := len(c.data)-dictSegmentLen+1, 0
+		for i := 0; i < segments; i++ {
+			if !picked[string(c.data[i:i+dictSegmentLen])] {
+				found++
+			}
+		}
+		if 2*found <= segments {
+			continue
+		}
+		for i := 0; i < segments; i++ {
+			picked[string(c.data[i:i+dictSegmentLen])] = true
+		}
+		parts = append(parts, c.data)
+		total += len(c.data)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	// the best parts are put last, as the closest are the cheapest to refer to
+	dict := make([]byte, 0, total)
+	for i := len(parts) - 1; i >= 0; i-- {
+		dict = append(dict, parts[i]...)
+	}
+	if len(dict) > size {
+		dict = dict[len(dict)-size:]
+	}
+	return dict
+}
@@ -0,0 +1,128 @@
+package ztream
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// schemaBlob returns a small json blob like those of the schema blobs of a
+// storage.
+func schemaBlob(r *rand.Rand) []byte {
+	ref := make([]byte, 28)
+	r.Read(ref)
+	return []byte(fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "fileName": "IMG_%04d.jpg", "unixMtime": "2020-%02d-%02dT10:%02d:00Z", "parts": [{"blobRef": "sha224-%x", "size": %d}]}`,
+		r.Intn(10000), 1+r.Intn(12), 1+r.Intn(28), r.Intn(60), ref, r.Intn(1<<20)))
+}
+
+func TestTrainDictionary(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, schemaBlob(r))
+	}
+	dict := TrainDictionary(samples, 1<<10)
+	if len(dict) == 0 || len(dict) > 1<<10 {
+		t.Error("unexpected dictionary size", len(dict))
+	}
+	if !bytes.Contains(dict, []byte(`"camliType": "file"`)) {
+		t.Error("expected the common parts in the dictionary", string(dict))
+	}
+	if d := TrainDictionary([][]byte{data(500, false), data(500, false)}, 1<<10); d != nil {
+		t.Error("expected no dictionary of random data", len(d))
+	}
+}
+
+func TestDictionaries(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	r := rand.New(rand.NewSource(1))
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, schemaBlob(r))
+	}
+	dicts := NewDictionaries(Dictionary{ID: 1, Data: TrainDictionary(samples, 1<<10)})
+	// the fastest level is raised only for the dictionary
+	opt := tOpt
+	opt.Dictionaries = dicts
+	s, _ := Create(fn, opt)
+	if c := s.opt.Codecs; c[0] != Deflate(flate.BestSpeed) || c[1].(deflateDictCodec).level != flate.DefaultCompression {
+		t.Error("expected the level raised only for the dictionary", c)
+	}
+	d1 := schemaBlob(r)
+	e1, err := s.Append("test1", d1, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if e1.CompressedSize >= e1.UncompressedSize/2 || s.pending[0].method != MethodDeflateDict {
+		t.Error("expected the dictionary to be used", e1)
+	}
+
+	// a newer dictionary is used once added, and the old one is still read
+	dicts.Add(Dictionary{ID: 2, Data: TrainDictionary(samples[100:], 1<<10)})
+	d2 := schemaBlob(r)
+	e2, err := s.Append("test2", d2, "")
+	if err != nil {
+		t.Error(err)
+	}
+	s.Close()
+
+	s, err = Open(fn, opt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for _, c := range []struct {
+		e Entry
+		d []byte
+		v byte
+	}{{e1, d1, 1}, {e2, d2, 2}} {
+		buf := make([]byte, c.e.UncompressedSize)
+		if err := s.Read(c.e, buf); err != nil || !bytes.Equal(buf, c.d) {
+			t.Error("read not equal", c.e.Name, err)
+		}
+		v := make([]byte, 1)
+		s.file.ReadAt(v, c.e.Offset)
+		if v[0] != c.v {
+			t.Error("expected dictionary", c.v, "got", v[0])
+		}
+	}
+	s.Close()
+
+	// without the dictionaries the entries can not be read
+	s, _ = Open(fn, tOpt)
+	defer s.Close()
+	if err := s.Read(e1, make([]byte, e1.UncompressedSize)); err == nil {
+		t.Error("expected a missing dictionary to fail")
+	}
+	opt.Dictionaries = NewDictionaries(Dictionary{ID: 2, Data: dicts.Get(2).Data})
+	s2, _ := Open(fn, opt)
+	defer s2.Close()
+	if err := s2.Read(e1, make([]byte, e1.UncompressedSize)); err != errUnknownDictionary {
+		t.Error("expected an unknown dictionary", err)
+	}
+}
+
+func TestNoDictionary(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	// until there is a dictionary plain deflate is used
+	opt := tOpt
+	opt.Dictionaries = NewDictionaries()
+	s, err := Create(fn, opt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer s.Close()
+	if _, err := s.Append("test1", bytes.Repeat([]byte("compono "), 2500), ""); err != nil {
+		t.Error(err)
+	}
+	if m := s.pending[0].method; m != MethodDeflate {
+		t.Error("expected deflate without a dictionary", m)
+	}
+}
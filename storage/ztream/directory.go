@@ -0,0 +1,211 @@
+package ztream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// loadDirectory loads the entries from the central directory written when
+// the stream was last closed, instead of scanning all local file headers. It
+// reports whether the directory was found and consistent with the file, and
+// that no entries have been appended after it was written. If not the caller
+// is expected to scan the file. The caller is expected to hold a write lock.
+func (s *Stream) loadDirectory() bool {
+	entries, end, ok := s.readDirectory()
+	if !ok {
+		return false
+	}
+
+	// entries appended after the directory was written are found after the
+	// last entry, possibly after wiped ranges.
+	buf := make([]byte, bufferSize+maxExtraLength)
+	for {
+		lfh, err := s.decodeFileHeader(end, buf, io.NewSectionReader(s.file, end, s.opt.FileSize-end))
+		if err != nil || lfh != nil && !lfh.wiped() {
+			return false
+		}
+		if lfh == nil {
+			break
+		}
+		end += lfh.size()
+	}
+
+	s.entries = entries
+	return true
+}
+
+// readDirectory reads the central directory written when the stream was last
+// closed, returning its entries and the end of the data of the last one. It
+// reports whether the directory was found and consistent with the file. The
+// caller is expected to hold a write lock.
+func (s *Stream) readDirectory() (entries []entry, end int64, ok bool) {
+	var tail [directory64EndLen + directory64LocateLen + directoryEndLen]byte
+	if _, err := s.file.ReadAt(tail[:], s.opt.FileSize-int64(len(tail))); err != nil {
+		return nil, 0, false
+	}
+	noFiles, size, offset, ok := decodeDirectoryEnd(tail[:])
+	if !ok || noFiles > s.opt.FileSize/46 || s.zip64End(int(noFiles)) != isZip64End(tail[:]) {
+		return nil, 0, false
+	}
+	start := s.opt.FileSize - s.directoryLen(int(noFiles), size)
+	if noFiles == 0 && (size != 0 || offset != 0) || noFiles > 0 && offset != start {
+		return nil, 0, false
+	}
+
+	records := make([]byte, size)
+	if _, err := s.file.ReadAt(records, start); err != nil {
+		return nil, 0, false
+	}
+	entries = make([]entry, 0, noFiles)
+	for i := int64(0); i < noFiles; i++ {
+		e, n, ok := decodeDirectoryHeader(records)
+		if !ok || e.header < end || e.method != MethodStore && s.codec(e.method) == nil {
+			return nil, 0, false
+		}
+		end = e.Offset + e.CompressedSize
+		if end > start {
+			return nil, 0, false
+		}
+		entries = append(entries, e)
+		records = records[n:]
+	}
+	if len(records) != 0 {
+		return nil, 0, false
+	}
+	return entries, end, true
+}
+
+// clearDirectory overwrites the central directory and end records and syncs
+// them, such that the directory is not trusted by loadDirectory until it has
+// been written again, and the names in it are gone if an entry is then wiped.
+// If the end record is not found only where it would be is overwritten. The
+// caller is expected to hold a write lock.
+func (s *Stream) clearDirectory() error {
+	var tail [directory64EndLen + directory64LocateLen + directoryEndLen]byte
+	if _, err := s.file.ReadAt(tail[:], s.opt.FileSize-int64(len(tail))); err != nil {
+		return err
+	}
+	l := int64(directoryEndLen)
+	if noFiles, size, _, ok := decodeDirectoryEnd(tail[:]); ok && noFiles <= s.opt.FileSize/46 && size < s.opt.FileSize {
+		if dl := s.directoryLen(int(noFiles), size); dl <= s.opt.FileSize {
+			l = dl
+		}
+	}
+	zeros := make([]byte, bufferSize)
+	for offset := s.opt.FileSize - l; offset < s.opt.FileSize; offset += int64(len(zeros)) {
+		if n := s.opt.FileSize - offset; n < int64(len(zeros)) {
+			zeros = zeros[:n]
+		}
+		if _, err := s.file.WriteAt(zeros, offset); err != nil {
+			return err
+		}
+	}
+	return s.file.Sync()
+}
+
+// decodeDirectoryEnd decodes the end of central directory record at the end
+// of tail, and the zip64 records before it if it refers to them. It returns
+// the number of entries, the size and offset of the central directory, and
+// if it was found.
+func decodeDirectoryEnd(tail []byte) (noFiles, size, offset int64, ok bool) {
+	end := tail[len(tail)-directoryEndLen:]
+	if !bytes.Equal(end[:4], directoryEndStream) || binary.LittleEndian.Uint16(end[20:]) != 2 {
+		return 0, 0, 0, false
+	}
+	if !isZip64End(tail) {
+		return int64(binary.LittleEndian.Uint16(end[10:])),
+			int64(binary.LittleEndian.Uint32(end[12:])),
+			int64(binary.LittleEndian.Uint32(end[16:])), true
+	}
+
+	l := tail[len(tail)-directoryEndLen-directory64LocateLen:]
+	rec := tail[len(tail)-directoryEndLen-directory64LocateLen-directory64EndLen:]
+	if !bytes.Equal(l[:4], directory64LocatorStream) || !bytes.Equal(rec[:4], directory64EndStream) {
+		return 0, 0, 0, false
+	}
+	noFiles = int64(binary.LittleEndian.Uint64(rec[32:]))
+	size = int64(binary.LittleEndian.Uint64(rec[40:]))
+	offset = int64(binary.LittleEndian.Uint64(rec[48:]))
+	if noFiles < 0 || size < 0 || offset < 0 || int64(binary.LittleEndian.Uint64(l[8:])) != offset+size {
+		return 0, 0, 0, false
+	}
+	return noFiles, size, offset, true
+}
+
+// isZip64End reports whether the end of central directory record at the end
+// of tail refers to the zip64 records.
+func isZip64End(tail []byte) bool {
+	end := tail[len(tail)-directoryEndLen:]
+	return binary.LittleEndian.Uint16(end[10:]) == uint16max ||
+		binary.LittleEndian.Uint32(end[12:]) == uint32max ||
+		binary.LittleEndian.Uint32(end[16:]) == uint32max
+}
+
+// decodeDirectoryHeader decodes the central directory header at the start of
+// b, as written by encodeDirectoryHeader. It returns the entry, the size of
+// the header and if it was valid.
+func decodeDirectoryHeader(b []byte) (e entry, n int, ok bool) {
+	if len(b) < 46 || !bytes.Equal(b[:4], directoryHeaderStream) {
+		return e, 0, false
+	}
+	version := binary.LittleEndian.Uint16(b[6:])
+	if version != version20 && version != version45 || binary.LittleEndian.Uint16(b[8:]) != 1<<11 {
+		return e, 0, false
+	}
+	e.method = binary.LittleEndian.Uint16(b[10:])
+	e.modTime = binary.LittleEndian.Uint16(b[12:])
+	e.modDate = binary.LittleEndian.Uint16(b[14:])
+	e.crc = binary.LittleEndian.Uint32(b[16:])
+	compressedSize := binary.LittleEndian.Uint32(b[20:])
+	uncompressedSize := binary.LittleEndian.Uint32(b[24:])
+	nameLen := int(binary.LittleEndian.Uint16(b[28:]))
+	extraLen := int(binary.LittleEndian.Uint16(b[30:]))
+	if binary.LittleEndian.Uint16(b[32:]) != 0 || nameLen > maxNameLength {
+		return e, 0, false
+	}
+	offset := binary.LittleEndian.Uint32(b[42:])
+	n = 46 + nameLen + extraLen
+	if len(b) < n {
+		return e, 0, false
+	}
+	e.Name = string(b[46 : 46+nameLen])
+
+	e.UncompressedSize = int64(uncompressedSize)
+	e.CompressedSize = int64(compressedSize)
+	e.header = int64(offset)
+	var zip64 []byte
+	for extra := b[46+nameLen : n]; len(extra) >= 4; {
+		id, l := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if l > len(extra)-4 {
+			return e, 0, false
+		}
+		switch id {
+		case zip64ExtraID:
+			zip64 = extra[4 : 4+l]
+		case extraID:
+			e.Extra = string(extra[4 : 4+l])
+		}
+		extra = extra[4+l:]
+	}
+	// the order of the fields is given by the specification
+	for _, v := range []*int64{&e.UncompressedSize, &e.CompressedSize, &e.header} {
+		if *v != uint32max {
+			continue
+		}
+		if len(zip64) < 8 {
+			return e, 0, false
+		}
+		*v = int64(binary.LittleEndian.Uint64(zip64))
+		zip64 = zip64[8:]
+	}
+
+	if e.CompressedSize < 0 || e.UncompressedSize < 0 || e.header < 0 {
+		return e, 0, false
+	}
+	if e.method != MethodStore && e.CompressedSize == 0 || (e.method != MethodStore) != (e.CompressedSize < e.UncompressedSize) {
+		return e, 0, false
+	}
+	e.Offset = e.header + 30 + int64(nameLen) + int64(localExtraLen(e.CompressedSize, e.UncompressedSize, e.Extra))
+	return e, n, true
+}
@@ -0,0 +1,81 @@
+package ztream
+
+import (
+	"os"
+	"testing"
+)
+
+// breakHeader overwrites the signature of the local file header of e, such
+// that a scan of the file stops there.
+func breakHeader(t *testing.T, fn string, e Entry) {
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte{0, 0, 0, 0}, e.headerOffset()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenDirectory(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	d1, d2, d3 := data(512, true), data(3000, false), data(512, true)
+	s.Append("test1", d1, "")
+	e2, _ := s.Append("test2", d2, "")
+	e3, _ := s.Append("test3", d3, "")
+	s.Sync()
+	s.Wipe("test1")
+	s.Close()
+
+	// the broken header is not noticed since the directory is used
+	breakHeader(t, fn, e2)
+	s, _ = Open(fn, tOpt)
+	c, err := s.Contents()
+	if err != nil || len(c) != 2 || c[0] != e2 || c[1] != e3 {
+		t.Error("unexpected contents from directory", c, err)
+	}
+	s.Close()
+
+	// appending without closing must make the directory untrusted
+	s, _ = Open(fn, tOpt)
+	d4 := data(512, true)
+	e4, _ := s.Append("test4", d4, "")
+	s.Sync()
+	s2, _ := Open(fn, tOpt)
+	if c, _ := s2.Contents(); len(c) != 0 {
+		t.Error("expected the file to be scanned", c)
+	}
+	s2.Close()
+	s.Close()
+
+	s, _ = Open(fn, tOpt)
+	c, err = s.Contents()
+	if err != nil || len(c) != 3 || c[2] != e4 {
+		t.Error("unexpected contents after append", c, err)
+	}
+	s.Close()
+}
+
+func TestOpenDirectoryZip64(t *testing.T) {
+	withZip64(1000, func() {
+		fn := file(t)
+		defer clean()
+
+		s, _ := Create(fn, tOpt)
+		e1, _ := s.Append("test1", data(3000, false), "")
+		e2, _ := s.Append("test2", data(500, false), "")
+		s.Close()
+
+		breakHeader(t, fn, e1)
+		s, _ = Open(fn, tOpt)
+		defer s.Close()
+		if c, err := s.Contents(); err != nil || len(c) != 2 || c[0] != e1 || c[1] != e2 {
+			t.Error("unexpected contents from directory", c, err)
+		}
+	})
+}
@@ -5,15 +5,15 @@ import "strconv"
 // A CorruptError is returned if any unexpected data is found in the file.
 type CorruptError struct {
 	File   string
-	Offset int
+	Offset int64
 	Err    string
 }
 
 func (e *CorruptError) Error() string {
-	return e.File + ":" + strconv.Itoa(e.Offset) + " " + e.Err
+	return e.File + ":" + strconv.FormatInt(e.Offset, 10) + " " + e.Err
 }
 
-func (s *Stream) corruptError(offset int, e string) error {
+func (s *Stream) corruptError(offset int64, e string) error {
 	return error(&CorruptError{
 		File:   s.file.Name(),
 		Offset: offset,
@@ -21,7 +21,29 @@ func (s *Stream) corruptError(offset int, e string) error {
 	})
 }
 
-// A VerifyError is returned if the name stored in the ztream does not match
-// the name given by the Verifier.
+// A VerifyError is returned if entries stored in the ztream do not verify,
+// such as if the crc code or the name given by the Verifier does not match.
+// Unless Options.ContinueOnError is set only the first bad entry is listed.
 type VerifyError struct {
+	File    string
+	Entries []BadEntry
+}
+
+// A BadEntry is an entry that did not verify.
+type BadEntry struct {
+	Name   string // the name stored for the entry
+	Offset int64  // offset to the local file header
+	Err    string
+}
+
+func (e *VerifyError) Error() string {
+	if len(e.Entries) == 0 {
+		return e.File + ": verification failed"
+	}
+	b := e.Entries[0]
+	msg := e.File + ":" + strconv.FormatInt(b.Offset, 10) + " " + b.Name + ": " + b.Err
+	if len(e.Entries) > 1 {
+		msg += " (and " + strconv.Itoa(len(e.Entries)-1) + " more bad entries)"
+	}
+	return msg
 }
@@ -0,0 +1,63 @@
+package ztream
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExtra(t *testing.T) {
+	withZip64(2000, func() {
+		fn := file(t)
+		defer clean()
+
+		s, _ := Create(fn, tOpt)
+		d1, d2 := data(512, true), data(3000, false)
+		e1, err := s.Append("test1", d1, "sha2-1234 schema")
+		if err != nil || e1.Extra != "sha2-1234 schema" {
+			t.Error("unexpected entry", e1, err)
+		}
+		e2, err := s.AppendFrom("test2", bytes.NewReader(d2), int64(len(d2)), "sha2-5678")
+		if err != nil || e2.Extra != "sha2-5678" {
+			t.Error("unexpected entry", e2, err)
+		}
+		if _, err := s.Append("test3", d1, strings.Repeat("a", MaxExtraSize+1)); err != ErrExtraTooLarge {
+			t.Error("expected ErrExtraTooLarge", err)
+		}
+		s.Sync()
+		buf := make([]byte, len(d2))
+		if err := s.Read(e2, buf); err != nil || !bytes.Equal(buf, d2) {
+			t.Error("read not equal", err)
+		}
+		s.Close()
+
+		// other zip readers ignore the field
+		validZip(t, fn, 2)
+		contains(t, fn, "test1", d1)
+		contains(t, fn, "test2", d2)
+
+		// the extra is read both from the directory and when scanning
+		for pass := 0; pass < 2; pass++ {
+			s, _ = Open(fn, tOpt)
+			c, err := s.Contents()
+			if err != nil || len(c) != 2 || c[0] != e1 || c[1] != e2 {
+				t.Error("unexpected contents", pass, c, err)
+			}
+			if err := s.Read(e1, buf); err != nil || !bytes.Equal(buf[:len(d1)], d1) {
+				t.Error("read not equal", err)
+			}
+			// it is also read from the header given only its length
+			e := e2
+			e.Extra = strings.Repeat("x", len(e.Extra))
+			if extra, err := s.Extra(e); err != nil || extra != e2.Extra {
+				t.Error("unexpected extra read", extra, err)
+			}
+			s.Close()
+
+			f, _ := os.OpenFile(fn, os.O_RDWR, 0)
+			f.WriteAt(make([]byte, directoryEndLen), tOpt.FileSize-directoryEndLen)
+			f.Close()
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package ztream
+
+import (
+	"io"
+	"os"
+
+	"github.com/detailyang/go-fallocate"
+)
+
+// A File is the file a ztream is stored in, as implemented by *os.File.
+// Other implementations can be used through Options.OpenFile, such as to
+// simulate failures in tests.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// openFile opens the file at path as given by the options.
+func (s *Stream) openFile(path string, flag int) (File, error) {
+	if s.opt.OpenFile != nil {
+		return s.opt.OpenFile(path, flag, 0777)
+	}
+	f, err := os.OpenFile(path, flag, 0777)
+	if err != nil {
+		// avoid returning a non-nil File holding a nil *os.File
+		return nil, err
+	}
+	return f, nil
+}
+
+// allocate allocates size bytes for the file, such that a full disk is found
+// when creating the file rather than when appending to it.
+func allocate(f File, size int64) error {
+	if f, ok := f.(*os.File); ok {
+		return fallocate.Fallocate(f, 0, size)
+	}
+	return f.Truncate(size)
+}
@@ -3,6 +3,7 @@ package ztream
 import (
 	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"strconv"
 	"time"
@@ -11,27 +12,135 @@ import (
 var fileHeaderStream = []byte{0x50, 0x4B, 0x03, 0x04}
 var directoryHeaderStream = []byte{0x50, 0x4B, 0x01, 0x02}
 var directoryEndStream = []byte{0x50, 0x4B, 0x05, 0x06}
+var directory64EndStream = []byte{0x50, 0x4B, 0x06, 0x06}
+var directory64LocatorStream = []byte{0x50, 0x4B, 0x06, 0x07}
+
+const (
+	uint16max = 1<<16 - 1
+	uint32max = 1<<32 - 1
+
+	zip64ExtraID = 0x0001
+	// extraID is the id of the extra field holding the Extra of an entry,
+	// which other zip readers ignore.
+	extraID = 0x6f63
+	// checkExtraID is the id of the extra field of entries without data,
+	// holding the crc code of the header before it. Without data there is
+	// no crc code of the data to tell if the header was torn by a crash.
+	checkExtraID = 0x6f64
+	// checkExtraLen is the size of the field with checkExtraID, which is
+	// last in the header.
+	checkExtraLen = 4 + 4
+	// localExtraLen64 is the size of the zip64 extra field in a local file
+	// header, which always holds both sizes.
+	localExtraLen64 = 4 + 16
+	// directoryEndLen is the size of the end of central directory record,
+	// including the 2 byte comment we write.
+	directoryEndLen      = 24
+	directory64EndLen    = 56
+	directory64LocateLen = 20
+
+	versionWiped = 10
+	version20    = 20
+	version45    = 45 // needed for zip64
+)
+
+// zip64Threshold is the smallest size or offset that is stored in a zip64
+// extra field. It is a variable such that zip64 can be tested without
+// creating huge files.
+var zip64Threshold int64 = uint32max
+
+func needZip64(v int64) bool {
+	return v >= zip64Threshold
+}
+
+// localExtraLen returns the size of the extra fields in the local file
+// header of an entry with the given sizes and extra data.
+func localExtraLen(compressedSize, uncompressedSize int64, extra string) int {
+	n := extraFieldLen(extra) + checkFieldLen(compressedSize, uncompressedSize)
+	if needZip64(compressedSize) || needZip64(uncompressedSize) {
+		n += localExtraLen64
+	}
+	return n
+}
+
+// checkFieldLen returns the size of the field with the crc code of the header
+// in the local file header of an entry with the given sizes, which is only
+// written for entries without data.
+func checkFieldLen(compressedSize, uncompressedSize int64) int {
+	if compressedSize == 0 && uncompressedSize == 0 {
+		return checkExtraLen
+	}
+	return 0
+}
+
+// directoryExtraLen returns the size of the extra fields in the central
+// directory header of an entry, where the zip64 field only holds the values
+// that need it.
+func directoryExtraLen(compressedSize, uncompressedSize, offset int64, extra string) int {
+	return directoryZip64Len(compressedSize, uncompressedSize, offset) + extraFieldLen(extra)
+}
+
+func directoryZip64Len(compressedSize, uncompressedSize, offset int64) int {
+	n := 0
+	for _, v := range []int64{uncompressedSize, compressedSize, offset} {
+		if needZip64(v) {
+			n += 8
+		}
+	}
+	if n > 0 {
+		n += 4
+	}
+	return n
+}
+
+// extraFieldLen returns the size of the field holding extra, which is left
+// out if extra is empty.
+func extraFieldLen(extra string) int {
+	if len(extra) == 0 {
+		return 0
+	}
+	return 4 + len(extra)
+}
+
+// putExtraField writes the field holding extra to b, returning its size.
+func putExtraField(b []byte, extra string) int {
+	if len(extra) == 0 {
+		return 0
+	}
+	binary.LittleEndian.PutUint16(b, extraID)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(extra)))
+	return 4 + copy(b[4:], extra)
+}
 
 type localFileHeader struct {
 	versionExtract    int16
 	bitFlag           uint16
-	compressionMethod int16
+	compressionMethod uint16
 	modificationTime  uint16
 	modificationDate  uint16
 	cRC               uint32
-	compressedSize    int32
-	uncompressedSize  int32
+	compressedSize    int64
+	uncompressedSize  int64
 	fileNameLength    int16
+	extraLength       int
 	fileName          string
+	extra             string // the data of our own extra field
+	check             int    // the offset of the header crc code in the extra fields, or -1
+}
+
+// size returns the size of the header and the data.
+func (lfh *localFileHeader) size() int64 {
+	return 30 + int64(lfh.fileNameLength) + int64(lfh.extraLength) + lfh.compressedSize
 }
 
 func encodeDirectoryHeader(
 	buf []byte,
 	wiped bool,
+	method uint16,
 	cRC uint32,
-	compressedSize int32,
-	uncompressedSize int32,
-	fileName string, time, date uint16, offset int32) []byte {
+	compressedSize int64,
+	uncompressedSize int64,
+	fileName string, extra string, time, date uint16, offset int64) []byte {
 
 	header := buf[:]
 	header[0] = directoryHeaderStream[0]
@@ -39,41 +148,68 @@ func encodeDirectoryHeader(
 	header[2] = directoryHeaderStream[2]
 	header[3] = directoryHeaderStream[3]
 
-	binary.LittleEndian.PutUint16(header[4:], 20)
-	binary.LittleEndian.PutUint16(header[6:], 20)
-	binary.LittleEndian.PutUint16(header[8:], 1<<11)
-	if compressedSize == uncompressedSize {
-		binary.LittleEndian.PutUint16(header[10:], 0)
-	} else {
-		binary.LittleEndian.PutUint16(header[10:], 8)
+	zip64Len := directoryZip64Len(compressedSize, uncompressedSize, offset)
+	extraLen := zip64Len + extraFieldLen(extra)
+	version := uint16(version20)
+	if zip64Len > 0 {
+		version = version45
 	}
+	binary.LittleEndian.PutUint16(header[4:], version)
+	binary.LittleEndian.PutUint16(header[6:], version)
+	binary.LittleEndian.PutUint16(header[8:], 1<<11)
+	binary.LittleEndian.PutUint16(header[10:], method)
 	binary.LittleEndian.PutUint16(header[12:], time)
 	binary.LittleEndian.PutUint16(header[14:], date)
 	binary.LittleEndian.PutUint32(header[16:], cRC)
-	binary.LittleEndian.PutUint32(header[20:], uint32(compressedSize))
-	binary.LittleEndian.PutUint32(header[24:], uint32(uncompressedSize))
+	binary.LittleEndian.PutUint32(header[20:], field32(compressedSize))
+	binary.LittleEndian.PutUint32(header[24:], field32(uncompressedSize))
 	binary.LittleEndian.PutUint16(header[28:], uint16(len(fileName)))
-	binary.LittleEndian.PutUint16(header[30:], 0)
+	binary.LittleEndian.PutUint16(header[30:], uint16(extraLen))
 	binary.LittleEndian.PutUint16(header[32:], 0)
 	binary.LittleEndian.PutUint16(header[34:], 0)
 	binary.LittleEndian.PutUint16(header[36:], 0)
 	binary.LittleEndian.PutUint32(header[38:], 0)
-	binary.LittleEndian.PutUint32(header[42:], uint32(offset))
-	fn := []byte(fileName)
-	for i := range fn {
-		header[46+i] = fn[i]
+	binary.LittleEndian.PutUint32(header[42:], field32(offset))
+	n := 46 + copy(header[46:], fileName)
+
+	if zip64Len > 0 {
+		binary.LittleEndian.PutUint16(header[n:], zip64ExtraID)
+		binary.LittleEndian.PutUint16(header[n+2:], uint16(zip64Len-4))
+		n += 4
+		// the order of the fields is given by the specification
+		for _, v := range []int64{uncompressedSize, compressedSize, offset} {
+			if needZip64(v) {
+				binary.LittleEndian.PutUint64(header[n:], uint64(v))
+				n += 8
+			}
+		}
 	}
+	n += putExtraField(header[n:], extra)
+	return header[:n]
+}
 
-	return header[:46+len(fn)]
+// field32 returns the value to store in a 32 bit field, which is all ones if
+// the value is stored in the zip64 extra field.
+func field32(v int64) uint32 {
+	if needZip64(v) {
+		return uint32max
+	}
+	return uint32(v)
 }
 
+// encodeFileHeader encodes a local file header. If zip64 is set the sizes
+// are stored in a zip64 extra field, followed by the field holding extra,
+// and for entries without data the field holding the crc code of the header.
 func encodeFileHeader(
 	buf []byte,
 	wiped bool,
+	zip64 bool,
+	method uint16,
 	cRC uint32,
-	compressedSize int32,
-	uncompressedSize int32,
-	fileName string) ([]byte, uint16, uint16) {
+	compressedSize int64,
+	uncompressedSize int64,
+	fileName string,
+	extra string) ([]byte, uint16, uint16) {
 
 	header := buf[:]
 	header[0] = fileHeaderStream[0]
@@ -81,17 +217,16 @@ func encodeFileHeader(
 	header[2] = fileHeaderStream[2]
 	header[3] = fileHeaderStream[3]
 
-	if wiped {
-		binary.LittleEndian.PutUint16(header[4:], 10)
-	} else {
-		binary.LittleEndian.PutUint16(header[4:], 20)
+	switch {
+	case wiped:
+		binary.LittleEndian.PutUint16(header[4:], versionWiped)
+	case zip64:
+		binary.LittleEndian.PutUint16(header[4:], version45)
+	default:
+		binary.LittleEndian.PutUint16(header[4:], version20)
 	}
 	binary.LittleEndian.PutUint16(header[6:], 1<<11)
-	if compressedSize == uncompressedSize {
-		binary.LittleEndian.PutUint16(header[8:], 0)
-	} else {
-		binary.LittleEndian.PutUint16(header[8:], 8)
-	}
+	binary.LittleEndian.PutUint16(header[8:], method)
 	date, time := timeToMsDosTime(time.Now())
 	if wiped {
 		date, time = 0, 0 // do not encode info about when it was deleted.
@@ -99,16 +234,79 @@ func encodeFileHeader(
 	binary.LittleEndian.PutUint16(header[10:], time)
 	binary.LittleEndian.PutUint16(header[12:], date)
 	binary.LittleEndian.PutUint32(header[14:], cRC)
-	binary.LittleEndian.PutUint32(header[18:], uint32(compressedSize))
-	binary.LittleEndian.PutUint32(header[22:], uint32(uncompressedSize))
+	extraLen := extraFieldLen(extra) + checkFieldLen(compressedSize, uncompressedSize)
+	if zip64 {
+		binary.LittleEndian.PutUint32(header[18:], uint32max)
+		binary.LittleEndian.PutUint32(header[22:], uint32max)
+		extraLen += localExtraLen64
+	} else {
+		binary.LittleEndian.PutUint32(header[18:], uint32(compressedSize))
+		binary.LittleEndian.PutUint32(header[22:], uint32(uncompressedSize))
+	}
+	binary.LittleEndian.PutUint16(header[28:], uint16(extraLen))
 	binary.LittleEndian.PutUint16(header[26:], uint16(len(fileName)))
-	binary.LittleEndian.PutUint16(header[28:], 0)
-	fn := []byte(fileName)
-	for i := range fn {
-		header[30+i] = fn[i]
+	n := 30 + copy(header[30:], fileName)
+
+	if zip64 {
+		binary.LittleEndian.PutUint16(header[n:], zip64ExtraID)
+		binary.LittleEndian.PutUint16(header[n+2:], 16)
+		binary.LittleEndian.PutUint64(header[n+4:], uint64(uncompressedSize))
+		binary.LittleEndian.PutUint64(header[n+12:], uint64(compressedSize))
+		n += localExtraLen64
+	}
+	n += putExtraField(header[n:], extra)
+	if checkFieldLen(compressedSize, uncompressedSize) > 0 {
+		binary.LittleEndian.PutUint16(header[n:], checkExtraID)
+		binary.LittleEndian.PutUint16(header[n+2:], 4)
+		binary.LittleEndian.PutUint32(header[n+4:], crc32.ChecksumIEEE(header[:n+4]))
+		n += checkExtraLen
+	}
+	return header[:n], time, date
+}
+
+// encodeDirectoryEnd encodes the end of central directory record, preceded by
+// the zip64 end of central directory record and locator if zip64 is set.
+func encodeDirectoryEnd(buf []byte, zip64 bool, entries int, size, offset int64) []byte {
+	b := buf[:0]
+	if zip64 {
+		var rec [directory64EndLen + directory64LocateLen]byte
+		copy(rec[:], directory64EndStream)
+		binary.LittleEndian.PutUint64(rec[4:], directory64EndLen-12)
+		binary.LittleEndian.PutUint16(rec[12:], version45)
+		binary.LittleEndian.PutUint16(rec[14:], version45)
+		binary.LittleEndian.PutUint32(rec[16:], 0)
+		binary.LittleEndian.PutUint32(rec[20:], 0)
+		binary.LittleEndian.PutUint64(rec[24:], uint64(entries))
+		binary.LittleEndian.PutUint64(rec[32:], uint64(entries))
+		binary.LittleEndian.PutUint64(rec[40:], uint64(size))
+		binary.LittleEndian.PutUint64(rec[48:], uint64(offset))
+
+		l := rec[directory64EndLen:]
+		copy(l, directory64LocatorStream)
+		binary.LittleEndian.PutUint32(l[4:], 0)
+		binary.LittleEndian.PutUint64(l[8:], uint64(offset+size))
+		binary.LittleEndian.PutUint32(l[16:], 1)
+		b = append(b, rec[:]...)
 	}
 
-	return header[:30+len(fn)], time, date
+	var end [directoryEndLen]byte
+	copy(end[:], directoryEndStream)
+	if zip64 {
+		// tells readers to look for the zip64 record
+		binary.LittleEndian.PutUint16(end[8:], uint16max)
+		binary.LittleEndian.PutUint16(end[10:], uint16max)
+		binary.LittleEndian.PutUint32(end[12:], uint32max)
+		binary.LittleEndian.PutUint32(end[16:], uint32max)
+	} else {
+		binary.LittleEndian.PutUint16(end[8:], uint16(entries))
+		binary.LittleEndian.PutUint16(end[10:], uint16(entries))
+		binary.LittleEndian.PutUint32(end[12:], uint32(size))
+		if entries > 0 {
+			binary.LittleEndian.PutUint32(end[16:], uint32(offset))
+		}
+	}
+	binary.LittleEndian.PutUint16(end[20:], 2)
+	return append(b, end[:]...)
 }
 
 // copied from go standard library zip package
@@ -119,10 +317,10 @@ func timeToMsDosTime(t time.Time) (fDate uint16, fTime uint16) {
 }
 
 // decoding, verifying, ensurting not to read past the header data of the reader.
-func (s *Stream) decodeFileHeader(offset int, buf []byte, r io.Reader) (lfh *localFileHeader, err error) {
+func (s *Stream) decodeFileHeader(offset int64, buf []byte, r io.Reader) (lfh *localFileHeader, err error) {
 	n, err := io.ReadFull(r, buf[:30])
 	if err == io.EOF {
-		return nil, s.corruptError(offset+n, "found EOF when looking for file header")
+		return nil, s.corruptError(offset+int64(n), "found EOF when looking for file header")
 	}
 	if err != nil {
 		return nil, err
@@ -132,7 +330,7 @@ func (s *Stream) decodeFileHeader(offset int, buf []byte, r io.Reader) (lfh *loc
 	}
 	lfh = &localFileHeader{}
 	lfh.versionExtract = int16(binary.LittleEndian.Uint16(buf[4:]))
-	if lfh.versionExtract != 10 && lfh.versionExtract != 20 {
+	if lfh.versionExtract != versionWiped && lfh.versionExtract != version20 && lfh.versionExtract != version45 {
 		return nil, s.corruptError(offset+4, "unexpected versionExtract: "+strconv.Itoa(int(lfh.versionExtract)))
 	}
 
@@ -141,26 +339,65 @@ func (s *Stream) decodeFileHeader(offset int, buf []byte, r io.Reader) (lfh *loc
 		return nil, s.corruptError(offset+6, "expected unicode flag only: "+strconv.Itoa(int(lfh.bitFlag)))
 	}
 
-	lfh.compressionMethod = int16(binary.LittleEndian.Uint16(buf[8:]))
-	if lfh.compressionMethod != 0 && lfh.compressionMethod != 8 {
-		return nil, s.corruptError(offset+8, "expected no compression or deflate: "+strconv.Itoa(int(lfh.compressionMethod)))
+	lfh.compressionMethod = binary.LittleEndian.Uint16(buf[8:])
+	if lfh.compressionMethod != MethodStore && s.codec(lfh.compressionMethod) == nil {
+		return nil, s.corruptError(offset+8, "expected no compression or a known method: "+strconv.Itoa(int(lfh.compressionMethod)))
 	}
 
 	lfh.modificationTime = uint16(binary.LittleEndian.Uint16(buf[10:]))
 	lfh.modificationDate = uint16(binary.LittleEndian.Uint16(buf[12:]))
 	lfh.cRC = binary.LittleEndian.Uint32(buf[14:])
+	compressedSize := binary.LittleEndian.Uint32(buf[18:])
+	uncompressedSize := binary.LittleEndian.Uint32(buf[22:])
 
-	lfh.compressedSize = int32(binary.LittleEndian.Uint32(buf[18:]))
-	if lfh.compressedSize <= 0 {
-		return nil, s.corruptError(offset+18, "expected compressed size > 0, got: "+strconv.Itoa(int(lfh.compressedSize)))
+	lfh.fileNameLength = int16(binary.LittleEndian.Uint16(buf[26:]))
+	if lfh.fileNameLength > maxNameLength || lfh.fileNameLength < 0 {
+		return nil, s.corruptError(offset+26, "filename length to long: "+strconv.Itoa(int(lfh.fileNameLength)))
+	}
+	lfh.extraLength = int(binary.LittleEndian.Uint16(buf[28:]))
+	if lfh.extraLength > maxExtraLength {
+		return nil, s.corruptError(offset+28, "extra field length to long: "+strconv.Itoa(lfh.extraLength))
+	}
+
+	// the name and extra fields follow the fixed fields in buf, such that
+	// the header can be checked against its crc code
+	header := buf[:30+int(lfh.fileNameLength)+lfh.extraLength]
+	n, err = io.ReadFull(r, header[30:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, s.corruptError(offset+int64(n)+30, "found EOF when reading filename")
 	}
+	if err != nil {
+		return nil, err
+	}
+	lfh.fileName = string(header[30 : 30+lfh.fileNameLength])
 
-	lfh.uncompressedSize = int32(binary.LittleEndian.Uint32(buf[22:]))
+	zip64 := compressedSize == uint32max || uncompressedSize == uint32max
+	if !lfh.readExtra(header[30+lfh.fileNameLength:], zip64) {
+		return nil, s.corruptError(offset+30+int64(lfh.fileNameLength), "invalid or missing zip64 extra field")
+	}
+	if !zip64 {
+		lfh.compressedSize = int64(compressedSize)
+		lfh.uncompressedSize = int64(uncompressedSize)
+	}
+
+	if lfh.compressedSize < 0 {
+		return nil, s.corruptError(offset+18, "expected compressed size >= 0, got: "+strconv.FormatInt(lfh.compressedSize, 10))
+	}
+	if lfh.wiped() {
+		// the sizes of a range being wiped may not match its method
+		return lfh, nil
+	}
 	if lfh.uncompressedSize < 0 {
-		return nil, s.corruptError(offset+18, "expected uncompressedSize size >= 0, got: "+strconv.Itoa(int(lfh.uncompressedSize)))
+		return nil, s.corruptError(offset+18, "expected uncompressedSize size >= 0, got: "+strconv.FormatInt(lfh.uncompressedSize, 10))
+	}
+	if checkFieldLen(lfh.compressedSize, lfh.uncompressedSize) > 0 {
+		at := 30 + int(lfh.fileNameLength) + lfh.check
+		if lfh.check < 0 || crc32.ChecksumIEEE(header[:at]) != binary.LittleEndian.Uint32(header[at:]) {
+			return nil, s.corruptError(offset, "header of entry without data not matching its crc code")
+		}
 	}
-	if lfh.deflated() {
-		if lfh.compressedSize >= lfh.uncompressedSize {
+	if lfh.compressed() {
+		if lfh.compressedSize == 0 || lfh.compressedSize >= lfh.uncompressedSize {
 			return nil, s.corruptError(offset+22, "compressed data >= uncompressed data stored")
 		}
 	} else {
@@ -169,29 +406,43 @@ func (s *Stream) decodeFileHeader(offset int, buf []byte, r io.Reader) (lfh *loc
 		}
 	}
 
-	lfh.fileNameLength = int16(binary.LittleEndian.Uint16(buf[26:]))
-	if lfh.fileNameLength > maxNameLength {
-		return nil, s.corruptError(offset+26, "filename length to long: "+strconv.Itoa(int(lfh.fileNameLength)))
-	}
+	return lfh, nil
+}
 
-	n, err = io.ReadFull(r, buf[:lfh.fileNameLength])
-	if err == io.EOF {
-		return nil, s.corruptError(offset+n+30, "found EOF when reading filename")
-	}
-	if err != nil {
-		return nil, err
+// readExtra reads the extra fields we know of, the sizes from the zip64
+// field if zip64 is set, the data of our own field and where the header crc
+// code is. It reports whether the fields were valid.
+func (lfh *localFileHeader) readExtra(extra []byte, zip64 bool) bool {
+	found := !zip64
+	lfh.check = -1
+	start := len(extra)
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			return false
+		}
+		switch {
+		case id == zip64ExtraID && zip64 && size >= 16:
+			lfh.uncompressedSize = int64(binary.LittleEndian.Uint64(extra))
+			lfh.compressedSize = int64(binary.LittleEndian.Uint64(extra[8:]))
+			found = lfh.uncompressedSize >= 0 && lfh.compressedSize >= 0
+		case id == extraID:
+			lfh.extra = string(extra[:size])
+		case id == checkExtraID && size == 4 && len(extra) == 4:
+			lfh.check = start - len(extra)
+		}
+		extra = extra[size:]
 	}
-
-	lfh.fileName = string(buf[:int(lfh.fileNameLength)])
-
-	return lfh, nil
+	return found
 }
 
 func (lfh *localFileHeader) wiped() bool {
 	// we (ab-use) the versionExtract field for indicating a wiped range
-	return lfh.versionExtract == 10
+	return lfh.versionExtract == versionWiped
 }
 
-func (lfh *localFileHeader) deflated() bool {
-	return lfh.compressionMethod == 8
+func (lfh *localFileHeader) compressed() bool {
+	return lfh.compressionMethod != MethodStore
 }
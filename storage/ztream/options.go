@@ -4,6 +4,7 @@ import (
 	"compress/flate"
 	"errors"
 	"io"
+	"os"
 
 	"github.com/imdario/mergo"
 )
@@ -19,14 +20,33 @@ type Verifier interface {
 	Match(name string) bool
 }
 
+// An ExtraVerifier is a Verifier that also checks the Extra stored with each
+// entry, after its name matched.
+type ExtraVerifier interface {
+	Verifier
+	MatchExtra(name, extra string) bool
+}
+
+// matches reports whether the entry of lfh is as v expects.
+func matches(v Verifier, lfh *localFileHeader) bool {
+	if !v.Match(lfh.fileName) {
+		return false
+	}
+	ev, ok := v.(ExtraVerifier)
+	return !ok || ev.MatchExtra(lfh.fileName, lfh.extra)
+}
+
 // Options to configure the ztream.
 type Options struct {
 	// The size of the zip file that should be allocated when creating a new file. Has no
 	// effect when opening an existing ztream.
-	FileSize int32
+	FileSize int64
 	// If non nill used to verify all exisiting data in a ztream that is opened. Has no
 	// effect when creating a new ztream.
 	Verifier Verifier
+	// If set Open continues verifying after an entry fails, and returns the Stream with
+	// the entries that verified along with a *VerifyError listing the others.
+	ContinueOnError bool
 	// If SampleCompressSize > 0 the ztream tries to compress part of any appended data to
 	// see if it is worthwile to compress the data to save space. If <= 0 compression is disabled.
 	// When compression is enabled the memory usage is increased since a buffer must be maintained
@@ -37,8 +57,22 @@ type Options struct {
 	CompressionThreshold float32
 	// CompressionLevel to use - specified as given by the flate package.
 	CompressionLevel int
+	// The codecs to choose between when compressing appended data, the one compressing
+	// the sample the most is used. If empty deflate at CompressionLevel is used.
+	Codecs []Codec
+	// If non nil appended data may also be compressed by deflate with the newest of the
+	// dictionaries, once there is one, and data compressed with any of them can be read.
+	// Only that codec raises a CompressionLevel not using dictionaries to flate.DefaultCompression.
+	Dictionaries *Dictionaries
+	// If non nil used instead of os.OpenFile to open the file of the ztream, as when
+	// testing how failures are handled.
+	OpenFile func(name string, flag int, perm os.FileMode) (File, error)
 }
 
+// maxFileSize is the largest FileSize accepted, larger files than 4 Gb are
+// written as zip64.
+const maxFileSize = 1 << 40
+
 var DefaultOptions = Options{
 	FileSize:             1 << 27, // ~250 Mb
 	Verifier:             nil,
@@ -53,8 +87,8 @@ func getOptions(opt *Options) error {
 	if opt.FileSize < 1<<18 {
 		return errors.New("ztream: to small FileSize specified, must be at least 1 << 18")
 	}
-	if opt.FileSize > 1<<30 {
-		return errors.New("zstream: to large FileSize, must be smaller than 1 << 30")
+	if opt.FileSize > maxFileSize {
+		return errors.New("zstream: to large FileSize, must be smaller than 1 << 40")
 	}
 
 	if opt.SampleCompressSize < 512 {
@@ -77,6 +111,13 @@ func getOptions(opt *Options) error {
 	if opt.CompressionLevel >= 9 {
 		return errors.New("zstream: to large CompressionLevel, must be smaller than 10")
 	}
+	if len(opt.Codecs) == 0 {
+		opt.Codecs = []Codec{Deflate(opt.CompressionLevel)}
+	}
+	if opt.Dictionaries != nil {
+		n := len(opt.Codecs)
+		opt.Codecs = append(opt.Codecs[:n:n], DeflateDict(opt.CompressionLevel, opt.Dictionaries))
+	}
 
 	return nil
 }
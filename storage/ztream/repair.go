@@ -0,0 +1,191 @@
+package ztream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// A RepairReport describes the result of Repair.
+type RepairReport struct {
+	Recovered []Entry     // the entries copied, as stored in the new ztream
+	Lost      []LostRange // the parts of the old ztream that were not recovered
+}
+
+// A LostRange is a part of a ztream where no valid entries were found.
+type LostRange struct {
+	Offset int64
+	End    int64  // the offset of the next recovered entry, or the file size
+	Name   string // the name of the first entry lost, if its header was valid
+	Err    string // why the first entry was lost
+}
+
+// Repair copies all entries that can be recovered from the possibly corrupt
+// ztream at src to a new ztream at dst, and reports what was lost. Unlike
+// when loading a ztream the scan does not stop at a corrupt header, but
+// resynchronizes by searching for the next local file header signature. A
+// header found is only trusted if its data matches the stored crc code, and
+// opt.Verifier if set. If opt.FileSize is 0 the new ztream is as large as the
+// old. On errors dst is removed.
+func Repair(src, dst string, opt Options) (*RepairReport, error) {
+	ropt := opt
+	ropt.Verifier = nil
+	r, err := Open(src, ropt)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if opt.FileSize == 0 {
+		opt.FileSize = r.opt.FileSize
+	}
+	w, err := Create(dst, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &RepairReport{}
+	rep.Lost, err = r.salvage(opt.Verifier, func(lfh *localFileHeader, offset int64) error {
+		er, err := r.newEntryReader(offset, lfh)
+		if err != nil {
+			return err
+		}
+		e, err := w.AppendFrom(lfh.fileName, er, lfh.uncompressedSize, lfh.extra)
+		if err == nil {
+			rep.Recovered = append(rep.Recovered, e)
+		}
+		return err
+	})
+	if err == nil {
+		err = w.Sync()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return nil, err
+	}
+	return rep, nil
+}
+
+// salvage calls fn with every entry of the stream that verifies, in order,
+// and returns the ranges where no such entries were found. The stream is not
+// loaded.
+func (s *Stream) salvage(v Verifier, fn func(lfh *localFileHeader, offset int64) error) ([]LostRange, error) {
+	var lost []LostRange
+	var cur *LostRange
+	buf := make([]byte, bufferSize+maxExtraLength)
+	for offset := int64(0); offset < s.opt.FileSize; {
+		lfh, err := s.candidate(offset, buf, v)
+		if lfh != nil && err == nil {
+			if cur != nil {
+				cur.End = offset
+				lost, cur = append(lost, *cur), nil
+			}
+			if !lfh.wiped() {
+				if err := fn(lfh, offset); err != nil {
+					return lost, err
+				}
+			}
+			offset += lfh.size()
+			continue
+		}
+
+		if cur == nil && (lfh != nil || err != nil) {
+			cur = &LostRange{Offset: offset}
+			if lfh != nil {
+				cur.Name = lfh.fileName
+			}
+			if err != nil {
+				cur.Err = err.Error()
+			}
+		}
+		next, err := s.findSignature(offset + 1)
+		if err != nil {
+			return lost, err
+		}
+		if next < 0 {
+			// if we are not in a lost range this is the end of the data
+			break
+		}
+		if cur == nil {
+			cur = &LostRange{Offset: offset, Err: "no local file header found"}
+		}
+		offset = next
+	}
+	if cur != nil {
+		cur.End = s.opt.FileSize
+		lost = append(lost, *cur)
+	}
+	return lost, nil
+}
+
+// candidate decodes the local file header at offset and verifies the data
+// following it. It returns a nil header and error if there is no header at
+// offset, and else the header and why it is not valid if it is not.
+func (s *Stream) candidate(offset int64, buf []byte, v Verifier) (*localFileHeader, error) {
+	lfh, err := s.decodeFileHeader(offset, buf, io.NewSectionReader(s.file, offset, s.opt.FileSize-offset))
+	if lfh == nil || err != nil {
+		return nil, err
+	}
+	if offset+lfh.size() > s.opt.FileSize {
+		return lfh, errors.New("data extends beyond the file")
+	}
+
+	var w io.Writer = ioutil.Discard
+	if v != nil && !lfh.wiped() {
+		v.Reset()
+		w = v
+	}
+	r, err := s.newEntryReader(offset, lfh)
+	if err != nil {
+		return lfh, err
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return lfh, err
+	}
+	if v != nil && !lfh.wiped() && !matches(v, lfh) {
+		return lfh, errors.New("entry not matching the expected: " + lfh.fileName)
+	}
+	return lfh, nil
+}
+
+// nextEntry returns the offset of the first local file header at or after
+// offset which is followed by data that verifies, or -1 if there is none.
+func (s *Stream) nextEntry(offset int64) (int64, error) {
+	buf := make([]byte, bufferSize+maxExtraLength)
+	for {
+		next, err := s.findSignature(offset)
+		if next < 0 || err != nil {
+			return next, err
+		}
+		if lfh, err := s.candidate(next, buf, nil); lfh != nil && err == nil {
+			return next, nil
+		}
+		offset = next + 1
+	}
+}
+
+// findSignature returns the offset of the first local file header signature
+// at or after offset, or -1 if there is none.
+func (s *Stream) findSignature(offset int64) (int64, error) {
+	buf := make([]byte, bufferSize)
+	for offset < s.opt.FileSize {
+		n, err := s.file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return -1, err
+		}
+		if i := bytes.Index(buf[:n], fileHeaderStream); i >= 0 {
+			return offset + int64(i), nil
+		}
+		if err == io.EOF || n < len(fileHeaderStream) {
+			break
+		}
+		// the signature may cross the end of buf
+		offset += int64(n - len(fileHeaderStream) + 1)
+	}
+	return -1, nil
+}
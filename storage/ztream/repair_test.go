@@ -0,0 +1,58 @@
+package ztream
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	d1, d2, d3, d4, d5 := data(5000, true), data(5000, false), data(5000, false), data(5000, true), data(500, false)
+	s.Append("test1", d1, "extra")
+	e2, _ := s.Append("test2", d2, "")
+	s.Append("wiped", d5, "")
+	e3, _ := s.Append("test3", d3, "")
+	e4, _ := s.Append("test4", d4, "")
+	s.Sync()
+	s.Wipe("wiped")
+	s.Close()
+
+	// break the header of test2 and the data of test3
+	f, _ := os.OpenFile(fn, os.O_RDWR, 0)
+	f.WriteAt([]byte("garbage"), e2.headerOffset())
+	f.WriteAt([]byte{^d3[100]}, e3.Offset+100)
+	f.Close()
+
+	dst := fn + ".repaired"
+	rep, err := Repair(fn, dst, tOpt)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(rep.Recovered) != 2 || rep.Recovered[0].Name != "test1" || rep.Recovered[0].Extra != "extra" || rep.Recovered[1].Name != "test4" {
+		t.Error("unexpected entries recovered", rep.Recovered)
+	}
+	if len(rep.Lost) != 2 {
+		t.Error("expected two lost ranges", rep.Lost)
+		t.FailNow()
+	}
+	if l := rep.Lost[0]; l.Offset != e2.headerOffset() || l.Name != "" || l.End <= e2.Offset {
+		t.Error("unexpected lost range", l)
+	}
+	if l := rep.Lost[1]; l.Offset != e3.headerOffset() || l.Name != "test3" || l.End != e4.headerOffset() {
+		t.Error("unexpected lost range", l)
+	}
+
+	validZip(t, dst, 2)
+	contains(t, dst, "test1", d1)
+	contains(t, dst, "test4", d4)
+	if _, err := os.Stat(dst); err != nil {
+		t.Error(err)
+	}
+	if _, err := Repair(fn, dst, tOpt); err == nil {
+		t.Error("expected an existing dst to fail")
+	}
+}
@@ -0,0 +1,104 @@
+package ztream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestAppendFrom(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	// the last one looks compressible from the sample but is not, so it is
+	// stored uncompressed after all
+	d1, d2 := bytes.Repeat([]byte("compono "), 12500), data(100000, false)
+	d3 := append(bytes.Repeat([]byte("compono "), tOpt.SampleCompressSize/8), data(100000, false)...)
+	e1, err := s.AppendFrom("test1", bytes.NewReader(d1), int64(len(d1)), "")
+	if err != nil {
+		t.Error(err)
+	}
+	e2, err := s.AppendFrom("test2", bytes.NewReader(d2), int64(len(d2)), "")
+	if err != nil {
+		t.Error(err)
+	}
+	e3, err := s.AppendFrom("test3", bytes.NewReader(d3), int64(len(d3)), "")
+	if err != nil {
+		t.Error(err)
+	}
+	if e1.CompressedSize >= e1.UncompressedSize || e2.CompressedSize != e2.UncompressedSize || e3.CompressedSize != e3.UncompressedSize {
+		t.Error("unexpected compression", e1, e2, e3)
+	}
+	if _, err := s.AppendFrom("short", bytes.NewReader(d1[:10]), 20, ""); err != io.ErrUnexpectedEOF {
+		t.Error("expected short data to fail", err)
+	}
+	if _, err := s.AppendFrom("large", bytes.NewReader(d2), tOpt.FileSize, ""); err != ErrStreamFull {
+		t.Error("expected ErrStreamFull", err)
+	}
+	s.Sync()
+	s.Close()
+
+	validZip(t, fn, 3)
+	contains(t, fn, "test1", d1)
+	contains(t, fn, "test2", d2)
+	contains(t, fn, "test3", d3)
+
+	s, _ = Open(fn, tOpt)
+	defer s.Close()
+	c, err := s.Contents()
+	if err != nil || len(c) != 3 || c[0] != e1 || c[1] != e2 || c[2] != e3 {
+		t.Error("unexpected contents", c, err)
+	}
+}
+
+func TestOpenEntry(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	d1, d2 := bytes.Repeat([]byte("compono "), 12500), data(100000, false)
+	e1, _ := s.Append("test1", d1, "")
+	e2, _ := s.Append("test2", d2, "")
+	s.Sync()
+
+	for _, c := range []struct {
+		e Entry
+		d []byte
+	}{{e1, d1}, {e2, d2}} {
+		r, err := s.Open(c.e)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		buf, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(buf, c.d) {
+			t.Error("read not equal", c.e.Name, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+	s.Close()
+
+	// flipping a byte of the stored data must be found when reaching the end
+	f, _ := os.OpenFile(fn, os.O_RDWR, 0)
+	f.WriteAt([]byte{^d2[500]}, e2.Offset+500)
+	f.Close()
+
+	s, _ = Open(fn, tOpt)
+	defer s.Close()
+	r, err := s.Open(e2)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expected corrupted data to be detected")
+	} else if _, ok := err.(*CorruptError); !ok {
+		t.Error("expected a CorruptError", err)
+	}
+}
@@ -0,0 +1,93 @@
+package ztream
+
+import (
+	"os"
+	"testing"
+)
+
+func TestVerifyContinue(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	d := data(512, false)
+	e1, _ := s.Append("test1", d, "")
+	e2, _ := s.Append("test2", d, "")
+	e3, _ := s.Append("wrong", data(512, true), "")
+	e4, _ := s.Append("test4", d, "")
+	s.Close()
+
+	f, _ := os.OpenFile(fn, os.O_RDWR, 0)
+	f.WriteAt([]byte{^d[10]}, e2.Offset+10)
+	f.Close()
+
+	o := tOpt
+	o.Verifier = new(ver)
+	if s, err := Open(fn, o); s != nil || err == nil {
+		t.Error("expected open to fail", err)
+	} else if verr, ok := err.(*VerifyError); !ok || len(verr.Entries) != 1 || verr.Entries[0].Offset != e2.headerOffset() {
+		t.Error("expected a VerifyError of the first bad entry", err)
+	}
+
+	o.Verifier = new(ver)
+	o.ContinueOnError = true
+	s, err := Open(fn, o)
+	if s == nil {
+		t.Error("expected the stream to be returned", err)
+		t.FailNow()
+	}
+	defer s.Close()
+	verr, ok := err.(*VerifyError)
+	if !ok || len(verr.Entries) != 2 {
+		t.Error("expected a VerifyError of two entries", err)
+		t.FailNow()
+	}
+	if b := verr.Entries[0]; b.Name != "test2" || b.Offset != e2.headerOffset() {
+		t.Error("unexpected bad entry", b)
+	}
+	if b := verr.Entries[1]; b.Name != "wrong" || b.Offset != e3.headerOffset() {
+		t.Error("unexpected bad entry", b)
+	}
+	if c, err := s.Contents(); err != nil || len(c) != 2 || c[0] != e1 || c[1] != e4 {
+		t.Error("expected the good entries", c, err)
+	}
+}
+
+// TestVerifyUnclosed checks that every bad entry of a stream that was not
+// closed is reported, also the last one.
+func TestVerifyUnclosed(t *testing.T) {
+	fs := newMemFS(1)
+	o := tOpt
+	o.OpenFile = fs.OpenFile
+	s, _ := Create("pack", o)
+	d := data(512, false)
+	e1, _ := s.Append("test1", d, "")
+	e2, _ := s.Append("test2", d, "")
+	e3, _ := s.Append("test3", d, "")
+	e4, _ := s.Append("test4", d, "")
+	s.Sync()
+
+	fs.files["pack"].data[e2.Offset+10] ^= 1
+	fs.files["pack"].data[e4.headerOffset()+6] ^= 1
+
+	o.Verifier = new(ver)
+	o.ContinueOnError = true
+	s, err := Open("pack", o)
+	if s == nil {
+		t.Fatal("expected the stream to be returned", err)
+	}
+	defer s.Close()
+	verr, ok := err.(*VerifyError)
+	if !ok || len(verr.Entries) != 2 {
+		t.Fatal("expected a VerifyError of two entries", err)
+	}
+	if b := verr.Entries[0]; b.Name != "test2" || b.Offset != e2.headerOffset() {
+		t.Error("unexpected bad entry", b)
+	}
+	if b := verr.Entries[1]; b.Offset != e4.headerOffset() {
+		t.Error("unexpected bad entry", b)
+	}
+	if c, err := s.Contents(); err != nil || len(c) != 2 || c[0] != e1 || c[1] != e3 {
+		t.Error("expected the good entries", c, err)
+	}
+}
@@ -0,0 +1,124 @@
+package ztream
+
+import (
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// A wipe is done in steps such that a crash at any point leaves a stream that
+// can be loaded, with the entry either present or wiped:
+//
+//  1. The versionExtract of the header is set to mark the range as wiped, as
+//     a single byte write that cannot be torn, and synced.
+//  2. The data is overwritten with random data and then zeros, and synced.
+//  3. The header is rewritten to describe the zeros, with the name and extra
+//     zeroed but of the same lengths.
+//
+// None of the writes change the size of the range as given by the header, so
+// a wiped range is always skipped correctly. A range not described by a
+// header as written in step 3 is a wipe interrupted after step 1, and
+// finished by load.
+
+// markWiped marks the entry whose header is at offset as wiped. The caller is
+// expected to hold a write lock and sync the file.
+func (s *Stream) markWiped(offset int64) error {
+	_, err := s.file.WriteAt([]byte{versionWiped}, offset+4)
+	return err
+}
+
+// finishWipe overwrites the data of the range with the header lfh at offset,
+// that has been marked as wiped, and rewrites the header to describe zeros.
+// The caller is expected to hold a write lock and sync the file.
+func (s *Stream) finishWipe(offset int64, lfh *localFileHeader) error {
+	if err := s.wipeData(offset, lfh); err != nil {
+		return err
+	}
+	// the zeros must be on disk before the header says they are
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	return s.writeWipedHeader(offset, lfh)
+}
+
+// wipeData overwrites the data of the range with the header lfh at offset
+// with random data, and then zeros. The caller is expected to hold a write
+// lock.
+func (s *Stream) wipeData(offset int64, lfh *localFileHeader) error {
+	dataStart := offset + 30 + int64(lfh.fileNameLength) + int64(lfh.extraLength)
+	if _, err := s.file.Seek(dataStart, 0); err != nil {
+		return err
+	}
+	n, err := io.CopyBuffer(s.file, io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), lfh.compressedSize), s.buffer)
+	if err != nil {
+		return err
+	}
+	if n != lfh.compressedSize {
+		return io.ErrShortWrite
+	}
+	if _, err := s.file.Seek(dataStart, 0); err != nil {
+		return err
+	}
+	for i := range s.buffer {
+		s.buffer[i] = 0
+	}
+	var b []byte
+	for toWrite := lfh.compressedSize; toWrite > 0; toWrite -= int64(len(b)) {
+		if toWrite > int64(len(s.buffer)) {
+			b = s.buffer
+		} else {
+			b = s.buffer[:toWrite]
+		}
+		if _, err := s.file.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeWipedHeader rewrites the header lfh at offset to describe the zeros
+// written by wipeData, with the name and extra zeroed but of the same
+// lengths. The caller is expected to hold a write lock.
+func (s *Stream) writeWipedHeader(offset int64, lfh *localFileHeader) error {
+	zip64, ok := wipedZip64(lfh)
+	if !ok {
+		return s.corruptError(offset+28, "zstream: unexpected extra fields in wiped range")
+	}
+	name, extra := strings.Repeat("\x00", int(lfh.fileNameLength)), strings.Repeat("\x00", len(lfh.extra))
+	b, _, _ := encodeFileHeader(s.buffer, true, zip64, MethodStore, zerosCRC(lfh.compressedSize), lfh.compressedSize, lfh.compressedSize, name, extra)
+	_, err := s.file.WriteAt(b, offset)
+	return err
+}
+
+// wipedZip64 reports whether the header lfh has a zip64 extra field, and if
+// its extra fields are laid out as written by encodeFileHeader such that it
+// can be rewritten by writeWipedHeader.
+func wipedZip64(lfh *localFileHeader) (zip64, ok bool) {
+	switch lfh.extraLength - extraFieldLen(lfh.extra) - checkFieldLen(lfh.compressedSize, lfh.compressedSize) {
+	case 0:
+		return false, true
+	case localExtraLen64:
+		return true, true
+	}
+	return false, false
+}
+
+// wipeFinished reports whether the wiped range with the header lfh has been
+// overwritten by finishWipe, or clearRange.
+func wipeFinished(lfh *localFileHeader) bool {
+	return !lfh.compressed() && lfh.compressedSize == lfh.uncompressedSize &&
+		strings.Trim(lfh.fileName, "\x00") == "" && strings.Trim(lfh.extra, "\x00") == "" &&
+		lfh.cRC == zerosCRC(lfh.compressedSize)
+}
+
+// zerosCRC returns the crc code of n zeros.
+func zerosCRC(n int64) uint32 {
+	var zeros [4096]byte
+	crc := uint32(0)
+	for ; n > int64(len(zeros)); n -= int64(len(zeros)) {
+		crc = crc32.Update(crc, crc32.IEEETable, zeros[:])
+	}
+	return crc32.Update(crc, crc32.IEEETable, zeros[:n])
+}
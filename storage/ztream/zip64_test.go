@@ -0,0 +1,137 @@
+package ztream
+
+import (
+	"bytes"
+	"testing"
+)
+
+// withZip64 runs fn with the zip64 threshold lowered, such that small entries
+// and files are written as zip64.
+func withZip64(threshold int64, fn func()) {
+	old := zip64Threshold
+	zip64Threshold = threshold
+	defer func() { zip64Threshold = old }()
+	fn()
+}
+
+func TestZip64(t *testing.T) {
+	withZip64(1000, func() {
+		fn := file(t)
+		defer clean()
+
+		s, err := Create(fn, tOpt)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		d1, d2, d3 := data(500, false), data(3000, false), data(4000, true)
+		e1, _ := s.Append("small", d1, "")
+		e2, _ := s.Append("large", d2, "")
+		e3, _ := s.Append("compressed", d3, "")
+		if err := s.Sync(); err != nil {
+			t.Error(err)
+		}
+		for _, c := range []struct {
+			e Entry
+			d []byte
+		}{{e1, d1}, {e2, d2}, {e3, d3}} {
+			buf := make([]byte, len(c.d))
+			if err := s.Read(c.e, buf); err != nil || !bytes.Equal(buf, c.d) {
+				t.Error("read not equal", c.e.Name, err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+		validZip(t, fn, 3)
+		contains(t, fn, "small", d1)
+		contains(t, fn, "large", d2)
+		contains(t, fn, "compressed", d3)
+
+		s, err = Open(fn, tOpt)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		c, err := s.Contents()
+		if err != nil || len(c) != 3 || c[1] != e2 || c[2] != e3 {
+			t.Error("unexpected contents on open", c, err)
+		}
+		if err := s.Wipe("large"); err != nil {
+			t.Error(err)
+		}
+		d4 := data(2000, false)
+		s.Append("appended", d4, "")
+		s.Sync()
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+		validZip(t, fn, 3)
+		contains(t, fn, "small", d1)
+		contains(t, fn, "compressed", d3)
+		contains(t, fn, "appended", d4)
+
+		s, err = Open(fn, tOpt)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if c, _ := s.Contents(); len(c) != 3 {
+			t.Error("expected 3 entries after wipe", c)
+		}
+		s.Close()
+	})
+}
+
+// TestOpenOld checks that packs written without zip64 can be appended to as
+// zip64.
+func TestOpenOld(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	d1 := data(3000, false)
+	s.Append("old", d1, "")
+	s.Sync()
+	s.Close()
+
+	withZip64(1000, func() {
+		s, err := Open(fn, tOpt)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		d2 := data(3000, false)
+		s.Append("new", d2, "")
+		s.Sync()
+		if c, _ := s.Contents(); len(c) != 2 {
+			t.Error("expected 2 entries", c)
+		}
+		s.Close()
+		validZip(t, fn, 2)
+		contains(t, fn, "new", d2)
+	})
+}
+
+// TestLargeEntryHeader checks that the headers of entries between 2 and 4 Gb,
+// which are not written as zip64, are decoded.
+func TestLargeEntryHeader(t *testing.T) {
+	fn := file(t)
+	defer clean()
+	s, _ := Create(fn, tOpt)
+	defer s.Close()
+
+	const size = 3 << 30
+	buf := make([]byte, bufferSize+maxExtraLength)
+	b, time, date := encodeFileHeader(buf, false, needZip64(size), MethodStore, 1, size, size, "large", "")
+	lfh, err := s.decodeFileHeader(0, make([]byte, bufferSize+maxExtraLength), bytes.NewReader(b))
+	if err != nil || lfh.compressedSize != size || lfh.uncompressedSize != size {
+		t.Error("unexpected local file header", lfh, err)
+	}
+
+	b = encodeDirectoryHeader(buf, false, MethodStore, 1, size, size, "large", "", time, date, size)
+	e, _, ok := decodeDirectoryHeader(b)
+	if !ok || e.CompressedSize != size || e.UncompressedSize != size || e.header != size {
+		t.Error("unexpected directory header", e, ok)
+	}
+}
@@ -2,6 +2,8 @@ package ztream
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
 	"strconv"
 	"testing"
 )
@@ -23,7 +25,7 @@ func TestAppend(t *testing.T) {
 
 	s, _ := Create(fn, tOpt)
 	d := data(12, false)
-	_, err := s.Append("test", d)
+	_, err := s.Append("test", d, "")
 	if err != nil {
 		t.Error(err)
 	}
@@ -36,6 +38,67 @@ func TestAppend(t *testing.T) {
 	contains(t, fn, "test", d)
 }
 
+func TestAppendEmptyEntry(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	d1, d3 := data(100, false), data(100, false)
+	s.Append("test1", d1, "")
+	e2, err := s.Append("test2", nil, "")
+	if err != nil || e2.CompressedSize != 0 || e2.UncompressedSize != 0 {
+		t.Error("unexpected empty entry", e2, err)
+	}
+	e3, _ := s.Append("test3", d3, "")
+	if err := s.Read(e2, nil); err != nil {
+		t.Error(err)
+	}
+	s.Close()
+	validZip(t, fn, 3)
+	contains(t, fn, "test2", []byte{})
+
+	// the entries following it are found when scanning the file
+	f, _ := os.OpenFile(fn, os.O_RDWR, 0)
+	f.WriteAt(make([]byte, directoryEndLen), tOpt.FileSize-directoryEndLen)
+	f.Close()
+	s, _ = Open(fn, tOpt)
+	defer s.Close()
+	c, err := s.Contents()
+	if err != nil || len(c) != 3 || c[1] != e2 || c[2] != e3 {
+		t.Error("unexpected contents from scan", c, err)
+	}
+	if err := s.Wipe("test2"); err != nil {
+		t.Error(err)
+	}
+	if c, err := s.Contents(); err != nil || len(c) != 2 || c[1] != e3 {
+		t.Error("unexpected contents after wipe", c, err)
+	}
+}
+
+// TestAppendPositional checks that entries are appended at the end of the
+// data wherever the file offset has been left.
+func TestAppendPositional(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	d1, d2 := data(100, false), data(100, false)
+	s.Append("test1", d1, "")
+	s.file.Seek(0, 0)
+	e2, err := s.Append("test2", d2, "")
+	if err != nil {
+		t.Error(err)
+	}
+	buf := make([]byte, len(d2))
+	if err := s.Read(e2, buf); err != nil || !bytes.Equal(buf, d2) {
+		t.Error("read not equal", err)
+	}
+	s.Close()
+	validZip(t, fn, 2)
+	contains(t, fn, "test1", d1)
+	contains(t, fn, "test2", d2)
+}
+
 func TestAppendCompress(t *testing.T) {
 	for _, size := range []int{500, 1024, 2000} {
 		fn := file(t)
@@ -43,7 +106,7 @@ func TestAppendCompress(t *testing.T) {
 
 		s, _ := Create(fn, tOpt)
 		d := data(size, true)
-		_, err := s.Append("test", d)
+		_, err := s.Append("test", d, "")
 		if err != nil {
 			t.Error(err)
 		}
@@ -63,7 +126,7 @@ func TestEnsureCompress(t *testing.T) {
 
 	s, _ := Create(fn, tOpt)
 	d := data(int(tOpt.FileSize), true)
-	_, err := s.Append("test", d)
+	_, err := s.Append("test", d, "")
 	if err != nil {
 		t.Error(err)
 	}
@@ -82,9 +145,9 @@ func TestMultiple(t *testing.T) {
 
 	s, _ := Create(fn, tOpt)
 	d1, d2, d3 := data(512, true), data(512, true), data(512, true)
-	s.Append("test1", d1)
-	s.Append("test2", d2)
-	s.Append("test3", d3)
+	s.Append("test1", d1, "")
+	s.Append("test2", d2, "")
+	s.Append("test3", d3, "")
 	s.Sync()
 	s.Close()
 
@@ -100,9 +163,9 @@ func TestRead(t *testing.T) {
 
 	s, _ := Create(fn, tOpt)
 	d1, d2, d3 := data(512, true), data(512, false), data(512, true)
-	e1, _ := s.Append("test1", d1)
-	e2, _ := s.Append("test2", d2)
-	e3, _ := s.Append("test3", d3)
+	e1, _ := s.Append("test1", d1, "")
+	e2, _ := s.Append("test2", d2, "")
+	e3, _ := s.Append("test3", d3, "")
 	s.Sync()
 
 	buf := make([]byte, 512)
@@ -132,9 +195,9 @@ func TestOpen(t *testing.T) {
 
 	s, _ := Create(fn, tOpt)
 	d1, d2, d3 := data(512, true), data(512, true), data(512, true)
-	s.Append("test1", d1)
-	s.Append("test2", d2)
-	s.Append("test3", d3)
+	s.Append("test1", d1, "")
+	s.Append("test2", d2, "")
+	s.Append("test3", d3, "")
 	c, err := s.Contents()
 	if err != nil {
 		t.Error(err)
@@ -158,7 +221,7 @@ func TestOpen(t *testing.T) {
 	}
 
 	d := data(512, false)
-	s.Append("test4", d)
+	s.Append("test4", d, "")
 	s.Sync()
 
 	s.Close()
@@ -176,9 +239,9 @@ func TestOpenVerify(t *testing.T) {
 
 	s, _ := Create(fn, tOpt)
 	d1, d2, d3 := data(512, true), data(512, true), data(512, true)
-	s.Append("test1", d1)
-	s.Append("test2", d2)
-	s.Append("test3", d3)
+	s.Append("test1", d1, "")
+	s.Append("test2", d2, "")
+	s.Append("test3", d3, "")
 	c, err := s.Contents()
 	if err != nil {
 		t.Error(err)
@@ -211,9 +274,9 @@ func TestOpenWipe(t *testing.T) {
 
 	s, _ := Create(fn, tOpt)
 	d1, d2, d3 := data(512, true), data(512, true), data(512, true)
-	s.Append("test1", d1)
-	s.Append("test2", d2)
-	s.Append("test3", d3)
+	s.Append("test1", d1, "")
+	s.Append("test2", d2, "")
+	s.Append("test3", d3, "")
 	s.Sync()
 	if c, _ := s.Contents(); len(c) != 3 {
 		t.Error("expected 3")
@@ -241,6 +304,75 @@ func TestOpenWipe(t *testing.T) {
 	contains(t, fn, "test3", d3)
 }
 
+func TestWipeMany(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	var d [][]byte
+	for i := 0; i < 5; i++ {
+		d = append(d, data(512, false))
+		s.Append("test"+strconv.Itoa(i), d[i], "")
+	}
+	// all entries of a name are wiped
+	d = append(d, data(512, false))
+	s.Append("test3", d[5], "")
+	s.Close()
+
+	s, _ = Open(fn, tOpt)
+	errs := s.WipeMany([]string{"test3", "test0", "missing", "test1", "test3"})
+	if len(errs) != 5 || errs[0] != nil || errs[1] != nil || errs[2] == nil || errs[3] != nil || errs[4] != nil {
+		t.Error("unexpected results", errs)
+	}
+	if c, _ := s.Contents(); len(c) != 2 || c[0].Name != "test2" || c[1].Name != "test4" {
+		t.Error("expected test2 and test4", c)
+	}
+	s.Close()
+
+	validZip(t, fn, 2)
+	contains(t, fn, "test2", d[2])
+	contains(t, fn, "test4", d[4])
+	b, _ := ioutil.ReadFile(fn)
+	for i, name := range map[int]string{0: "test0", 1: "test1", 3: "test3", 5: "test3"} {
+		if bytes.Contains(b, d[i]) || bytes.Contains(b, []byte(name)) {
+			t.Error("not wiped", i)
+		}
+	}
+}
+
+func TestWipeInterrupted(t *testing.T) {
+	fn := file(t)
+	defer clean()
+
+	s, _ := Create(fn, tOpt)
+	d1, d2 := data(512, false), data(512, false)
+	e1, _ := s.Append("test1", d1, "")
+	s.Append("test2", d2, "")
+	s.Close()
+
+	// as if a wipe of test1 was interrupted right after marking it as wiped
+	s, _ = Open(fn, tOpt)
+	s.m.Lock()
+	s.clearDirectory()
+	s.markWiped(e1.headerOffset())
+	s.m.Unlock()
+	s.file.Close()
+
+	s, _ = Open(fn, tOpt)
+	c, err := s.Contents()
+	if err != nil || len(c) != 1 || c[0].Name != "test2" {
+		t.Error("expected only test2", c, err)
+	}
+	s.Close()
+
+	validZip(t, fn, 1)
+	contains(t, fn, "test2", d2)
+	b, _ := ioutil.ReadFile(fn)
+	if bytes.Contains(b, d1) || bytes.Contains(b, []byte("test1")) {
+		t.Error("the wipe was not finished")
+	}
+}
+
 type ver int
 
 func (v *ver) Write(b []byte) (int, error) {
@@ -4,28 +4,23 @@ package ztream
 import (
 	"bufio"
 	"bytes"
-	"compress/flate"
-	"encoding/binary"
 	"errors"
 	"hash"
 	"hash/crc32"
 	"io"
-	"math"
-	"math/rand"
 	"os"
+	"sort"
 	"sync"
-	"time"
-
-	"github.com/detailyang/go-fallocate"
 )
 
 var (
 	ErrStreamFull        = errors.New("zstream: the provided data does not fit in the stream")
 	ErrBuffNotSufficient = errors.New("zstream: the provided buffer is not long enough to read the data")
+	ErrExtraTooLarge     = errors.New("zstream: the provided extra data is larger than MaxExtraSize")
+	ErrNoEntry           = errors.New("zstream: no such entry")
 )
 
 // TODO: Minimize garbage
-// TODO: change to using int32 - we will never need larger files...
 // TODO: document that only intended for small files that can be kept fully in memory
 
 // TODO: Expose statistics, e.g compressed etc.
@@ -36,26 +31,38 @@ const (
 	bufferSize = 1024 * 16
 	// maxNameLength must never be decreased to maintain compatibility
 	maxNameLength = bufferSize - 46
+	// maxExtraLength is the largest extra field accepted in a local file
+	// header, the buffers hold a name and extra field.
+	maxExtraLength = 1024
+	// MaxExtraSize is the largest Extra that can be stored with an entry,
+	// leaving room for the zip64 field in the extra field.
+	MaxExtraSize = 512
 )
 
 // A Stream can only b
 type Stream struct {
+	// w is held by writers, which may then read the fields without m while
+	// the data is compressed and written. They also hold m to change the
+	// fields used by readers.
+	w sync.Mutex
 	m sync.RWMutex // protects all fields
 
-	opt          Options
-	file         *os.File // the underlying file on disk to write to
-	compressor   *flate.Writer
-	decompressor io.ReadCloser
-	entries      []entry // entries that are synced to disk
-	pending      []entry // entries appended and written but not yet synced to disk
+	opt           Options
+	file          File                  // the underlying file on disk to write to
+	compressors   map[uint16]Compressor // of the codecs in opt.Codecs
+	decompressors decompressors
+	entries       []entry // entries that are synced to disk
+	pending       []entry // entries appended and written but not yet synced to disk
+	syncs         uint64  // changed whenever pending is moved to entries
+
+	loaded bool // true if the file has been loaded/parsed
 
-	loaded     bool // true if the file has been loaded/parsed
-	lastAppend bool // if the file handler is seeked so we can just append
+	// used when loading and wiping, which holds the write lock
+	reader *bufio.Reader
+	buffer []byte
 
-	reader   *bufio.Reader
-	buffer   []byte
-	lastRead int
-	crc      hash.Hash32
+	readers    sync.Pool // of *readState
+	generation uint64    // changed whenever data is written, to invalidate buffered reads
 }
 
 // Create h
@@ -64,12 +71,16 @@ func Create(path string, opt Options) (s *Stream, err error) {
 		return nil, err
 	}
 
-	s = &Stream{opt: opt, pending: make([]entry, 0, 32), reader: bufio.NewReader(nil), buffer: make([]byte, bufferSize), decompressor: flate.NewReader(nil)}
-	s.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0777)
+	s = &Stream{opt: opt, pending: make([]entry, 0, 32), reader: bufio.NewReader(nil), buffer: make([]byte, bufferSize+maxExtraLength), decompressors: decompressors{}}
+	s.file, err = s.openFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL)
 	if err != nil {
 		return nil, err
 	}
-	err = fallocate.Fallocate(s.file, 0, int64(opt.FileSize))
+	err = allocate(s.file, opt.FileSize)
+	if err == nil {
+		// the size must be durable before anything is appended
+		err = s.file.Sync()
+	}
 	if err != nil {
 		s.file.Close()
 		return nil, err
@@ -79,33 +90,36 @@ func Create(path string, opt Options) (s *Stream, err error) {
 }
 
 // Open op
+//
+// If opt.Verifier is set all entries are verified. A *VerifyError is returned
+// if any of them fail, along with the Stream if opt.ContinueOnError is set.
 func Open(path string, opt Options) (s *Stream, err error) {
 	if err = getOptions(&opt); err != nil {
 		return nil, err
 	}
 
-	// The file size we need to get from the file
-	// TODO: Can this be delayed to avoid a disk seek for Stat if we only want to read?
-	fi, err := os.Stat(path)
+	s = &Stream{opt: opt, reader: bufio.NewReader(nil), buffer: make([]byte, bufferSize+maxExtraLength), decompressors: decompressors{}}
+	s.file, err = s.openFile(path, os.O_RDWR)
 	if err != nil {
 		return nil, err
 	}
-	s = &Stream{opt: opt, reader: bufio.NewReader(nil), buffer: make([]byte, bufferSize), lastRead: -2, decompressor: flate.NewReader(nil)}
-
-	size := fi.Size()
-	if size > math.MaxInt32 {
-		return nil, s.corruptError(0, "file is to large to be a ztream")
-	}
-	s.opt.FileSize = int32(size)
 
-	s.file, err = os.OpenFile(path, os.O_RDWR, 0777)
+	// The file size we need to get from the file
+	// TODO: Can this be delayed to avoid a disk seek for Stat if we only want to read?
+	fi, err := s.file.Stat()
 	if err != nil {
+		s.file.Close()
 		return nil, err
 	}
+	s.opt.FileSize = fi.Size()
 
 	if s.opt.Verifier != nil {
 		err := s.load()
+		if _, ok := err.(*VerifyError); ok && s.opt.ContinueOnError {
+			return s, err
+		}
 		if err != nil {
+			s.file.Close()
 			return nil, err
 		}
 	}
@@ -116,6 +130,8 @@ func Open(path string, opt Options) (s *Stream, err error) {
 // Close ensures that the written file is a valid zip and everything
 // is commited to disk.
 func (s *Stream) Close() error {
+	s.w.Lock()
+	defer s.w.Unlock()
 	s.m.Lock()
 	defer s.m.Unlock()
 
@@ -129,7 +145,7 @@ func (s *Stream) Close() error {
 	}
 
 	// Write out everything, including the end of file dictionary
-	err := s.writeDirectory(0)
+	err := s.writeDirectory(nil)
 	if err != nil {
 		_ = s.file.Close()
 		return err
@@ -139,14 +155,30 @@ func (s *Stream) Close() error {
 
 type Entry struct {
 	Name   string
-	Offset int32 // Offset to the actuall data, not the header.
-	// The data is deflated if and only if CompressedSize < UncompressedSize
-	CompressedSize   int32
-	UncompressedSize int32
+	Offset int64 // Offset to the actuall data, not the header.
+	// The data is compressed if and only if CompressedSize < UncompressedSize
+	CompressedSize   int64
+	UncompressedSize int64
+	// Extra is metadata stored with the entry in an extra field of its own,
+	// that other zip readers ignore.
+	Extra string
+}
+
+// headerOffset returns the offset to the local file header of the entry.
+func (e *Entry) headerOffset() int64 {
+	return e.Offset - 30 - int64(len(e.Name)) - int64(localExtraLen(e.CompressedSize, e.UncompressedSize, e.Extra))
+}
+
+// Size returns the space taken by the entry in the stream, that of its local
+// file header and data.
+func (e *Entry) Size() int64 {
+	return e.Offset + e.CompressedSize - e.headerOffset()
 }
 
 type entry struct {
 	Entry
+	header  int64 // offset to the local file header
+	method  uint16
 	crc     uint32
 	modTime uint16
 	modDate uint16
@@ -157,6 +189,13 @@ type entry struct {
 // will not be returned here.
 func (s *Stream) Contents() (entries []Entry, err error) {
 	s.m.Lock()
+	if !s.loaded {
+		// loading moves the file offset writers use
+		s.m.Unlock()
+		s.w.Lock()
+		defer s.w.Unlock()
+		s.m.Lock()
+	}
 	defer s.m.Unlock()
 
 	if !s.loaded {
@@ -171,104 +210,119 @@ func (s *Stream) Contents() (entries []Entry, err error) {
 	return
 }
 
-// the caller is expected to hold a write lock and it to be loaded
-func (s *Stream) enoughSpace(name string, data []byte) bool {
-	available := int(s.opt.FileSize)
-	names := 0
+// enoughSpace reports whether an entry can be written at offset, leaving room
+// for the directory. The caller is expected to hold a write lock and it to be
+// loaded.
+func (s *Stream) enoughSpace(offset int64, name, extra string, compressedSize, uncompressedSize int64) bool {
+	records := int64(46 + len(name) + directoryExtraLen(compressedSize, uncompressedSize, offset, extra))
+	for _, e := range s.entries {
+		records += e.directoryLen()
+	}
+	for _, e := range s.pending {
+		records += e.directoryLen()
+	}
+	noFiles := len(s.entries) + len(s.pending) + 1
+	header := int64(30 + len(name) + localExtraLen(compressedSize, uncompressedSize, extra))
+
+	return offset+header+compressedSize+s.directoryLen(noFiles, records) < s.opt.FileSize
+}
+
+// dataEnd returns the offset after the last appended entry. The caller is
+// expected to hold a lock.
+func (s *Stream) dataEnd() int64 {
 	if len(s.pending) > 0 {
 		e := s.pending[len(s.pending)-1]
-		available -= int(e.Offset) + int(e.CompressedSize)
-		for _, p := range s.pending {
-			names += len(p.Name)
-		}
+		return e.Offset + e.CompressedSize
 	} else if len(s.entries) > 0 {
 		e := s.entries[len(s.entries)-1]
-		available -= int(e.Offset) + int(e.CompressedSize)
-		for _, e := range s.entries {
-			names += len(e.Name)
-		}
+		return e.Offset + e.CompressedSize
 	}
-	noFiles := len(s.entries) + len(s.pending)
-	eofSize := 46*noFiles + 24 + names
-	available -= eofSize
+	return 0
+}
+
+// directoryLen returns the size of the central directory and end records for
+// noFiles entries whose records are recordsLen bytes.
+func (s *Stream) directoryLen(noFiles int, recordsLen int64) int64 {
+	l := recordsLen + directoryEndLen
+	if s.zip64End(noFiles) {
+		l += directory64EndLen + directory64LocateLen
+	}
+	return l
+}
 
-	available -= 46 + len(name)*2 + 30 + len(data)
+// zip64End reports whether the zip64 end of central directory records are
+// needed, which depends only on the file size such that the directory can
+// be placed at the end of the file.
+func (s *Stream) zip64End(noFiles int) bool {
+	return noFiles >= uint16max || needZip64(s.opt.FileSize)
+}
 
-	return available > 0
+// directoryLen returns the size of the central directory record.
+func (e *entry) directoryLen() int64 {
+	return int64(46 + len(e.Name) + directoryExtraLen(e.CompressedSize, e.UncompressedSize, e.header, e.Extra))
 }
 
-// Append tries to append a file with the given name and data to the file.
+// Append tries to append a file with the given name and data to the file,
+// storing extra with it if not empty.
 // NOTE that this will NOT commit the data to disk, Sync() MUST be called, this
 // allows seceral data pieces to be written at once to avoid disk seek.
 // If it does not fit ErrStreamFull is returned.
-func (s *Stream) Append(name string, data []byte) (Entry, error) {
-	s.m.Lock()
-	defer s.m.Unlock()
-	s.lastRead = -2
+func (s *Stream) Append(name string, data []byte, extra string) (Entry, error) {
+	if len(extra) > MaxExtraSize {
+		return Entry{}, ErrExtraTooLarge
+	}
 
-	if !s.loaded {
-		if err := s.load(); err != nil {
-			return Entry{}, err
-		}
+	// only m is held by reads, which continue while the data is compressed
+	// and written
+	s.w.Lock()
+	defer s.w.Unlock()
+	if err := s.ensureLoaded(); err != nil {
+		return Entry{}, err
 	}
 
-	// figure out if we should compress or not.
-	doCompress := false
+	// figure out if we should compress or not, and with which codec.
+	var compressor Compressor
+	method := uint16(MethodStore)
 	if s.opt.SampleCompressSize > 0 {
-		var testCompression []byte
+		var err error
 		if len(data) <= s.opt.SampleCompressSize {
-			testCompression = data
+			compressor, method, err = s.chooseCodec(data)
 		} else {
-			testCompression = data[:s.opt.SampleCompressSize]
+			compressor, method, err = s.chooseCodec(data[:s.opt.SampleCompressSize])
 		}
-		cw := countWriter{}
-		s.compressor.Reset(&cw)
-		s.compressor.Write(testCompression)
-		s.compressor.Close()
-		if cw.Size() > 0 && cw.Size() < int(s.opt.CompressionThreshold*float32(len(testCompression))) {
-			doCompress = true
+		if err != nil {
+			return Entry{}, err
 		}
 	}
 
 	var buff []byte = data
-	if doCompress {
+	if compressor != nil {
 		// choosing to allocate each time instead of retaining since we assume
 		// the gc cost overhead is relatively small compared to the disk operations we do here anyway.
 		bw := bytes.NewBuffer(make([]byte, 0, len(data)))
-		s.compressor.Reset(bw)
-		n, err := s.compressor.Write(data)
+		compressor.Reset(bw)
+		n, err := compressor.Write(data)
 		if err != nil {
 			return Entry{}, err
 		}
 		if n != len(data) {
 			panic("should not be able to happen?")
 		}
-		if err := s.compressor.Close(); err != nil {
+		if err := compressor.Close(); err != nil {
 			return Entry{}, err
 		}
 		buff = bw.Bytes()
 		if len(buff) >= len(data) {
 			// if compression made it worse - discard it..
 			buff = data
-			doCompress = false
+			method = MethodStore
 		}
 	}
 
-	if !s.enoughSpace(name, buff) {
-		return Entry{}, ErrStreamFull
-	}
-
 	// ensure the file is ready to be written
-	offset := int32(0)
-	if len(s.pending) > 0 {
-		e := s.pending[len(s.pending)-1]
-		offset = e.Offset + e.CompressedSize
-	} else if len(s.entries) > 0 {
-		e := s.entries[len(s.entries)-1]
-		offset = int32(e.Offset + e.CompressedSize)
-	}
-	if !s.lastAppend {
-		s.file.Seek(int64(offset), 0)
+	offset := s.dataEnd()
+	if !s.enoughSpace(offset, name, extra, int64(len(buff)), int64(len(data))) {
+		return Entry{}, ErrStreamFull
 	}
 
 	// calculate the crc
@@ -278,106 +332,330 @@ func (s *Stream) Append(name string, data []byte) (Entry, error) {
 	// we now have the data we should write in buff, but we first need
 	// to write the header.
 	// TODO: should we retain this buffer instead of allocating new?
-	header := make([]byte, 30+len(name))
-	header, time, date := encodeFileHeader(header, false, crc.Sum32(), int32(len(buff)), int32(len(data)), name)
+	compressedSize, uncompressedSize := int64(len(buff)), int64(len(data))
+	zip64 := needZip64(compressedSize) || needZip64(uncompressedSize)
+	headerLen := 30 + len(name) + localExtraLen(compressedSize, uncompressedSize, extra)
+	header, time, date := encodeFileHeader(make([]byte, headerLen, headerLen+len(buff)), false, zip64, method, crc.Sum32(), compressedSize, uncompressedSize, name, extra)
+
+	// the header and data are written at once, such that if the write is
+	// torn by a crash the crc code no longer matches.
+	if _, err := s.file.WriteAt(append(header, buff...), offset); err != nil {
+		return Entry{}, err
+	}
+
+	ee := Entry{Name: name,
+		Offset:           offset + int64(headerLen),
+		UncompressedSize: uncompressedSize,
+		CompressedSize:   compressedSize,
+		Extra:            extra}
+	s.addPending(entry{
+		Entry:   ee,
+		header:  offset,
+		method:  method,
+		crc:     crc.Sum32(),
+		modTime: time,
+		modDate: date,
+	})
+	return ee, nil
+}
+
+// ensureLoaded loads the stream unless it is loaded. The caller is expected
+// to hold w.
+func (s *Stream) ensureLoaded() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.loaded {
+		return nil
+	}
+	return s.load()
+}
+
+// addPending adds e written by an append to the pending entries. The caller
+// is expected to hold w.
+func (s *Stream) addPending(e entry) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	// reads that buffered the data while it was written must not reuse it
+	s.generation++
+	s.pending = append(s.pending, e)
+}
+
+// chooseCodec compresses sample with each codec in the options, and returns
+// the compressor and method of the one compressing it the most, if well
+// enough for the data to be stored compressed. Else a nil Compressor is
+// returned. The caller is expected to hold a write lock.
+func (s *Stream) chooseCodec(sample []byte) (Compressor, uint16, error) {
+	if s.compressors == nil {
+		s.compressors = make(map[uint16]Compressor, len(s.opt.Codecs))
+	}
+	var best Compressor
+	method, size := uint16(MethodStore), int(s.opt.CompressionThreshold*float32(len(sample)))
+	for _, c := range s.opt.Codecs {
+		if dc, ok := c.(deflateDictCodec); ok && dc.dicts.Latest() == nil {
+			// without a dictionary it is plain deflate with a larger header
+			continue
+		}
+		compressor, ok := s.compressors[c.Method()]
+		if !ok {
+			var err error
+			if compressor, err = c.NewCompressor(); err != nil {
+				return nil, 0, err
+			}
+			s.compressors[c.Method()] = compressor
+		}
+		cw := countWriter{}
+		compressor.Reset(&cw)
+		compressor.Write(sample)
+		compressor.Close()
+		if cw.Size() > 0 && cw.Size() < size {
+			best, method, size = compressor, c.Method(), cw.Size()
+		}
+	}
+	return best, method, nil
+}
+
+// AppendFrom appends a file with the given name and extra, and size bytes
+// read from r.
+// The data is compressed as it is written, such that it never needs to be
+// kept in memory. As for Append the data is not commited to disk until Sync
+// is called, and if it does not fit ErrStreamFull is returned.
+func (s *Stream) AppendFrom(name string, r io.Reader, size int64, extra string) (Entry, error) {
+	if len(extra) > MaxExtraSize {
+		return Entry{}, ErrExtraTooLarge
+	}
+
+	s.w.Lock()
+	defer s.w.Unlock()
+	if err := s.ensureLoaded(); err != nil {
+		return Entry{}, err
+	}
+
+	// the start of the data is read first to figure out if we should compress
+	var compressor Compressor
+	method := uint16(MethodStore)
+	if s.opt.SampleCompressSize > 0 {
+		sample := make([]byte, s.opt.SampleCompressSize)
+		if size < int64(len(sample)) {
+			sample = sample[:size]
+		}
+		if _, err := io.ReadFull(r, sample); err != nil {
+			return Entry{}, err
+		}
+		var err error
+		if compressor, method, err = s.chooseCodec(sample); err != nil {
+			return Entry{}, err
+		}
+		r = io.MultiReader(bytes.NewReader(sample), r)
+	}
 
-	if _, err := s.file.Write(header); err != nil {
+	offset := s.dataEnd()
+	zip64 := needZip64(size)
+	headerLen := int64(30 + len(name) + localExtraLen(size, size, extra))
+	compressedSize, crc, err := s.writeData(offset, name, extra, r, size, compressor)
+	if err != nil {
 		return Entry{}, err
 	}
-	if _, err := s.file.Write(buff); err != nil {
+	if compressor != nil && compressedSize >= size {
+		// compressing did not pay off, so the data is stored again after the
+		// compressed copy, which is then wiped.
+		wiped := offset
+		dec, err := s.codec(method).NewDecompressor()
+		if err == nil {
+			err = dec.Reset(io.NewSectionReader(s.file, offset+headerLen, compressedSize), compressedSize)
+		}
+		if err != nil {
+			return Entry{}, err
+		}
+		offset += headerLen + compressedSize
+		compressedSize, crc, err = s.writeData(offset, name, extra, dec, size, nil)
+		if err != nil {
+			return Entry{}, err
+		}
+		if err := s.clearRange(wiped, offset-wiped); err != nil {
+			return Entry{}, err
+		}
+		method = MethodStore
+	}
+
+	// the header is written last since the sizes and crc are not known until
+	// the data has been written.
+	header, time, date := encodeFileHeader(make([]byte, headerLen), false, zip64, method, crc, compressedSize, size, name, extra)
+	if _, err := s.file.WriteAt(header, offset); err != nil {
 		return Entry{}, err
 	}
 
-	s.lastAppend = true
 	ee := Entry{Name: name,
-		Offset:           offset + 30 + int32(len(name)),
-		UncompressedSize: int32(len(data)),
-		CompressedSize:   int32(len(buff))}
-	s.pending = append(s.pending, entry{
+		Offset:           offset + headerLen,
+		UncompressedSize: size,
+		CompressedSize:   compressedSize,
+		Extra:            extra}
+	s.addPending(entry{
 		Entry:   ee,
-		crc:     crc.Sum32(),
+		header:  offset,
+		method:  method,
+		crc:     crc,
 		modTime: time,
 		modDate: date,
 	})
 	return ee, nil
 }
 
+// writeData writes size bytes read from r as the data of an entry with its
+// header at offset, compressed by compressor if not nil, returning the size
+// written and the crc of the data. The caller is expected to hold a write
+// lock.
+func (s *Stream) writeData(offset int64, name, extra string, r io.Reader, size int64, compressor Compressor) (int64, uint32, error) {
+	reserved := size
+	if compressor != nil {
+		// codecs add a few bytes per block to incompressible data
+		reserved = size + size>>12 + 64
+	}
+	if !s.enoughSpace(offset, name, extra, reserved, size) {
+		return 0, 0, ErrStreamFull
+	}
+
+	if _, err := s.file.Seek(offset+int64(30+len(name)+localExtraLen(size, size, extra)), 0); err != nil {
+		return 0, 0, err
+	}
+	bw := bufio.NewWriterSize(s.file, bufferSize)
+	cw := countWriter{w: bw}
+	var w io.Writer = &cw
+	if compressor != nil {
+		compressor.Reset(&cw)
+		w = compressor
+	}
+	crc := crc32.NewIEEE()
+	_, err := io.CopyN(io.MultiWriter(w, crc), r, size)
+	if err == io.EOF {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return int64(cw.Size()), crc.Sum32(), bw.Flush()
+}
+
 // Sync flushes out all the Appended data to the underlying disk (writes and syncs).
 // Note that the end of file dictionary will not be written until Close is called, since data can be recovered by scanning.
 // Note that after an error here 0 or more of the data pieces Appended since last Sync
 // may be missing from the file - they must be read and checked to ensure they are
 // present.
+// Appends and reads continue while the file is synced, the entries appended
+// meanwhile are synced by the next call. Sync must not be called concurrently
+// with Close.
 func (s *Stream) Sync() error {
-	s.m.Lock()
-	defer s.m.Unlock()
-	if !s.loaded {
+	s.w.Lock()
+	if !s.loaded || len(s.pending) == 0 {
+		s.w.Unlock()
 		return nil // nothing to do
 	}
+	n, syncs := len(s.pending), s.syncs
+	s.w.Unlock()
 
-	return s.sync()
+	// the entries are kept pending if the sync fails, since they may not
+	// have reached the disk
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.w.Lock()
+	defer s.w.Unlock()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.syncs == syncs {
+		// else they have been moved by a sync while we synced
+		s.entries = append(s.entries, s.pending[:n]...)
+		s.pending = append(s.pending[:0], s.pending[n:]...)
+		s.syncs++
+	}
+	return nil
 }
 
+// sync syncs the file and moves all pending entries to the synced ones. The
+// caller is expected to hold a write lock.
 func (s *Stream) sync() error {
 	if len(s.pending) <= 0 {
 		return nil
 	}
 
-	err := s.file.Sync()
+	// the entries are kept pending if the sync fails, since they may not
+	// have reached the disk
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
 	s.entries = append(s.entries, s.pending...)
 	s.pending = s.pending[:0]
-	return err
+	s.syncs++
+	return nil
+}
+
+// readState is the state of a single Read. The states are pooled, and a
+// state remembers where its buffered data ends such that a read of the entry
+// following the previous one can continue from the buffer.
+type readState struct {
+	reader        *bufio.Reader
+	decompressors decompressors
+	crc           hash.Hash32
+	buffer        []byte
+
+	next       int64  // offset of the next byte in reader, -1 if unknown
+	generation uint64 // the generation of the stream the buffer was read at
+}
+
+func (s *Stream) getReadState() *readState {
+	if rs, ok := s.readers.Get().(*readState); ok {
+		return rs
+	}
+	return &readState{
+		reader:        bufio.NewReaderSize(nil, bufferSize),
+		decompressors: decompressors{},
+		crc:           crc32.NewIEEE(),
+		buffer:        make([]byte, bufferSize+maxExtraLength),
+		next:          -1,
+	}
 }
 
 // Read out the Entry, optimized for sequential reading of entries after
 // each other. Note that buf must be large enough to hold the uncompressed
-// data or it is an error of type ErrBuffNotSufficient.
+// data or it is an error of type ErrBuffNotSufficient. Read may be called
+// concurrently, all reads are positional and use their own state.
 func (s *Stream) Read(e Entry, buf []byte) (err error) {
 	s.m.RLock()
 	defer s.m.RUnlock()
-	s.lastAppend = false
 
-	offsetToStart := int(e.Offset) - 30 - len(e.Name)
-	if s.lastRead != offsetToStart-1 {
-		// slow-path for now-sequential reads
-		_, err := s.file.Seek(int64(offsetToStart), 0)
-		if err != nil {
-			s.lastRead = -2
-			return err
-		}
-		s.reader.Reset(s.file)
+	rs := s.getReadState()
+	defer s.readers.Put(rs)
+
+	offsetToStart := e.headerOffset()
+	if rs.next != offsetToStart || rs.generation != s.generation {
+		// slow-path for non-sequential reads, or if data has been written
+		// since the buffer was filled
+		rs.reader.Reset(io.NewSectionReader(s.file, offsetToStart, s.opt.FileSize-offsetToStart))
+		rs.generation = s.generation
 	}
-	s.lastRead = -2
+	rs.next = -1
 
 	// thanks to the entry we know the header size we need read out
-	lfh, err := s.decodeFileHeader(offsetToStart, s.buffer, s.reader)
+	lfh, err := s.decodeFileHeader(offsetToStart, rs.buffer, rs.reader)
 	if err != nil {
 		return err
 	}
-	if lfh == nil {
-		return errors.New("zstream: did not find a file at specified offset")
-	}
-
-	if lfh.fileName != e.Name {
-		return errors.New("zstream: name not matching")
-	}
-	if lfh.compressedSize != e.CompressedSize {
-		return errors.New("zstream: compressed size not matchin")
-	}
-	if lfh.uncompressedSize != e.UncompressedSize {
-		return errors.New("zstream: compressed size not matchin")
+	if err := checkHeader(lfh, e); err != nil {
+		return err
 	}
-	if len(buf) < int(lfh.uncompressedSize) {
+	if int64(len(buf)) < lfh.uncompressedSize {
 		return ErrBuffNotSufficient
 	}
 
-	// check the crc and afterwards deflate if needed
-	if s.crc == nil {
-		s.crc = crc32.NewIEEE()
-	}
-	crc := s.crc
+	// check the crc and afterwards decompress if needed
+	crc := rs.crc
 	crc.Reset()
-	if !lfh.deflated() {
-		_, err := io.ReadFull(s.reader, buf[:lfh.uncompressedSize])
+	if !lfh.compressed() {
+		_, err := io.ReadFull(rs.reader, buf[:lfh.uncompressedSize])
 		if err != nil {
 			return err
 		}
@@ -385,16 +663,16 @@ func (s *Stream) Read(e Entry, buf []byte) (err error) {
 		if crc.Sum32() != lfh.cRC {
 			return s.corruptError(offsetToStart, "stored crc code not matching, indicating corrupted data")
 		}
-		s.lastRead = int(e.Offset + e.CompressedSize)
+		rs.next = e.Offset + e.CompressedSize
 		return nil
 	}
 
-	err = s.decompressor.(flate.Resetter).Reset(s.reader, nil)
+	dec, err := rs.decompressors.get(s, lfh.compressionMethod, rs.reader, lfh.compressedSize)
 	if err != nil {
 		return err
 	}
-	n, err := io.ReadFull(s.decompressor, buf[:lfh.uncompressedSize])
-	if n != int(lfh.uncompressedSize) {
+	n, err := io.ReadFull(dec, buf[:lfh.uncompressedSize])
+	if int64(n) != lfh.uncompressedSize {
 		if err != nil {
 			return err
 		}
@@ -405,83 +683,299 @@ func (s *Stream) Read(e Entry, buf []byte) (err error) {
 	if crc.Sum32() != lfh.cRC {
 		return s.corruptError(offsetToStart, "stored crc code not matching, indicating corrupted data")
 	}
-	s.lastRead = int(e.Offset + e.CompressedSize)
+	rs.next = e.Offset + e.CompressedSize
+	return nil
+}
+
+// checkHeader checks that the local file header read at the offset of e
+// describes e.
+func checkHeader(lfh *localFileHeader, e Entry) error {
+	if lfh == nil {
+		return errors.New("zstream: did not find a file at specified offset")
+	}
+	if lfh.fileName != e.Name {
+		return errors.New("zstream: name not matching")
+	}
+	if lfh.compressedSize != e.CompressedSize {
+		return errors.New("zstream: compressed size not matchin")
+	}
+	if lfh.uncompressedSize != e.UncompressedSize {
+		return errors.New("zstream: compressed size not matchin")
+	}
+	return nil
+}
+
+// Open returns a reader of the data of e, that is decompressed as it is
+// read, such that e does not have to fit in memory. The crc code is checked
+// when all data has been read, and a *CorruptError is returned instead of
+// io.EOF if it is not matching. The Stream must not be closed before the
+// reader.
+func (s *Stream) Open(e Entry) (io.ReadCloser, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	offsetToStart := e.headerOffset()
+	header := io.NewSectionReader(s.file, offsetToStart, e.Offset-offsetToStart)
+	lfh, err := s.decodeFileHeader(offsetToStart, make([]byte, bufferSize+maxExtraLength), header)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHeader(lfh, e); err != nil {
+		return nil, err
+	}
+
+	return s.newEntryReader(offsetToStart, lfh)
+}
+
+// Extra returns the Extra stored in the local file header of e, for when e
+// is known without it, as long as its length is known to find the header.
+func (s *Stream) Extra(e Entry) (string, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	offsetToStart := e.headerOffset()
+	header := io.NewSectionReader(s.file, offsetToStart, e.Offset-offsetToStart)
+	lfh, err := s.decodeFileHeader(offsetToStart, make([]byte, bufferSize+maxExtraLength), header)
+	if err != nil {
+		return "", err
+	}
+	if err := checkHeader(lfh, e); err != nil {
+		return "", err
+	}
+	return lfh.extra, nil
+}
+
+// newEntryReader returns a reader of the data following the local file
+// header lfh at offset.
+func (s *Stream) newEntryReader(offset int64, lfh *localFileHeader) (*entryReader, error) {
+	r := &entryReader{s: s, offset: offset, want: lfh.cRC, left: lfh.uncompressedSize, crc: crc32.NewIEEE()}
+	data := io.NewSectionReader(s.file, offset+lfh.size()-lfh.compressedSize, lfh.compressedSize)
+	if !lfh.compressed() {
+		r.r = data
+		return r, nil
+	}
+	dec, err := decompressors{}.get(s, lfh.compressionMethod, bufio.NewReaderSize(data, bufferSize), lfh.compressedSize)
+	if err != nil {
+		return nil, err
+	}
+	r.r = dec
+	return r, nil
+}
+
+// entryReader reads the data of an entry and checks the crc code at the end.
+type entryReader struct {
+	s      *Stream
+	offset int64 // offset to the local file header, for errors
+	r      io.Reader
+	crc    hash.Hash32
+	want   uint32
+	left   int64
+}
+
+func (r *entryReader) Read(p []byte) (n int, err error) {
+	if r.left == 0 {
+		return 0, r.end()
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err = r.r.Read(p)
+	r.crc.Write(p[:n])
+	r.left -= int64(n)
+	if r.left == 0 {
+		return n, r.end()
+	}
+	if err == io.EOF {
+		return n, r.s.corruptError(r.offset, "found EOF before the end of the data")
+	}
+	return n, err
+}
+
+// end returns io.EOF if the crc code matches the data read.
+func (r *entryReader) end() error {
+	if r.crc.Sum32() != r.want {
+		return r.s.corruptError(r.offset, "stored crc code not matching, indicating corrupted data")
+	}
+	return io.EOF
+}
+
+func (r *entryReader) Close() error {
 	return nil
 }
 
 // Wipe removes the given file and overwrites the data twice to ensure that it is
 // gone. Note that this is an expensive call. It is not expected to be used often so ok that it is slow.
+// If Wipe fails or is interrupted the file is either left as is, or removed
+// with the overwriting finished when the stream is next loaded.
 func (s *Stream) Wipe(name string) error {
+	return s.WipeMany([]string{name})[0]
+}
+
+// WipeMany wipes the given files as Wipe, but overwrites them all in the
+// order they are stored and rewrites the directory once, which is much faster
+// than calling Wipe for each. All entries of a name are wiped. It returns the
+// result for each name, a nil error if it was wiped and ErrNoEntry if there
+// is no such entry.
+func (s *Stream) WipeMany(names []string) []error {
+	s.w.Lock()
+	defer s.w.Unlock()
 	s.m.Lock()
 	defer s.m.Unlock()
-	s.lastRead = -2
-	s.lastAppend = false
+	s.generation++
+
+	errs := make([]error, len(names))
+	fail := func(err error) []error {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
 
 	if !s.loaded {
 		if err := s.load(); err != nil {
-			return err
+			return fail(err)
 		}
-	} else {
-		s.sync()
+	} else if err := s.sync(); err != nil {
+		return fail(err)
 	}
 
-	// entries are not sorted so we must do a linear scan.
-	e := entry{Entry: Entry{Offset: -1}}
-	ei := -1
+	// entries are not sorted so we index them by name, and since we synced
+	// we know there is nothing pending.
+	index := make(map[string][]int, len(s.entries))
 	for i := range s.entries {
-		if s.entries[i].Name == name {
-			e = s.entries[i]
-			ei = i
+		index[s.entries[i].Name] = append(index[s.entries[i].Name], i)
+	}
+	type target struct {
+		e   entry
+		lfh *localFileHeader
+	}
+	var targets []target
+	found := make(map[string]bool, len(names))
+	for i, name := range names {
+		eis, ok := index[name]
+		if !ok {
+			errs[i] = ErrNoEntry
+			continue
+		}
+		if !found[name] {
+			found[name] = true
+			for _, ei := range eis {
+				targets = append(targets, target{e: s.entries[ei]})
+			}
 		}
 	}
-	if e.Offset < 0 {
-		// since we synced we know there is nothing pending
-		return errors.New("zstream: no such entry")
+	if len(targets) == 0 {
+		return errs
 	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].e.header < targets[j].e.header })
 
-	// First write random data, after ensuring this is a file
-	offsetToStart := int(e.Offset) - 30 - len(e.Name)
-	if _, err := s.file.Seek(int64(offsetToStart), 0); err != nil {
-		return err
+	// the directory must not be trusted, nor hold the names, if we crash
+	// before it is rewritten
+	if err := s.clearDirectory(); err != nil {
+		return fail(err)
 	}
-	s.reader.Reset(s.file)
-	lfh, err := s.decodeFileHeader(offsetToStart, s.buffer, s.reader)
-	if err != nil {
-		return err
+
+	// ensure these are files before marking them as wiped, all marks are
+	// then synced at once
+	marked := targets[:0]
+	for _, t := range targets {
+		h := t.e.header
+		lfh, err := s.decodeFileHeader(h, s.buffer, io.NewSectionReader(s.file, h, s.opt.FileSize-h))
+		if err == nil && (lfh == nil || lfh.wiped()) {
+			err = s.corruptError(h, "zstream: not a lfh where expected")
+		}
+		if err == nil {
+			if _, ok := wipedZip64(lfh); !ok {
+				err = s.corruptError(h+28, "zstream: unexpected extra fields")
+			}
+		}
+		if err == nil {
+			err = s.markWiped(h)
+		}
+		if err != nil {
+			for i, name := range names {
+				if name == t.e.Name {
+					errs[i] = err
+				}
+			}
+			continue
+		}
+		t.lfh = lfh
+		marked = append(marked, t)
 	}
-	if lfh == nil {
-		return s.corruptError(offsetToStart, "zstream: not a lfh where expected")
+	if err := s.file.Sync(); err != nil {
+		// the marks may still reach the disk, so load must find them
+		s.loaded = false
+		return fail(err)
 	}
 
-	// Write put random data first
-	dataSize := 30 + len(lfh.fileName) + int(lfh.compressedSize)
-	if _, err := s.file.Seek(int64(offsetToStart), 0); err != nil {
-		return err
+	// the entries are now wiped even if we fail or crash before their data
+	// has been overwritten, which load will then finish.
+	headers := make(map[int64]bool, len(marked))
+	for _, t := range marked {
+		headers[t.e.header] = true
+	}
+	entries, removed := s.entries[:0], make([]entry, 0, len(marked))
+	for _, e := range s.entries {
+		if headers[e.header] {
+			removed = append(removed, e)
+		} else {
+			entries = append(entries, e)
+		}
 	}
-	n, err := io.CopyBuffer(s.file, io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), int64(dataSize)), s.buffer)
+	s.entries = entries
+	err := func() error {
+		for _, t := range marked {
+			if err := s.wipeData(t.e.header, t.lfh); err != nil {
+				return err
+			}
+		}
+		// the zeros must be on disk before the headers say they are
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+		for _, t := range marked {
+			if err := s.writeWipedHeader(t.e.header, t.lfh); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
 	if err != nil {
-		// TODO: This error is bad - we should try to recover here since otherwise we might create an all corrupt file that is hard to recover
-		// from.
-		return err
+		// the directory must not be written until they have been finished
+		s.loaded = false
+		return fail(err)
 	}
-	if int(n) != dataSize {
-		// TODO: This error is bad - we should try to recover here since otherwise we might create an all corrupt file that is hard to recover
-		// from.
-		return errors.New("zstream: did not manage to write the random data")
+	if err := s.writeDirectory(removed); err != nil {
+		return fail(err)
 	}
+	return errs
+}
 
-	// Now we need to write out zero data, and also calculate the correct crc
-	// code such that we still have a valid zip for a recover program.
+// clearRange overwrites size bytes at offset with zeros, headed by a local
+// file header marking the range as wiped. The zeros are described by the
+// header with the correct crc code such that we still have a valid zip for
+// a recover program. A range to large for the header is described by a zip64
+// extra field at its start, that is not part of the zeros. The caller is
+// expected to hold a write lock.
+func (s *Stream) clearRange(offset, size int64) error {
+	zip64 := needZip64(size - 30)
+	zerosStart := offset + 30
+	if zip64 {
+		zerosStart += localExtraLen64
+	}
 	crc := crc32.NewIEEE()
-	if _, err := s.file.Seek(int64(offsetToStart+30), 0); err != nil {
+	if _, err := s.file.Seek(zerosStart, 0); err != nil {
 		return err
 	}
 	for i := range s.buffer {
 		s.buffer[i] = 0
 	}
 	var b []byte
-	for toWrite := dataSize - 30; toWrite > 0; toWrite -= len(b) {
-		if toWrite > len(s.buffer) {
+	for toWrite := offset + size - zerosStart; toWrite > 0; toWrite -= int64(len(b)) {
+		if toWrite > int64(len(s.buffer)) {
 			b = s.buffer
 		} else {
 			b = s.buffer[:toWrite]
@@ -493,37 +987,63 @@ func (s *Stream) Wipe(name string) error {
 		crc.Write(b)
 	}
 
-	b, _, _ = encodeFileHeader(s.buffer, true, crc.Sum32(), int32(dataSize)-30, int32(dataSize)-30, "")
-	_, err = s.file.Seek(int64(offsetToStart), 0)
-	if err != nil {
-		return err
-	}
-	_, err = s.file.Write(b)
-	if err != nil {
-		return err
-	}
-
-	s.entries = append(s.entries[:ei], s.entries[ei+1:]...)
-	return s.writeDirectory(len(lfh.fileName))
+	zeros := offset + size - zerosStart
+	b, _, _ = encodeFileHeader(s.buffer, true, zip64, MethodStore, crc.Sum32(), zeros, zeros, "", "")
+	_, err := s.file.WriteAt(b, offset)
+	return err
 }
 
 // load opens the file for writing and or verification. The caller is expected to hold
-// a write lock. Note that we are scanning the file instead of using a directory - since
-// we need to be able to open files that were not properly closed.
+// a write lock. Note that unless the directory can be trusted we are scanning the file,
+// since we need to be able to open files that were not properly closed.
 func (s *Stream) load() (err error) {
-	s.compressor, err = flate.NewWriter(nil, s.opt.CompressionLevel)
-	s.lastAppend = false
-	s.lastRead = -2
+	s.generation++
 
-	buf := make([]byte, bufferSize) // This should be cached in the struct?
+	// the data must be read to verify it, else the directory is used if the
+	// stream was properly closed
+	if s.opt.Verifier == nil && s.loadDirectory() {
+		s.loaded = true
+		return nil
+	}
+
+	buf := make([]byte, bufferSize+maxExtraLength) // This should be cached in the struct?
 	// TODO: if we have a verifier allocate a larger buffer since we will need to read the entire data stream
 	reader := s.reader
-	offset := 0
+	offset := int64(0)
+	var bad []BadEntry
+	s.entries = s.entries[:0]
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return err
+	}
 	reader.Reset(s.file)
 
+	// a bad entry is taken to be torn by a crash, which ends the data, only
+	// when no valid entry follows it. Any other is corruption to report.
 	for {
 		offs := offset
 		lfh, err := s.decodeFileHeader(offset, buf, reader)
+		if _, ok := err.(*CorruptError); ok {
+			next, ferr := s.nextEntry(offset + 1)
+			if ferr != nil {
+				return ferr
+			}
+			if s.opt.Verifier == nil {
+				if next < 0 {
+					break
+				}
+				return err
+			}
+			bad = append(bad, BadEntry{Offset: offs, Err: err.Error()})
+			if !s.opt.ContinueOnError || next < 0 {
+				break
+			}
+			offset = next
+			if _, err := s.file.Seek(offset, 0); err != nil {
+				return err
+			}
+			reader.Reset(s.file)
+			continue
+		}
 		if err != nil {
 			return err
 		}
@@ -532,119 +1052,153 @@ func (s *Stream) load() (err error) {
 		}
 
 		if lfh.wiped() {
-			offset += 30 + len(lfh.fileName) + int(lfh.compressedSize)
-			if _, err := s.file.Seek(int64(offset), 0); err != nil {
+			if !wipeFinished(lfh) {
+				if err := s.finishWipe(offset, lfh); err != nil {
+					return err
+				}
+				if err := s.file.Sync(); err != nil {
+					return err
+				}
+			}
+			offset += lfh.size()
+			if _, err := s.file.Seek(offset, 0); err != nil {
 				return err
 			}
 			reader.Reset(s.file)
 			continue
 		}
 
-		if s.opt.Verifier != nil {
-			if err := s.verifyData(offset, buf, lfh, reader); err != nil {
-				return errors.New("sss" + err.Error())
+		if offset+lfh.size() > s.opt.FileSize {
+			// the scan cannot continue after a truncated entry
+			if s.opt.Verifier != nil {
+				bad = append(bad, BadEntry{Name: lfh.fileName, Offset: offs, Err: "data extends beyond the file"})
 			}
-			offset += 30 + len(lfh.fileName) + int(lfh.compressedSize)
-		} else {
-			offset += 30 + len(lfh.fileName) + int(lfh.compressedSize)
-			if _, err := s.file.Seek(int64(offset), 0); err != nil {
+			break
+		}
+		// without a verifier the crc is still checked, since entries
+		// appended but not synced before a crash may be torn.
+		verr := s.verifyData(lfh, reader)
+		offset += lfh.size()
+		if verr != nil {
+			// the data may hold what looks like entries, so the next one is
+			// looked for after it.
+			next, err := s.nextEntry(offset)
+			if err != nil {
 				return err
 			}
-			reader.Reset(s.file)
-
+			if s.opt.Verifier == nil {
+				if next < 0 {
+					break
+				}
+				return s.corruptError(offs, verr.Error())
+			}
+			bad = append(bad, BadEntry{Name: lfh.fileName, Offset: offs, Err: verr.Error()})
+			if !s.opt.ContinueOnError || next < 0 {
+				break
+			}
+			offset = next
+		}
+		if _, err := s.file.Seek(offset, 0); err != nil {
+			return err
+		}
+		reader.Reset(s.file)
+		if verr != nil {
+			continue
 		}
 
 		s.entries = append(s.entries, entry{Entry: Entry{
 			Name:             lfh.fileName,
-			Offset:           int32(offs) + 30 + int32(len(lfh.fileName)),
+			Offset:           offs + 30 + int64(lfh.fileNameLength) + int64(lfh.extraLength),
 			CompressedSize:   lfh.compressedSize,
 			UncompressedSize: lfh.uncompressedSize,
+			Extra:            lfh.extra,
 		},
+			header:  offs,
+			method:  lfh.compressionMethod,
 			crc:     lfh.cRC,
 			modTime: lfh.modificationTime,
 			modDate: lfh.modificationDate,
 		})
 	}
 
+	if len(bad) > 0 && !s.opt.ContinueOnError {
+		s.entries = s.entries[:0]
+		return &VerifyError{File: s.file.Name(), Entries: bad}
+	}
 	s.loaded = true
+	if len(bad) > 0 {
+		return &VerifyError{File: s.file.Name(), Entries: bad}
+	}
 	return nil
 }
 
-// verify both that the crc code and that the verifier gives the correct values,
-// this requires uncompression.
-func (s *Stream) verifyData(offset int, buf []byte, lfh *localFileHeader, r *bufio.Reader) error {
+// verifyData checks both that the crc code and that the verifier, if any,
+// gives the correct values, this requires uncompression.
+func (s *Stream) verifyData(lfh *localFileHeader, r *bufio.Reader) error {
 	var re io.Reader = r
-	if lfh.deflated() {
-		s.decompressor.(flate.Resetter).Reset(r, nil)
-		re = s.decompressor
+	if lfh.compressed() {
+		dec, err := s.decompressors.get(s, lfh.compressionMethod, r, lfh.compressedSize)
+		if err != nil {
+			return errors.New("unable to read out contents: " + err.Error())
+		}
+		re = dec
 	}
 
 	crc := crc32.NewIEEE()
 	var mw io.Writer = crc
-
-	s.opt.Verifier.Reset()
-	mw = io.MultiWriter(crc, s.opt.Verifier)
-
-	n, err := io.CopyN(mw, re, int64(lfh.uncompressedSize))
-	if err != nil {
-		return err
+	if s.opt.Verifier != nil {
+		s.opt.Verifier.Reset()
+		mw = io.MultiWriter(crc, s.opt.Verifier)
 	}
-	if n != int64(lfh.uncompressedSize) {
-		if err != nil {
-			return s.corruptError(-1, "unable to read out contents: "+err.Error())
-		}
-		return s.corruptError(-1, "specified contents extends beyond file")
+
+	if _, err := io.CopyN(mw, re, lfh.uncompressedSize); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("data shorter than the stored size")
+	} else if err != nil {
+		return errors.New("unable to read out contents: " + err.Error())
 	}
 
 	if crc.Sum32() != lfh.cRC {
-		return s.corruptError(offset+14, "crc not matching stored data")
+		return errors.New("crc not matching stored data")
 	}
-	if s.opt.Verifier != nil && !s.opt.Verifier.Match(lfh.fileName) {
-		return s.corruptError(offset+30, "filename not matching the expected: "+lfh.fileName)
+	if s.opt.Verifier != nil && !matches(s.opt.Verifier, lfh) {
+		return errors.New("entry not matching the expected: " + lfh.fileName)
 	}
 	return nil
 }
 
-func (s *Stream) writeDirectory(fileLength int) error {
-	// ensure that if a directory was previously written we overwrite it all with zeros
-	// if the new one is shorted (at a wipe) to ensure we are not leaking data. We do this
-	// by reading backwards block wise to wipe the data, then re-writing.
-	// expects caller to hold a write lock.
-
-	s.lastAppend = false
-	s.lastRead = -2
-
-	if fileLength != 0 {
-		// this is the amount of extra data that might need to be overwritten
-		// to ensure the file name is removed at a wipe.
-
-		fileLength += 46
-	}
+// writeDirectory writes the central directory and end records at the end of
+// the file and syncs it. If entries have been removed they are given as
+// removed, and the space their records used is overwritten with zeros to not
+// leak their names. The caller is expected to hold a write lock.
+func (s *Stream) writeDirectory(removed []entry) error {
+	s.generation++
 
 	if err := s.sync(); err != nil {
-		return nil
+		return err
 	}
 
-	oldLen, newLen := fileLength, 24
+	records := int64(0)
 	for _, e := range s.entries {
-		newLen += 46 + len(e.Name)
+		records += e.directoryLen()
+	}
+	newLen := s.directoryLen(len(s.entries), records)
+	oldRecords := records
+	for _, e := range removed {
+		oldRecords += e.directoryLen()
 	}
-	oldLen += newLen
+	oldLen := s.directoryLen(len(s.entries)+len(removed), oldRecords)
 
-	if _, err := s.file.Seek(int64(s.opt.FileSize)-int64(oldLen), 0); err != nil {
+	if _, err := s.file.Seek(s.opt.FileSize-oldLen, 0); err != nil {
 		return err
 	}
 
 	if oldLen > newLen {
 		for i := range s.buffer {
 			s.buffer[i] = 0
-			if i > (oldLen - newLen) {
-				break
-			}
 		}
 		var b []byte
-		for toWipe := oldLen - newLen; toWipe > 0; toWipe -= len(b) {
-			if toWipe > len(s.buffer) {
+		for toWipe := oldLen - newLen; toWipe > 0; toWipe -= int64(len(b)) {
+			if toWipe > int64(len(s.buffer)) {
 				b = s.buffer
 			} else {
 				b = s.buffer[:toWipe]
@@ -661,29 +1215,21 @@ func (s *Stream) writeDirectory(fileLength int) error {
 	for _, e := range s.entries {
 		w.Write(encodeDirectoryHeader(s.buffer,
 			false,
+			e.method,
 			e.crc,
 			e.CompressedSize,
 			e.UncompressedSize,
-			e.Name, e.modTime, e.modDate, e.Offset-30-int32(len(e.Name))))
+			e.Name, e.Extra, e.modTime, e.modDate, e.header))
 	}
 
 	// finally write out the eocd record to end the file
-	w.Write(directoryEndStream)
-	binary.LittleEndian.PutUint16(s.buffer[4-4:], 0)
-	binary.LittleEndian.PutUint16(s.buffer[6-4:], 0)
-	binary.LittleEndian.PutUint16(s.buffer[8-4:], uint16(len(s.entries)))
-	binary.LittleEndian.PutUint16(s.buffer[10-4:], uint16(len(s.entries)))
-	binary.LittleEndian.PutUint32(s.buffer[12-4:], uint32(newLen-24))
-
-	if len(s.entries) > 0 {
-		binary.LittleEndian.PutUint32(s.buffer[16-4:], uint32(s.opt.FileSize)-uint32(newLen))
-
-	} else {
-		binary.LittleEndian.PutUint32(s.buffer[16-4:], 0)
+	offset := s.opt.FileSize - newLen
+	if len(s.entries) == 0 {
+		offset = 0
 	}
-	binary.LittleEndian.PutUint16(s.buffer[20-4:], 2)
-	binary.LittleEndian.PutUint16(s.buffer[22-4:], 0)
-	w.Write(s.buffer[:22-4+2])
-
-	return w.Flush()
+	w.Write(encodeDirectoryEnd(s.buffer, s.zip64End(len(s.entries)), len(s.entries), records, offset))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
 }